@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+// bowness-list verifies signed metadata (for instance Bowness' cache file)
+// and lists the entities in it. Use - as the metadata file to read from stdin.
+//
+//	bowness-list -jwks /path/to/jwks [-format table|json|jsonl] <metadata file or ->
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/joesiltberg/bowness/fedtls"
+)
+
+// The listed information about an entity
+type entitySummary struct {
+	EntityID       string   `json:"entity_id"`
+	Organization   *string  `json:"organization"`
+	OrganizationID *string  `json:"organization_id"`
+	Pins           []string `json:"pins"`
+}
+
+func summarize(entity *fedtls.Entity) entitySummary {
+	summary := entitySummary{
+		EntityID:       entity.EntityID,
+		Organization:   entity.Organization,
+		OrganizationID: entity.OrganizationID,
+		Pins:           []string{},
+	}
+
+	for _, client := range entity.Clients {
+		for _, pin := range client.Pins {
+			summary.Pins = append(summary.Pins, pin.Digest)
+		}
+	}
+	return summary
+}
+
+func orEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func printTable(w io.Writer, entities []entitySummary) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENTITY ID\tORGANIZATION\tORGANIZATION ID\tPINS")
+
+	for _, e := range entities {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.EntityID, orEmpty(e.Organization),
+			orEmpty(e.OrganizationID), strings.Join(e.Pins, ","))
+	}
+	return tw.Flush()
+}
+
+func printJSON(w io.Writer, entities []entitySummary) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entities)
+}
+
+// One JSON object per entity and line
+func printJSONLines(w io.Writer, entities []entitySummary) error {
+	enc := json.NewEncoder(w)
+
+	for _, e := range entities {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	jwksPath := flag.String("jwks", "", "path to the federation's JWKS (or a directory of JWK files)")
+	format := flag.String("format", "table", "output format (table, json or jsonl)")
+	flag.Parse()
+
+	if *jwksPath == "" || flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s -jwks <JWKS file> [-format table|json|jsonl] <metadata file or ->\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	printers := map[string]func(io.Writer, []entitySummary) error{
+		"table": printTable,
+		"json":  printJSON,
+		"jsonl": printJSONLines,
+	}
+
+	printer, ok := printers[*format]
+	if !ok {
+		log.Fatalf("Unknown format %s, expected table, json or jsonl", *format)
+	}
+
+	file, err := fedtls.ReadMetadataFile(*jwksPath, flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	md := file.Metadata
+
+	entities := make([]entitySummary, len(md.Entities))
+	for i := range md.Entities {
+		entities[i] = summarize(&md.Entities[i])
+	}
+
+	if err := printer(os.Stdout, entities); err != nil {
+		log.Fatalf("Failed to write output: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+// bowness-verify verifies signed metadata the same way Bowness does and
+// prints its protected headers and a summary of the metadata. Use - as the
+// metadata file to read from stdin.
+//
+//	curl -s https://md.example.com/md.jws | bowness-verify -jwks /path/to/jwks -
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/joesiltberg/bowness/fedtls"
+)
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
+
+func main() {
+	jwksPath := flag.String("jwks", "", "path to the federation's JWKS (or a directory of JWK files)")
+	issuer := flag.String("issuer", "", "require this issuer (iss header)")
+	flag.Parse()
+
+	if *jwksPath == "" || flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s -jwks <JWKS file> [-issuer <issuer>] <metadata file or ->\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	file, err := fedtls.ReadMetadataFile(*jwksPath, flag.Arg(0), fedtls.ExpectedIssuer(*issuer))
+	if err != nil {
+		fail("%v", err)
+	}
+	md := file.Metadata
+
+	// The signature is verified, so the headers can be trusted
+	protected, err := file.ProtectedHeaders()
+	if err != nil {
+		fail("%v", err)
+	}
+
+	headers, err := json.MarshalIndent(protected, "", "  ")
+	if err != nil {
+		fail("Failed to encode headers: %v", err)
+	}
+
+	fmt.Printf("Protected headers: %s\n", headers)
+	fmt.Printf("Version: %s\n", md.Version)
+	fmt.Printf("Cache TTL: %d\n", md.CacheTTL)
+	fmt.Printf("Entities: %d\n", len(md.Entities))
+
+	// For pinning with JWKSThumbprints
+	thumbprints, err := fedtls.JWKSThumbprints(file.JWKS)
+	if err != nil {
+		fail("Failed to compute JWKS thumbprints: %v", err)
+	}
+	fmt.Printf("JWKS thumbprints: %s\n", strings.Join(thumbprints, " "))
+}
@@ -0,0 +1,40 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// An activityTracker keeps track of the number of open client connections
+// and the number of requests currently being handled
+type activityTracker struct {
+	connections atomic.Int64
+	requests    atomic.Int64
+}
+
+// connState should be used as the http.Server's ConnState hook
+func (t *activityTracker) connState(c net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		t.connections.Add(1)
+	case http.StateClosed, http.StateHijacked:
+		t.connections.Add(-1)
+	}
+}
+
+// middleware counts the requests in progress
+func (t *activityTracker) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.requests.Add(1)
+		defer t.requests.Add(-1)
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/joesiltberg/bowness/fedtls"
+	"github.com/joesiltberg/bowness/server"
+)
+
+// An auditLog writes metadata refreshes and authentication decisions to a
+// file, one JSON object per line. The file is only appended to, rotation is
+// left to external tools (which should use copytruncate or similar).
+type auditLog struct {
+	file *os.File
+	lock sync.Mutex
+}
+
+// An audit record, fields not relevant for the event are omitted
+type auditRecord struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+
+	// Metadata refreshes
+	URL      string `json:"url,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Entities *int   `json:"entities,omitempty"`
+
+	// The metadata in effect after a refresh, or the one an
+	// authentication decision was based on
+	MetadataHash string `json:"metadata_hash,omitempty"`
+
+	// Authentication decisions
+	RemoteAddr  string `json:"remote_addr,omitempty"`
+	EntityID    string `json:"entity_id,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file}, nil
+}
+
+func (a *auditLog) write(record *auditRecord) {
+	line, err := json.Marshal(record)
+
+	if err != nil {
+		log.Printf("Failed to encode audit record: %v", err)
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write to audit log: %v", err)
+	}
+}
+
+// Returns a result string and an error message for a record
+func outcome(err error, success, failure string) (string, string) {
+	if err != nil {
+		return failure, err.Error()
+	}
+	return success, ""
+}
+
+func (a *auditLog) metadataRefresh(event *fedtls.RefreshEvent) {
+	record := &auditRecord{
+		Time:   time.Now(),
+		Event:  "metadata_refresh",
+		URL:    event.URL,
+		Source: event.Source,
+	}
+	record.Result, record.Error = outcome(event.Err, "success", "failure")
+
+	if event.Err == nil {
+		record.Entities = &event.Entities
+		record.MetadataHash = event.MetadataHash
+	}
+	a.write(record)
+}
+
+func (a *auditLog) authentication(event *server.AuthEvent) {
+	record := &auditRecord{
+		Time:         event.Time,
+		Event:        "authentication",
+		RemoteAddr:   event.RemoteAddr,
+		EntityID:     event.EntityID,
+		Fingerprint:  event.Fingerprint,
+		MetadataHash: event.MetadataHash,
+	}
+	record.Result, record.Error = outcome(event.Err, "granted", "denied")
+	a.write(record)
+}
+
+func (a *auditLog) Close() error {
+	return a.file.Close()
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/joesiltberg/bowness/fedtls"
+)
+
+// When Bowness was started, for the uptime
+var startTime = time.Now()
+
+// A snapshot of the state of Bowness, for support
+type diagnostics struct {
+	Version       string  `json:"version"`
+	GoVersion     string  `json:"go_version"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	Goroutines    int     `json:"goroutines"`
+
+	Memory struct {
+		HeapAllocBytes uint64 `json:"heap_alloc_bytes"`
+		HeapObjects    uint64 `json:"heap_objects"`
+		SysBytes       uint64 `json:"sys_bytes"`
+		NumGC          uint32 `json:"num_gc"`
+	} `json:"memory"`
+
+	Metadata struct {
+		Loaded        bool                 `json:"loaded"`
+		LastUpdate    *time.Time           `json:"last_update,omitempty"`
+		LastError     string               `json:"last_error,omitempty"`
+		InitialSource string               `json:"initial_source,omitempty"`
+		NextRefresh   *time.Time           `json:"next_refresh,omitempty"`
+		Stats         fedtls.MetadataStats `json:"stats"`
+	} `json:"metadata"`
+
+	ActiveConnections int64 `json:"active_connections"`
+	ActiveRequests    int64 `json:"active_requests"`
+}
+
+// Returns nil for the zero time, so it's left out of the JSON
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+// Serves a diagnostics snapshot as JSON, only to clients on the loopback
+// interface
+func diagnosticsHandler(mdstore *fedtls.MetadataStore, activity *activityTracker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, "Diagnostics are only available from localhost", http.StatusForbidden)
+			return
+		}
+
+		var diag diagnostics
+		diag.Version = version
+		diag.GoVersion = runtime.Version()
+		diag.UptimeSeconds = time.Since(startTime).Seconds()
+		diag.Goroutines = runtime.NumGoroutine()
+
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		diag.Memory.HeapAllocBytes = mem.HeapAlloc
+		diag.Memory.HeapObjects = mem.HeapObjects
+		diag.Memory.SysBytes = mem.Sys
+		diag.Memory.NumGC = mem.NumGC
+
+		status := mdstore.Status()
+		diag.Metadata.Loaded = status.Loaded
+		diag.Metadata.LastUpdate = optionalTime(status.LastUpdate)
+		if status.LastError != nil {
+			diag.Metadata.LastError = status.LastError.Error()
+		}
+		diag.Metadata.InitialSource = status.InitialSource
+		diag.Metadata.NextRefresh = optionalTime(status.NextRefresh)
+		diag.Metadata.Stats = status.Stats
+
+		diag.ActiveConnections = activity.connections.Load()
+		diag.ActiveRequests = activity.requests.Load()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&diag)
+	})
+}
@@ -10,19 +10,25 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"expvar"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
+	"runtime"
+	"runtime/debug"
 	"syscall"
 	"time"
 
 	"github.com/joesiltberg/bowness/fedtls"
 	"github.com/joesiltberg/bowness/server"
+	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/spf13/viper"
 	"golang.org/x/time/rate"
 )
@@ -41,50 +47,265 @@ func verifyRequired(keys ...string) {
 	}
 }
 
-func stripHeader(h http.Handler, header string) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		r2 := *r
-		r2.Header = r.Header.Clone()
-		r2.Header.Del(header)
-		h.ServeHTTP(w, &r2)
-	})
+// Creates the transport used for all requests to backends
+func newBackendTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = viper.GetInt("BackendMaxIdleConns")
+	transport.MaxIdleConnsPerHost = viper.GetInt("BackendMaxIdleConnsPerHost")
+	transport.IdleConnTimeout = configuredSeconds("BackendIdleConnTimeout")
+	return transport
 }
 
-func newReverseProxy(target *url.URL) http.Handler {
-	return stripHeader(httputil.NewSingleHostReverseProxy(target), "X-Forwarded-For")
+// Creates a reverse proxy to a backend, configured according to the
+// global proxy settings
+func newBackend(targetURL string, transport http.RoundTripper) http.Handler {
+	target, err := url.Parse(targetURL)
+
+	if err != nil {
+		log.Fatalf("Failed to parse target URL (%s): %v", targetURL, err)
+	}
+
+	// Some entities or organizations may be sent to other paths
+	var entityPrefixes []server.EntityPrefix
+	must(viper.UnmarshalKey("EntityPathPrefixes", &entityPrefixes))
+
+	var backend http.Handler = server.NewReverseProxy(target,
+		server.ProxyTransport(transport),
+		server.ProxyEntityPrefixes(entityPrefixes, viper.GetString("DefaultEntityPathPrefix")),
+		server.ProxyFlushInterval(configuredMilliseconds("ProxyFlushInterval")),
+		server.ProxyBufferSize(viper.GetInt("ProxyBufferSize")),
+		server.ProxyForwardedHeaders(viper.GetBool("ForwardedHeaders")),
+		server.ProxyRewritePrefix(viper.GetString("StripPathPrefix"),
+			viper.GetString("ReplacePathPrefix"),
+			viper.GetBool("RejectUnmatchedPathPrefix")))
+
+	// CONNECT tunnels go to the same backend as other requests, so they
+	// get the same routing and limits
+	if viper.GetBool("EnableConnect") {
+		backend = server.ConnectTunnel(backend, target)
+	}
+	return backend
+}
+
+// A routeConfig is the configuration of a route to a separate backend
+type routeConfig struct {
+	TargetURL       string
+	EntityIDs       []string
+	OrganizationIDs []string
+
+	// Seconds, overrides BackendTimeout if not 0
+	Timeout int
+}
+
+// An entityConcurrencyConfig overrides MaxConcurrentRequestsPerEntity for
+// some entities
+type entityConcurrencyConfig struct {
+	EntityIDs []string
+
+	// Zero means no limit
+	Max int
+}
+
+// A backendConfig is one of several replicas of the default backend
+type backendConfig struct {
+	TargetURL string
+
+	// nil means 1, 0 means no requests are sent to the backend
+	Weight *int
 }
 
 func configuredSeconds(setting string) time.Duration {
 	return time.Duration(viper.GetInt(setting)) * time.Second
 }
 
+func configuredMilliseconds(setting string) time.Duration {
+	return time.Duration(viper.GetInt(setting)) * time.Millisecond
+}
+
+// CachePath is either a single path or a list of paths, where the first
+// is the primary cache and the others are secondary caches
+func configuredCachePaths() (string, []string) {
+	if _, isList := viper.Get("CachePath").([]interface{}); !isList {
+		return viper.GetString("CachePath"), nil
+	}
+
+	paths := viper.GetStringSlice("CachePath")
+	if len(paths) == 0 {
+		log.Fatalf("CachePath is an empty list")
+	}
+	return paths[0], paths[1:]
+}
+
 func waitForShutdownSignal() {
-	signals := make(chan os.Signal)
+	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
 	<-signals
 }
 
+// Makes sure our server certificate is issued by an issuer in metadata, or
+// by the CA in ServerCertCAFile if set. Exits if it isn't.
+func validateServerCert(certFile string, mdstore *fedtls.MetadataStore) {
+	var roots *x509.CertPool
+
+	if caFile := viper.GetString("ServerCertCAFile"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			log.Fatalf("Failed to read server certificate CA file (%s): %v", caFile, err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates found in server certificate CA file (%s)", caFile)
+		}
+	} else {
+		timeout := configuredSeconds("ServerCertValidationTimeout")
+		deadline := time.Now().Add(timeout)
+
+		for !mdstore.Status().Loaded {
+			if time.Now().After(deadline) {
+				log.Fatalf("No metadata loaded within %v, can't validate the server certificate", timeout)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		roots = server.IssuerPool(mdstore.GetIssuerCertificates())
+	}
+
+	if err := server.VerifyServerCertificate(certFile, roots); err != nil {
+		log.Fatalf("Server certificate validation failed: %v", err)
+	}
+	log.Printf("Server certificate is issued by a trusted issuer")
+}
+
+// Something loaded from a file, such as the deny list
+type reloadable interface {
+	Load(path string) error
+	Len() int
+}
+
+// Reloads a file every time we get a SIGHUP, if it fails the previous
+// contents are kept
+func reloadOnSIGHUP(name string, r reloadable, path string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			if err := r.Load(path); err != nil {
+				log.Printf("Failed to reload %s, keeping the previous one: %v", name, err)
+			} else {
+				log.Printf("Reloaded %s with %d entries", name, r.Len())
+			}
+		}
+	}()
+}
+
 // This is meant to be set at build time with -ldflags,
 // for instance with "git describe" or a hard coded version number.
 var version = "version not set at build time"
 
+// Serves the version and build information as JSON
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	info := map[string]string{
+		"version":    version,
+		"go_version": runtime.Version(),
+	}
+
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			switch setting.Key {
+			case "vcs.revision", "vcs.time", "vcs.modified":
+				info[setting.Key] = setting.Value
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
 func main() {
 	viper.SetEnvPrefix("BWNS")
 	viper.AutomaticEnv()
 
 	viper.SetDefault("MetadataURL", "https://md.swefed.se/kontosynk/kontosynk-prod-1.jws")
 	viper.SetDefault("DefaultCacheTTL", 3600)
+	viper.SetDefault("MinCacheTTL", 0)
 	viper.SetDefault("NetworkRetry", 60)
+	viper.SetDefault("MinRefreshInterval", 0)
 	viper.SetDefault("BadContentRetry", 3600)
+	viper.SetDefault("BadContentThreshold", 0)
 	viper.SetDefault("ReadHeaderTimeout", 5)
 	viper.SetDefault("ReadTimeout", 20)
 	viper.SetDefault("WriteTimeout", 40)
 	viper.SetDefault("IdleTimeout", 60)
+	viper.SetDefault("MaxHeaderBytes", 0)
+	viper.SetDefault("MaxHeaderCount", 0)
 	viper.SetDefault("BackendTimeout", 30)
 	viper.SetDefault("EnableLimiting", false)
 	viper.SetDefault("LimitRequestsPerSecond", 10.0)
 	viper.SetDefault("LimitBurst", 50)
+	viper.SetDefault("ColdStartErrors", true)
+	viper.SetDefault("ProxyFlushInterval", 0)
+	viper.SetDefault("ProxyBufferSize", 0)
+	viper.SetDefault("MaxConcurrentRequests", 0)
+	viper.SetDefault("MaxConcurrentRequestsPerEntity", 0)
+	viper.SetDefault("SlowRequestThreshold", 0)
+	viper.SetDefault("EnableCompression", false)
+	viper.SetDefault("CompressionMinSize", 1024)
+	viper.SetDefault("ConcurrencyQueueTimeout", 0)
+	viper.SetDefault("LogTLSParameters", false)
+	viper.SetDefault("LogDenials", "full")
+	viper.SetDefault("RecheckAuth", false)
+	viper.SetDefault("DrainRemovedEntities", false)
+	viper.SetDefault("LogDeniedCertificates", false)
+	viper.SetDefault("DenialStatus", http.StatusForbidden)
+	viper.SetDefault("UserIDHeader", "X-FedTLSAuth-User-ID")
+	viper.SetDefault("BackendTokenAlgorithm", "ES256")
+	viper.SetDefault("BackendTokenHeader", "Authorization")
+	viper.SetDefault("BackendTokenPrefix", "Bearer ")
+	viper.SetDefault("BackendTokenLifetime", 60)
+	viper.SetDefault("BackendTokenEntityIDClaim", "sub")
+	viper.SetDefault("BackendTokenOrganizationClaim", "org")
+	viper.SetDefault("BackendTokenOrganizationIDClaim", "org_id")
+	viper.SetDefault("NonceWindow", 300)
+	viper.SetDefault("CollapseSlashes", false)
+	viper.SetDefault("IgnorePathCase", false)
+	viper.SetDefault("TrimTrailingSlash", false)
+	viper.SetDefault("RewriteNormalizedPath", false)
+	viper.SetDefault("OrganizationRequestMetric", false)
+	viper.SetDefault("OrganizationMetricMaxLabels", 1000)
+	viper.SetDefault("DenialLogInterval", 60)
+	viper.SetDefault("BackendMaxIdleConns", 256)
+	viper.SetDefault("BackendMaxIdleConnsPerHost", 64)
+	viper.SetDefault("BackendIdleConnTimeout", 90)
+	viper.SetDefault("BackendPrewarmConnections", 0)
+	viper.SetDefault("ShutdownTimeout", 0)
+	viper.SetDefault("ReadOnlyCache", false)
+	viper.SetDefault("MaxCacheAge", 0)
+	viper.SetDefault("MaxCacheAgeWait", 10)
+	viper.SetDefault("LenientMetadataParsing", false)
+	viper.SetDefault("RemovedPinGrace", 0)
+	viper.SetDefault("DetachedPayload", false)
+	viper.SetDefault("EnableConnect", false)
+	viper.SetDefault("MaxConnectionLifetime", 0)
+	viper.SetDefault("TCPKeepAlive", 15)
+	viper.SetDefault("AcceptRate", 0.0)
+	viper.SetDefault("AcceptBurst", 100)
+	viper.SetDefault("AcceptRateDrop", false)
+	viper.SetDefault("SourceAcceptRate", 0.0)
+	viper.SetDefault("SourceAcceptBurst", 20)
+	viper.SetDefault("DisableSessionTickets", false)
+	viper.SetDefault("EnableHTTP2", false)
+	viper.SetDefault("LogTLSConfig", true)
+	viper.SetDefault("EnableDiagnostics", false)
+	viper.SetDefault("LogUntrustedCerts", false)
+	viper.SetDefault("LogHandshakeFailures", false)
+	viper.SetDefault("MinTrustedIssuers", 1)
+	viper.SetDefault("ValidateServerCert", false)
+	viper.SetDefault("RequireValidServerCert", false)
+	viper.SetDefault("RequireSNI", false)
+	viper.SetDefault("ServerCertValidationTimeout", 60)
+	viper.SetDefault("SessionTicketKeyRotation", 0)
 
 	var versionFlag bool
 	flag.BoolVar(&versionFlag, "version", false, "display program version and exit")
@@ -95,7 +316,7 @@ func main() {
 	flag.BoolVar(&helpFlag, "h", false, "alias for help")
 
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] <config-file>\nWhere options can include:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [config-file]\nWhere options can include:\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
@@ -111,55 +332,371 @@ func main() {
 		return
 	}
 
-	if flag.NArg() < 1 {
-		flag.Usage()
-		log.Fatal("Missing configuration file path")
+	// The configuration file is optional, all settings can also be
+	// given as environment variables (which override the file).
+	if flag.NArg() >= 1 {
+		viper.SetConfigFile(flag.Arg(0))
+		must(viper.ReadInConfig())
+	}
+
+	verifyRequired("Cert", "Key", "ListenAddress")
+
+	// The default backend is either TargetURL, or several replicas which
+	// get requests with weighted round-robin
+	var backends []backendConfig
+	must(viper.UnmarshalKey("Backends", &backends))
+
+	if len(backends) == 0 {
+		verifyRequired("TargetURL")
+		if viper.GetString("TargetURL") == "" {
+			log.Fatalf("TargetURL is empty")
+		}
+	}
+
+	for i, backend := range backends {
+		if backend.TargetURL == "" {
+			log.Fatalf("Invalid Backends: backend %d has no TargetURL", i+1)
+		}
+		if backend.Weight != nil && *backend.Weight < 0 {
+			log.Fatalf("Invalid Backends: %s has a negative weight (%d)", backend.TargetURL, *backend.Weight)
+		}
+	}
+
+	// Are some entities or organizations routed to other backends?
+	var routes []routeConfig
+	must(viper.UnmarshalKey("Routes", &routes))
+
+	for i, route := range routes {
+		if route.TargetURL == "" {
+			log.Fatalf("Invalid Routes: route %d has no TargetURL", i+1)
+		}
+	}
+
+	// Either a single federation configured with MetadataURL, JWKSPath and
+	// CachePath, or a list of federations in MetadataSources
+	var sources []fedtls.MetadataSource
+	must(viper.UnmarshalKey("MetadataSources", &sources))
+
+	if len(sources) == 0 {
+		verifyRequired("JWKSPath", "CachePath")
+		if viper.GetBool("DetachedPayload") {
+			verifyRequired("PayloadURL")
+		}
+		cachePath, secondaryCachePaths := configuredCachePaths()
+		sources = []fedtls.MetadataSource{
+			{
+				URL:                 viper.GetString("MetadataURL"),
+				JWKSPath:            viper.GetString("JWKSPath"),
+				CachePath:           cachePath,
+				SecondaryCachePaths: secondaryCachePaths,
+				JWKSThumbprints:     viper.GetStringSlice("JWKSThumbprints"),
+				PayloadURL:          viper.GetString("PayloadURL"),
+			},
+		}
+	}
+
+	if err := fedtls.CheckMetadataSources(sources); err != nil {
+		log.Fatalf("Invalid MetadataSources: %v", err)
 	}
 
-	configPath := flag.Arg(0)
+	if viper.GetBool("DetachedPayload") {
+		for _, source := range sources {
+			if source.PayloadURL == "" {
+				log.Fatalf("Missing PayloadURL for %s, required with DetachedPayload", source.URL)
+			}
+		}
+	}
+
+	// Optional audit trail of metadata refreshes and authentication decisions
+	var audit *auditLog
+	if auditPath := viper.GetString("AuditLogPath"); auditPath != "" {
+		var err error
+		audit, err = openAuditLog(auditPath)
 
-	viper.SetConfigFile(configPath)
+		if err != nil {
+			log.Fatalf("Failed to open audit log (%s): %v", auditPath, err)
+		}
+	}
 
-	must(viper.ReadInConfig())
+	// Closes the connections of entities removed from metadata
+	var drainer *server.ConnectionDrainer
+	if viper.GetBool("DrainRemovedEntities") {
+		drainer = server.NewConnectionDrainer()
+	}
 
-	verifyRequired("JWKSPath", "CachePath", "Cert", "Key", "TargetURL", "ListenAddress")
+	// Local emergency brake, reloaded on SIGHUP
+	denyList := fedtls.NewDenyList()
+	if denyListPath := viper.GetString("DenyListPath"); denyListPath != "" {
+		if err := denyList.Load(denyListPath); err != nil {
+			log.Fatalf("Failed to load deny list (%s): %v", denyListPath, err)
+		}
+		log.Printf("Loaded deny list with %d entries", denyList.Len())
+		reloadOnSIGHUP("deny list", denyList, denyListPath)
+	}
 
-	mdstore := fedtls.NewMetadataStore(
-		viper.GetString("MetadataURL"),
-		viper.GetString("JWKSPath"),
-		viper.GetString("CachePath"),
+	mdOptions := []fedtls.OptionSetter{
 		fedtls.DefaultCacheTTL(configuredSeconds("DefaultCacheTTL")),
+		fedtls.MinCacheTTL(configuredSeconds("MinCacheTTL")),
 		fedtls.NetworkRetry(configuredSeconds("NetworkRetry")),
-		fedtls.BadContentRetry(configuredSeconds("BadContentRetry")))
+		fedtls.MinRefreshInterval(configuredSeconds("MinRefreshInterval")),
+		fedtls.BadContentRetry(configuredSeconds("BadContentRetry")),
+		fedtls.ColdStartErrors(viper.GetBool("ColdStartErrors")),
+		fedtls.ReadOnlyCache(viper.GetBool("ReadOnlyCache")),
+		fedtls.MaxCacheAge(configuredSeconds("MaxCacheAge")),
+		fedtls.MaxCacheAgeWait(configuredSeconds("MaxCacheAgeWait")),
+		fedtls.ExportPath(viper.GetString("MetadataExportPath")),
+		fedtls.DetachedPayload(viper.GetBool("DetachedPayload")),
+		fedtls.ExpectedIssuer(viper.GetString("ExpectedIssuer")),
+		fedtls.MaxMetadataAge(configuredSeconds("MaxMetadataAge")),
+		fedtls.MatchChainPins(viper.GetBool("MatchChainPins")),
+		fedtls.RemovedPinGrace(configuredSeconds("RemovedPinGrace"), func(entityID, fingerprint string) {
+			removedPinGraceAccepts.Add(1)
+		}),
+		fedtls.AllowedContentTypes(viper.GetStringSlice("AllowedContentTypes")...),
+		fedtls.OnFetchError(func(err *fedtls.FetchError) {
+			fetchErrors.Add(err.Class, 1)
+		}),
+		fedtls.OnEntitiesRemoved(func(entityIDs []string) {
+			removedEntities.Add(int64(len(entityIDs)))
+			if drainer != nil {
+				drainer.Drain(entityIDs)
+			}
+		}),
+		fedtls.Deny(denyList),
+		fedtls.BadContentThreshold(viper.GetInt("BadContentThreshold"), func(url string, failures int, err error) {
+			badContentAlerts.Add(1)
+		}),
+		fedtls.OnRefresh(func(event *fedtls.RefreshEvent) {
+			if audit != nil {
+				audit.metadataRefresh(event)
+			}
+		}),
+	}
+
+	// For split horizon DNS, the metadata host may need to be resolved
+	// with another DNS server than the system's
+	if resolver := viper.GetString("MetadataResolver"); resolver != "" {
+		mdOptions = append(mdOptions, fedtls.Resolver(fedtls.ResolverAt(resolver)))
+	}
+
+	// One malformed entity shouldn't stop the others from being trusted
+	if viper.GetBool("LenientMetadataParsing") {
+		mdOptions = append(mdOptions, fedtls.Parser(fedtls.LenientMetadataParser))
+	}
+
+	// Restricts which of the federation's clients are accepted, also
+	// reloaded on SIGHUP
+	if allowListPath := viper.GetString("AllowListPath"); allowListPath != "" {
+		allowList := fedtls.NewAllowList()
+		if err := allowList.Load(allowListPath); err != nil {
+			log.Fatalf("Failed to load allow list (%s): %v", allowListPath, err)
+		}
+		log.Printf("Loaded allow list with %d entries", allowList.Len())
+		reloadOnSIGHUP("allow list", allowList, allowListPath)
+		mdOptions = append(mdOptions, fedtls.Allow(allowList))
+	}
+
+	mdstore := fedtls.NewMultiMetadataStore(sources, mdOptions...)
+
+	metrics.Set("initial_metadata_source", expvar.Func(func() interface{} {
+		return mdstore.Status().InitialSource
+	}))
+	metrics.Set("time_to_first_metadata_seconds", expvar.Func(func() interface{} {
+		return mdstore.Status().TimeToFirstLoad.Seconds()
+	}))
+	metrics.Set("metadata_cache_ttl_seconds", expvar.Func(func() interface{} {
+		return mdstore.Status().CacheTTL.Seconds()
+	}))
+	metrics.Set("next_metadata_refresh", expvar.Func(func() interface{} {
+		return mdstore.Status().NextRefresh
+	}))
+	metrics.Set("metadata_stats", expvar.Func(func() interface{} {
+		return mdstore.Status().Stats
+	}))
 
 	certFile := viper.GetString("Cert")
 	keyFile := viper.GetString("Key")
 
-	mdTLSConfigManager, err := server.NewMetadataTLSConfigManager(certFile, keyFile, mdstore)
+	if viper.GetBool("ValidateServerCert") {
+		validateServerCert(certFile, mdstore)
+	}
+
+	var tlsOptions []server.TLSOptionSetter
+
+	if viper.GetBool("RejectUnknownClientsInHandshake") {
+		tlsOptions = append(tlsOptions, server.TLSVerifyConnection(server.PinVerifier(mdstore)))
+	}
+
+	tlsOptions = append(tlsOptions,
+		server.TLSSessionTicketsDisabled(viper.GetBool("DisableSessionTickets")),
+		server.TLSRequireValidServerCert(viper.GetBool("RequireValidServerCert")),
+		server.TLSRequireSNI(viper.GetBool("RequireSNI")),
+		server.TLSMinTrustedIssuers(viper.GetInt("MinTrustedIssuers")),
+		server.TLSOnTrustUpdateRejected(func(issuers int) {
+			rejectedTrustUpdates.Add(1)
+		}),
+		server.TLSHandshakeWhenNotReady(viper.GetString("NotReadyBody") != ""))
+
+	// Since we create the TLS listener ourselves, HTTP/2 is only
+	// negotiated if we offer it
+	if viper.GetBool("EnableHTTP2") {
+		if viper.GetBool("EnableConnect") {
+			log.Fatalf("EnableConnect can't be combined with EnableHTTP2, CONNECT tunnels require HTTP/1.1")
+		}
+		tlsOptions = append(tlsOptions, server.TLSNextProtos([]string{"h2", "http/1.1"}))
+	} else {
+		tlsOptions = append(tlsOptions, server.TLSNextProtos([]string{"http/1.1"}))
+	}
+
+	mdTLSConfigManager, err := server.NewMetadataTLSConfigManager(certFile, keyFile, mdstore, tlsOptions...)
 
 	if err != nil {
 		log.Fatalf("Failed to create TLS configuration: %v", err)
 	}
 
-	target, err := url.Parse(viper.GetString("TargetURL"))
+	if viper.GetBool("LogTLSConfig") {
+		log.Printf("TLS configuration: %s", mdTLSConfigManager.Summary())
+	}
 
-	if err != nil {
-		log.Fatalf("Failed to parse target URL: %v", err)
+	// Explicitly managed session ticket keys, either from a file or
+	// randomly generated (in both cases rotated if configured)
+	ticketKeyFile := viper.GetString("SessionTicketKeyFile")
+	ticketKeyRotation := configuredSeconds("SessionTicketKeyRotation")
+	if !viper.GetBool("DisableSessionTickets") && (ticketKeyFile != "" || ticketKeyRotation > 0) {
+		err := server.RotateSessionTicketKeys(mdTLSConfigManager, ticketKeyFile, ticketKeyRotation)
+
+		if err != nil {
+			log.Fatalf("Failed to set session ticket keys: %v", err)
+		}
+	}
+
+	transport := newBackendTransport()
+
+	var proxyHandler http.Handler
+	var prewarmTargets []string
+
+	if len(backends) > 0 {
+		weighted := make([]server.WeightedBackend, len(backends))
+		for i, backend := range backends {
+			weight := 1
+			if backend.Weight != nil {
+				weight = *backend.Weight
+			}
+			weighted[i] = server.WeightedBackend{
+				Handler: newBackend(backend.TargetURL, transport),
+				Weight:  weight,
+			}
+			if weight > 0 {
+				prewarmTargets = append(prewarmTargets, backend.TargetURL)
+			}
+		}
+		proxyHandler = server.WeightedRoundRobin(weighted)
+	} else {
+		proxyHandler = newBackend(viper.GetString("TargetURL"), transport)
+		prewarmTargets = []string{viper.GetString("TargetURL")}
+	}
+
+	serverRoutes := make([]server.Route, len(routes))
+	for i, route := range routes {
+		serverRoutes[i] = server.Route{
+			EntityIDs:       route.EntityIDs,
+			OrganizationIDs: route.OrganizationIDs,
+			Handler:         newBackend(route.TargetURL, transport),
+			Timeout:         time.Duration(route.Timeout) * time.Second,
+		}
+	}
+
+	if len(serverRoutes) > 0 {
+		proxyHandler = server.EntityRouter(serverRoutes, proxyHandler)
+	}
+
+	if viper.GetBool("EnableCompression") {
+		proxyHandler = server.Compressor(proxyHandler, viper.GetInt("CompressionMinSize"))
+	}
+
+	if threshold := configuredMilliseconds("SlowRequestThreshold"); threshold > 0 {
+		proxyHandler = server.SlowRequestLogger(proxyHandler, threshold,
+			func(r *http.Request, elapsed time.Duration) {
+				slowRequests.Add(1)
+			})
+	}
+
+	// Cancelled when shutdown begins, to release requests queued in the
+	// concurrency limiters and the rate limiter
+	shuttingDown, beginShutdown := context.WithCancel(context.Background())
+
+	if maxConcurrent := viper.GetInt("MaxConcurrentRequests"); maxConcurrent > 0 {
+		proxyHandler = server.ConcurrencyLimiterWithContext(shuttingDown, proxyHandler, maxConcurrent,
+			configuredMilliseconds("ConcurrencyQueueTimeout"))
 	}
 
-	proxyHandler := newReverseProxy(target)
+	// One entity's slow requests shouldn't use up the backend's capacity
+	var entityConcurrency []entityConcurrencyConfig
+	must(viper.UnmarshalKey("EntityConcurrencyLimits", &entityConcurrency))
+
+	if maxPerEntity := viper.GetInt("MaxConcurrentRequestsPerEntity"); maxPerEntity > 0 || len(entityConcurrency) > 0 {
+		limits := make(map[string]int)
+		for _, c := range entityConcurrency {
+			for _, entityID := range c.EntityIDs {
+				limits[entityID] = c.Max
+			}
+		}
+		proxyHandler = server.EntityConcurrencyLimiterWithContext(shuttingDown, proxyHandler, maxPerEntity, limits,
+			configuredMilliseconds("ConcurrencyQueueTimeout"))
+	}
 
 	enableLimiting := viper.GetBool("EnableLimiting")
+	var entityLimiter *server.EntityLimiter
 
 	if enableLimiting {
-		proxyHandler = server.Limiter(proxyHandler,
+		var costs []server.PathCost
+		must(viper.UnmarshalKey("LimitPathCosts", &costs))
+
+		burst := viper.GetInt("LimitBurst")
+		if err := server.CheckPathCosts(costs, burst); err != nil {
+			log.Fatalf("Invalid LimitPathCosts: %v", err)
+		}
+
+		entityLimiter = server.NewEntityLimiter(shuttingDown, proxyHandler,
 			rate.Limit(viper.GetFloat64("LimitRequestsPerSecond")),
-			viper.GetInt("LimitBurst"))
+			burst,
+			costs...)
+		proxyHandler = entityLimiter
 	}
 
+	// Routes may have timeouts of their own
 	beTimeout := configuredSeconds("BackendTimeout")
-	if beTimeout >= 1*time.Second {
-		proxyHandler = http.TimeoutHandler(proxyHandler, beTimeout, "Backend timeout")
+	if beTimeout < 1*time.Second {
+		beTimeout = 0
+	}
+	proxyHandler = server.RouteTimeouts(proxyHandler, serverRoutes, beTimeout)
+
+	// Replayed requests are rejected before they reach the backend
+	if nonceHeader := viper.GetString("NonceHeader"); nonceHeader != "" {
+		proxyHandler = server.NonceVerifier(proxyHandler, nonceHeader,
+			configuredSeconds("NonceWindow"), viper.GetStringSlice("NoncePaths")...)
+	}
+
+	// Usage per tenant, health checks aren't counted
+	if viper.GetBool("OrganizationRequestMetric") {
+		proxyHandler = server.OrganizationCounter(proxyHandler, viper.GetInt("OrganizationMetricMaxLabels"),
+			func(label string) { organizationRequests.Add(label, 1) })
+	}
+
+	// Answered by us rather than the backend, and not rate limited
+	if healthPath := viper.GetString("HealthCheckPath"); healthPath != "" {
+		proxyHandler = server.HealthCheck(proxyHandler, healthPath, mdstore)
+	}
+
+	// Clients may be inconsistent about slashes and case in paths
+	normalization := server.PathNormalization{
+		CollapseSlashes:   viper.GetBool("CollapseSlashes"),
+		IgnoreCase:        viper.GetBool("IgnorePathCase"),
+		TrimTrailingSlash: viper.GetBool("TrimTrailingSlash"),
+		RewritePath:       viper.GetBool("RewriteNormalizedPath"),
+	}
+	if normalization != (server.PathNormalization{}) {
+		proxyHandler = server.NormalizePaths(proxyHandler, normalization)
 	}
 
 	// Is there a configured API key to add to HTTP requests?
@@ -173,30 +710,198 @@ func main() {
 		}
 	}
 
-	srv := &http.Server{
-		// Wrap the HTTP handler with authentication middleware.
-		Handler: server.AuthMiddleware(proxyHandler, mdstore, apiKey),
+	// Pre-warmed until shutdown begins, with the API key since the backend
+	// may require it on every request
+	if n := viper.GetInt("BackendPrewarmConnections"); n > 0 {
+		interval := configuredSeconds("BackendIdleConnTimeout") / 2
+		if interval <= 0 {
+			interval = 30 * time.Second
+		}
+		for _, target := range prewarmTargets {
+			prewarmBackend(shuttingDown, target, transport, apiKey, n, interval)
+		}
+	}
+
+	// Should we add a signed token describing the client to HTTP requests?
+	var backendToken *server.BackendToken
+	if keyFile := viper.GetString("BackendTokenKeyFile"); keyFile != "" {
+		var algorithm jwa.SignatureAlgorithm
+		if err := algorithm.Accept(viper.GetString("BackendTokenAlgorithm")); err != nil {
+			log.Fatalf("Invalid BackendTokenAlgorithm: %v", err)
+		}
+		backendToken, err = server.NewBackendToken(keyFile, algorithm)
+		if err != nil {
+			log.Fatalf("Failed to set up backend token: %v", err)
+		}
+		backendToken.HeaderName = viper.GetString("BackendTokenHeader")
+		backendToken.Prefix = viper.GetString("BackendTokenPrefix")
+		backendToken.Lifetime = configuredSeconds("BackendTokenLifetime")
+		backendToken.Issuer = viper.GetString("BackendTokenIssuer")
+		backendToken.Audience = viper.GetString("BackendTokenAudience")
+		backendToken.EntityIDClaim = viper.GetString("BackendTokenEntityIDClaim")
+		backendToken.OrganizationClaim = viper.GetString("BackendTokenOrganizationClaim")
+		backendToken.OrganizationIDClaim = viper.GetString("BackendTokenOrganizationIDClaim")
+	}
+
+	denialLogMode := server.DenialLogMode(viper.GetString("LogDenials"))
+	switch denialLogMode {
+	case server.DenialLogFull, server.DenialLogSampled, server.DenialLogOff:
+	default:
+		log.Fatalf("Invalid LogDenials (%s), expected full, sampled or off", denialLogMode)
+	}
+
+	// Also used for sampling untrusted certificates and handshake failures
+	if viper.GetInt("DenialLogInterval") <= 0 {
+		log.Fatalf("Invalid DenialLogInterval (%d), must be at least 1 second", viper.GetInt("DenialLogInterval"))
+	}
 
-		// In order to use the authentication middleware, the server needs
-		// to have a ConnContext configured so the middleware can access
-		// connection specific information.
-		ConnContext: server.ContextModifier(),
+	// Maps entity IDs to the backend's user IDs, reloaded on SIGHUP
+	var userMap *server.UserMap
+	if userMapPath := viper.GetString("UserMapPath"); userMapPath != "" {
+		userMap = server.NewUserMap()
+		if err := userMap.Load(userMapPath); err != nil {
+			log.Fatalf("Failed to load user map (%s): %v", userMapPath, err)
+		}
+		log.Printf("Loaded user map with %d entries", userMap.Len())
+		reloadOnSIGHUP("user map", userMap, userMapPath)
+	}
 
-		ReadHeaderTimeout: configuredSeconds("ReadHeaderTimeout"),
-		ReadTimeout:       configuredSeconds("ReadTimeout"),
-		WriteTimeout:      configuredSeconds("WriteTimeout"),
-		IdleTimeout:       configuredSeconds("IdleTimeout"),
+	denialStatus := viper.GetInt("DenialStatus")
+	if denialStatus != http.StatusUnauthorized && denialStatus != http.StatusForbidden {
+		log.Fatalf("Invalid DenialStatus (%d), expected 401 or 403", denialStatus)
 	}
 
+	activity := &activityTracker{}
+	metrics.Set("active_connections", expvar.Func(func() interface{} { return activity.connections.Load() }))
+	metrics.Set("active_requests", expvar.Func(func() interface{} { return activity.requests.Load() }))
+
 	// Set up a TLS listener with certificate authorities loaded from
 	// federation metadata (and dynamically updated as metadata gets refreshed).
 	address := viper.GetString("ListenAddress")
-	listener, err := tls.Listen("tcp", address, mdTLSConfigManager.Config())
+	listener, err := net.Listen("tcp", address)
 
 	if err != nil {
 		log.Fatalf("Failed to listen to %s (%v)", address, err)
 	}
 
+	listener = server.KeepAliveListener(listener, configuredSeconds("TCPKeepAlive"))
+
+	// Applied before the global limit, so connections from a flooding
+	// address don't use up the global limit's tokens
+	if sourceRate := viper.GetFloat64("SourceAcceptRate"); sourceRate > 0 {
+		burst := viper.GetInt("SourceAcceptBurst")
+		if burst < 1 {
+			log.Fatalf("Invalid SourceAcceptBurst (%d), must be at least 1", burst)
+		}
+		listener = server.SourceRateListener(listener, rate.Limit(sourceRate), burst,
+			func(net.Addr) { sourceDroppedConnections.Add(1) })
+	}
+
+	if acceptRate := viper.GetFloat64("AcceptRate"); acceptRate > 0 {
+		burst := viper.GetInt("AcceptBurst")
+		if burst < 1 {
+			log.Fatalf("Invalid AcceptBurst (%d), must be at least 1", burst)
+		}
+		listener = server.AcceptRateListener(listener, rate.Limit(acceptRate),
+			burst, viper.GetBool("AcceptRateDrop"),
+			func() { droppedConnections.Add(1) })
+	}
+
+	if maxLifetime := configuredSeconds("MaxConnectionLifetime"); maxLifetime > 0 {
+		listener = server.LifetimeListener(listener, maxLifetime)
+	}
+
+	// The rate limiter and backend timeout are already part of
+	// proxyHandler, since CONNECT tunnels and health checks go outside
+	// of them
+	srv, listener, err := server.New(mdstore,
+		server.ServerTLSConfigManager(mdTLSConfigManager),
+		server.ServerListener(listener),
+		server.ServerHandler(proxyHandler),
+		server.ServerAPIKey(apiKey),
+		server.ServerTimeouts(configuredSeconds("ReadHeaderTimeout"), configuredSeconds("ReadTimeout"),
+			configuredSeconds("WriteTimeout"), configuredSeconds("IdleTimeout")),
+		server.ServerMiddleware(
+			server.LogTLSParameters(viper.GetBool("LogTLSParameters")),
+			server.LogDenials(denialLogMode),
+			server.LogDeniedCertificates(viper.GetBool("LogDeniedCertificates")),
+			server.DenialLogInterval(configuredSeconds("DenialLogInterval")),
+			server.RecheckAuth(viper.GetBool("RecheckAuth")),
+			server.DrainConnections(drainer),
+			server.WithBackendToken(backendToken),
+			server.DenialStatus(denialStatus, viper.GetString("WWWAuthenticate")),
+			server.ClientDescriptionsHeader(viper.GetString("ClientDescriptionsHeader")),
+			server.ALPNHeader(viper.GetString("ALPNHeader")),
+			server.MetadataVersionHeader(viper.GetString("MetadataVersionHeader")),
+			server.UserID(viper.GetString("UserIDHeader"), userMap, viper.GetString("DefaultUserID")),
+			server.NotReadyResponse(viper.GetString("NotReadyBody")),
+			server.OnAuthentication(func(event *server.AuthEvent) {
+				if audit != nil {
+					audit.authentication(event)
+				}
+			})))
+
+	if err != nil {
+		log.Fatalf("Failed to set up server: %v", err)
+	}
+
+	handler := srv.Handler
+	if maxHeaders := viper.GetInt("MaxHeaderCount"); maxHeaders > 0 {
+		handler = server.HeaderCountLimiter(handler, maxHeaders)
+	}
+
+	srv.Handler = activity.middleware(handler)
+
+	connStateHooks := []func(net.Conn, http.ConnState){activity.connState}
+	if drainer != nil {
+		connStateHooks = append(connStateHooks, drainer.ConnState)
+	}
+	if configuredSeconds("MaxConnectionLifetime") > 0 {
+		connStateHooks = append(connStateHooks, server.LifetimeConnState)
+	}
+	srv.ConnState = func(c net.Conn, state http.ConnState) {
+		for _, hook := range connStateHooks {
+			hook(c, state)
+		}
+	}
+
+	// 0 means Go's default (http.DefaultMaxHeaderBytes)
+	srv.MaxHeaderBytes = viper.GetInt("MaxHeaderBytes")
+
+	if !viper.GetBool("EnableHTTP2") {
+		// A non-nil empty map keeps net/http from setting up HTTP/2
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	// Handshakes fail inside net/http, where they are only visible as
+	// generic errors
+	var handshakeLoggers []func(conn net.Conn, err error)
+	if viper.GetBool("LogUntrustedCerts") {
+		handshakeLoggers = append(handshakeLoggers,
+			server.UntrustedCertLogger(configuredSeconds("DenialLogInterval"), func() {
+				untrustedClientCerts.Add(1)
+			}))
+	}
+	if viper.GetBool("LogHandshakeFailures") {
+		handshakeLoggers = append(handshakeLoggers,
+			server.HandshakeFailureLogger(configuredSeconds("DenialLogInterval"), func(class string) {
+				handshakeFailures.Add(class, 1)
+			}))
+	}
+	if len(handshakeLoggers) > 0 {
+		// The same timeout net/http would apply to the handshake
+		handshakeTimeout := configuredSeconds("ReadHeaderTimeout")
+		if handshakeTimeout <= 0 {
+			handshakeTimeout = configuredSeconds("ReadTimeout")
+		}
+		listener = server.HandshakeListener(listener, handshakeTimeout,
+			func(conn net.Conn, err error) {
+				for _, logger := range handshakeLoggers {
+					logger(conn, err)
+				}
+			})
+	}
+
 	go func() {
 		err := srv.Serve(listener)
 
@@ -205,17 +910,105 @@ func main() {
 		}
 	}()
 
+	// The admin listener is optional and plain HTTP, it should only be
+	// reachable from inside the deployment (e.g. for readiness probes).
+	var adminSrv *http.Server
+	if viper.IsSet("AdminListenAddress") {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/ready", server.ReadinessHandler(mdstore))
+		adminMux.Handle("/debug/vars", expvar.Handler())
+		adminMux.HandleFunc("/version", versionHandler)
+		if viper.GetBool("EnableDiagnostics") {
+			adminMux.Handle("/debug/diag", diagnosticsHandler(mdstore, activity))
+		}
+		adminMux.Handle("/debug/issuers", server.TrustedIssuersHandler(mdTLSConfigManager))
+		if entityLimiter != nil {
+			adminMux.Handle("/debug/limiters", server.LimiterStateHandler(entityLimiter))
+		}
+
+		adminSrv = &http.Server{
+			Addr:              viper.GetString("AdminListenAddress"),
+			Handler:           adminMux,
+			ReadHeaderTimeout: configuredSeconds("ReadHeaderTimeout"),
+		}
+
+		go func() {
+			err := adminSrv.ListenAndServe()
+
+			if err != http.ErrServerClosed {
+				log.Fatalf("Unexpected admin server exit: %v", err)
+			}
+		}()
+	}
+
+	// Plain HTTP listener redirecting clients which connect to the wrong
+	// port, no authentication is done there
+	var redirectSrv *http.Server
+	if viper.IsSet("RedirectListenAddress") {
+		_, httpsPort, err := net.SplitHostPort(address)
+		must(err)
+
+		redirectSrv = &http.Server{
+			Addr:              viper.GetString("RedirectListenAddress"),
+			Handler:           server.HTTPSRedirectHandler(httpsPort),
+			ReadHeaderTimeout: configuredSeconds("ReadHeaderTimeout"),
+		}
+
+		go func() {
+			err := redirectSrv.ListenAndServe()
+
+			if err != http.ErrServerClosed {
+				log.Fatalf("Unexpected redirect server exit: %v", err)
+			}
+		}()
+	}
+
 	waitForShutdownSignal()
 
-	log.Printf("Shutting down, waiting for active requests to finish...")
+	log.Printf("Shutting down, waiting for active requests to finish (connections: %d, requests: %d)...",
+		activity.connections.Load(), activity.requests.Load())
 
-	err = srv.Shutdown(context.Background())
-	if err != nil {
+	shutdownStart := time.Now()
+	beginShutdown()
+	shutdownCtx := context.Background()
+	if timeout := configuredSeconds("ShutdownTimeout"); timeout > 0 {
+		var cancel context.CancelFunc
+		shutdownCtx, cancel = context.WithTimeout(shutdownCtx, timeout)
+		defer cancel()
+	}
+
+	err = srv.Shutdown(shutdownCtx)
+	if err == context.DeadlineExceeded {
+		log.Printf("Shutdown timeout, forcibly closing remaining connections (connections: %d, requests: %d)",
+			activity.connections.Load(), activity.requests.Load())
+		srv.Close()
+	} else if err != nil {
 		log.Printf("Failed to gracefully shutdown server: %v", err)
 	}
+	log.Printf("Server drained in %v", time.Since(shutdownStart))
+
+	if redirectSrv != nil {
+		err = redirectSrv.Shutdown(context.Background())
+		if err != nil {
+			log.Printf("Failed to gracefully shutdown redirect server: %v", err)
+		}
+	}
+
+	if adminSrv != nil {
+		err = adminSrv.Shutdown(context.Background())
+		if err != nil {
+			log.Printf("Failed to gracefully shutdown admin server: %v", err)
+		}
+	}
 
 	log.Printf("Server closed, waiting for metadata store to close...")
+	quitStart := time.Now()
 	mdstore.Quit()
+	log.Printf("Metadata store closed in %v", time.Since(quitStart))
+
+	if audit != nil {
+		audit.Close()
+	}
 
 	log.Printf("Done.")
 }
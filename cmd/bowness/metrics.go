@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package main
+
+import "expvar"
+
+// Metrics are published with expvar, and served by the admin listener
+// at /debug/vars
+var metrics = expvar.NewMap("bowness")
+
+// Entities which have disappeared from metadata since start up
+var removedEntities = new(expvar.Int)
+
+// Failed metadata downloads, per class of error
+var fetchErrors = new(expvar.Map)
+
+// Metadata updates which were ignored since they had too few usable issuers
+var rejectedTrustUpdates = new(expvar.Int)
+
+// Requests which took longer than SlowRequestThreshold
+var slowRequests = new(expvar.Int)
+
+// Times downloaded metadata reached BadContentThreshold consecutive
+// verification failures
+var badContentAlerts = new(expvar.Int)
+
+// Connections closed since they exceeded the accept rate limit
+var droppedConnections = new(expvar.Int)
+
+// Connections closed since their source address exceeded SourceAcceptRate
+var sourceDroppedConnections = new(expvar.Int)
+
+// Handshakes which failed since the client's certificate wasn't issued by
+// a trusted issuer (only counted with LogUntrustedCerts)
+var untrustedClientCerts = new(expvar.Int)
+
+// Clients accepted because of RemovedPinGrace although their pins are no
+// longer in metadata
+var removedPinGraceAccepts = new(expvar.Int)
+
+// Authenticated requests per organization ID (with OrganizationRequestMetric)
+var organizationRequests = new(expvar.Map)
+
+// Failed handshakes per class, see server.ClassifyHandshakeError (only
+// counted with LogHandshakeFailures)
+var handshakeFailures = new(expvar.Map)
+
+func init() {
+	metrics.Set("removed_entities", removedEntities)
+	metrics.Set("fetch_errors", fetchErrors)
+	metrics.Set("rejected_trust_updates", rejectedTrustUpdates)
+	metrics.Set("slow_requests", slowRequests)
+	metrics.Set("bad_content_alerts", badContentAlerts)
+	metrics.Set("dropped_connections", droppedConnections)
+	metrics.Set("source_dropped_connections", sourceDroppedConnections)
+	metrics.Set("untrusted_client_certs", untrustedClientCerts)
+	metrics.Set("removed_pin_grace_accepts", removedPinGraceAccepts)
+	metrics.Set("organization_requests", organizationRequests)
+	metrics.Set("handshake_failures", handshakeFailures)
+}
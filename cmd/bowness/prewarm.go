@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/joesiltberg/bowness/server"
+)
+
+// Opens n connections to the backend by sending n concurrent HEAD requests,
+// once done the connections are left idle in the transport's pool.
+func warmConnections(ctx context.Context, target string, transport http.RoundTripper, apiKey *server.APIKey, n int) {
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+
+			request, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
+			if err != nil {
+				log.Printf("Failed to pre-warm backend connection: %v", err)
+				return
+			}
+			if apiKey != nil {
+				request.Header.Set(apiKey.HeaderName, apiKey.Key)
+			}
+
+			response, err := client.Do(request)
+
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Failed to pre-warm backend connection: %v", err)
+				}
+				return
+			}
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+// Pre-warms n connections to the backend at start up and then keeps them
+// alive by repeating it regularly (interval should be shorter than the
+// transport's idle connection timeout), until ctx is done.
+func prewarmBackend(ctx context.Context, target string, transport http.RoundTripper, apiKey *server.APIKey,
+	n int, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			warmConnections(ctx, target, transport, apiKey, n)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
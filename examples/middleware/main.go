@@ -8,7 +8,6 @@
 package main
 
 import (
-	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
@@ -47,32 +46,18 @@ func main() {
 		fedtls.NetworkRetry(1*time.Minute),
 		fedtls.BadContentRetry(1*time.Hour))
 
-	certFile := "cert.pem"
-	keyFile := "key.pem"
-
-	mdTLSConfigManager, err := server.NewMetadataTLSConfigManager(certFile, keyFile, mdstore)
-
-	if err != nil {
-		log.Fatalf("Failed to create TLS configuration: %v", err)
-	}
-
-	srv := &http.Server{
-		// Wrap the HTTP handler with authentication middleware.
-		Handler: server.AuthMiddleware(http.HandlerFunc(myHandler), mdstore),
-
-		// In order to use the authentication middleware, the server needs
-		// to have a ConnContext configured so the middleware can access
-		// connection specific information.
-		ConnContext: server.ContextModifier(),
-	}
-
-	// Set up a TLS listener with certificate authorities loaded from
-	// federation metadata (and dynamically updated as metadata gets refreshed).
-	address := ":8443"
-	listener, err := tls.Listen("tcp", address, mdTLSConfigManager.Config())
+	// server.New wires together the TLS configuration (with certificate
+	// authorities loaded from federation metadata, and dynamically updated
+	// as metadata gets refreshed), the authentication middleware and the
+	// http.Server's ConnContext which the middleware depends on.
+	srv, listener, err := server.New(mdstore,
+		server.ServerCertificate("cert.pem", "key.pem"),
+		server.ServerAddress(":8443"),
+		server.ServerHandler(http.HandlerFunc(myHandler)),
+		server.ServerTimeouts(5*time.Second, 20*time.Second, 40*time.Second, 60*time.Second))
 
 	if err != nil {
-		log.Fatalf("Failed to listen to %s (%v)", address, err)
+		log.Fatalf("Failed to set up server: %v", err)
 	}
 
 	srv.Serve(listener)
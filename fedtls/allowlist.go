@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package fedtls
+
+import (
+	"errors"
+	"fmt"
+)
+
+// An AllowList is a local list of entity IDs and pin digests, if it's used
+// only clients matching it are accepted, even if other clients are found
+// in the metadata. It's meant for services which should only be used by a
+// few of the federation's members.
+//
+// The list can be replaced at any time, for instance when reloaded from file.
+type AllowList struct {
+	entityList
+}
+
+// NewAllowList creates an empty AllowList, which denies all clients until
+// it's loaded
+func NewAllowList() *AllowList {
+	return &AllowList{entityList{entries: make(map[string]bool)}}
+}
+
+// Load replaces the list with the contents of a file, in the same format
+// as for DenyList.Load. An empty list would deny all clients and is most
+// likely a mistake, so it's treated as an error. If the file can't be read
+// or is invalid, the list is left unchanged.
+func (a *AllowList) Load(path string) error {
+	entries, err := readEntityList(path)
+
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		return errors.New("The allow list is empty")
+	}
+
+	a.set(entries)
+	return nil
+}
+
+// NotAllowedError is returned by LookupClient when the client is found in
+// metadata but doesn't match any entry in the local allow list
+type NotAllowedError struct {
+	EntityID    string
+	Fingerprint string
+}
+
+func (e *NotAllowedError) Error() string {
+	return fmt.Sprintf("Client %s (%s) is not in the local allow list", e.EntityID, e.Fingerprint)
+}
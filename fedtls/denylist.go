@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package fedtls
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// An entityList is a set of entity IDs and pin digests loaded from a file,
+// shared by DenyList and AllowList
+type entityList struct {
+	entries map[string]bool
+	lock    sync.RWMutex
+
+	// Incremented every time the list is loaded
+	generation atomic.Uint64
+}
+
+// Reads a list file, with one entity ID or pin digest per line. Empty
+// lines and lines starting with # are ignored.
+func readEntityList(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		// Neither entity IDs nor pin digests contain white space, this is
+		// probably a mistake which would make the entry useless
+		if strings.ContainsAny(entry, " \t") {
+			return nil, fmt.Errorf("Invalid entry on line %d: %q", line, entry)
+		}
+		entries[entry] = true
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Replaces the entries, so that lookups see either the old or the new list
+func (l *entityList) set(entries map[string]bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries = entries
+	l.generation.Add(1)
+}
+
+// Len returns the number of entries in the list
+func (l *entityList) Len() int {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return len(l.entries)
+}
+
+// Returns the first of values found in the list, or false if none is
+func (l *entityList) match(values ...string) (string, bool) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	for _, v := range values {
+		if l.entries[v] {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// The number of times the list has been loaded
+func (l *entityList) loaded() uint64 {
+	return l.generation.Load()
+}
+
+// A DenyList is a local list of entity IDs and pin digests which are
+// rejected regardless of what the metadata says. It's meant as an emergency
+// brake for when a federation member is compromised and it's not possible
+// to wait for the federation operator to remove it from the metadata.
+//
+// The list can be replaced at any time, for instance when reloaded from file.
+type DenyList struct {
+	entityList
+}
+
+// NewDenyList creates an empty DenyList
+func NewDenyList() *DenyList {
+	return &DenyList{entityList{entries: make(map[string]bool)}}
+}
+
+// Load replaces the list with the contents of a file.
+//
+// The file should contain one entity ID or pin digest (base64 encoded
+// SHA256, as in metadata) per line. Empty lines and lines starting with #
+// are ignored. If the file can't be read or has invalid entries, the list
+// is left unchanged.
+func (d *DenyList) Load(path string) error {
+	entries, err := readEntityList(path)
+
+	if err != nil {
+		return err
+	}
+
+	d.set(entries)
+	return nil
+}
+
+// DeniedError is returned by LookupClient when the client matches an entry
+// in the local deny list
+type DeniedError struct {
+	EntityID    string
+	Fingerprint string
+
+	// The deny list entry which matched
+	Entry string
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("Client %s (%s) is in the local deny list (matched %s)",
+		e.EntityID, e.Fingerprint, e.Entry)
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package fedtls
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeEntityList(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "deny")
+	must(os.WriteFile(path, []byte(content), 0600), t)
+	return path
+}
+
+func TestDenyListLoad(t *testing.T) {
+	list := NewDenyList()
+	must(list.Load(writeEntityList(t, "# Compromised\nhttps://bad.example.com\n\n  pindigest=  \n")), t)
+
+	if list.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %d", list.Len())
+	}
+
+	if _, ok := list.match("pindigest="); !ok {
+		t.Errorf("Pin digest not found in deny list")
+	}
+
+	if err := list.Load(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("Loading a missing file should fail")
+	}
+
+	if list.Len() != 2 {
+		t.Errorf("Failed load changed the list")
+	}
+}
+
+func TestLookupClientDenied(t *testing.T) {
+	chain := newTestChain(t)
+	md := testMetadata("https://example.com", chain.pin())
+
+	for _, entry := range []string{"https://example.com", chain.pin()} {
+		list := NewDenyList()
+		must(list.Load(writeEntityList(t, entry+"\n")), t)
+		mdstore := newTestStore(md, Deny(list))
+
+		_, _, _, err := mdstore.LookupClient(chain.verifiedChains())
+
+		var denied *DeniedError
+		if !errors.As(err, &denied) {
+			t.Errorf("Expected DeniedError for entry %s, got %v", entry, err)
+		}
+	}
+
+	mdstore := newTestStore(md, Deny(NewDenyList()))
+	_, _, _, err := mdstore.LookupClient(chain.verifiedChains())
+	must(err, t)
+}
+
+func TestVersionChangesWithDenyList(t *testing.T) {
+	list := NewDenyList()
+	mdstore := newTestStore(testMetadata("https://example.com", "pin"), Deny(list))
+	before := mdstore.Version()
+
+	must(list.Load(writeEntityList(t, "https://example.com\n")), t)
+
+	if mdstore.Version() == before {
+		t.Errorf("Version didn't change when the deny list was reloaded")
+	}
+}
+
+func TestDenyListInvalidEntry(t *testing.T) {
+	list := NewDenyList()
+	must(list.Load(writeEntityList(t, "https://bad.example.com\n")), t)
+
+	if err := list.Load(writeEntityList(t, "https://bad.example.com\nhttps://other.example.com pindigest=\n")); err == nil {
+		t.Errorf("Loading a list with an invalid entry should fail")
+	}
+
+	if _, ok := list.match("https://bad.example.com"); !ok || list.Len() != 1 {
+		t.Errorf("Failed load changed the list")
+	}
+}
+
+func TestLookupClientAllowList(t *testing.T) {
+	chain := newTestChain(t)
+	md := testMetadata("https://example.com", chain.pin())
+
+	list := NewAllowList()
+	if err := list.Load(writeEntityList(t, "# Nobody\n")); err == nil {
+		t.Errorf("Loading an empty allow list should fail")
+	}
+
+	must(list.Load(writeEntityList(t, "https://other.example.com\n")), t)
+	mdstore := newTestStore(md, Allow(list))
+	before := mdstore.Version()
+
+	_, _, _, err := mdstore.LookupClient(chain.verifiedChains())
+	var notAllowed *NotAllowedError
+	if !errors.As(err, &notAllowed) {
+		t.Errorf("Expected NotAllowedError, got %v", err)
+	}
+
+	for _, entry := range []string{"https://example.com", chain.pin()} {
+		must(list.Load(writeEntityList(t, entry+"\n")), t)
+		_, _, _, err := mdstore.LookupClient(chain.verifiedChains())
+		must(err, t)
+	}
+
+	if mdstore.Version() == before {
+		t.Errorf("Version didn't change when the allow list was reloaded")
+	}
+}
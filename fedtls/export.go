@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package fedtls
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Writes a file by writing to a temporary file in the same directory and
+// renaming it, so that readers never see a partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly after the rename
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func sortPins(pins []Pin) {
+	sort.Slice(pins, func(i, j int) bool {
+		if pins[i].Alg != pins[j].Alg {
+			return pins[i].Alg < pins[j].Alg
+		}
+		return pins[i].Digest < pins[j].Digest
+	})
+}
+
+// Clients and servers have no natural key, so they're ordered by their
+// JSON encoding (after their own lists have been sorted)
+func jsonKey(v interface{}) string {
+	encoded, _ := json.Marshal(v)
+	return string(encoded)
+}
+
+// Returns a copy of the metadata with entities, and everything in them,
+// in a deterministic order
+func normalizedMetadata(md *Metadata) (*Metadata, error) {
+	// A deep copy, so the store's metadata is left as it is
+	encoded, err := json.Marshal(md)
+	if err != nil {
+		return nil, err
+	}
+	var normalized Metadata
+	if err := json.Unmarshal(encoded, &normalized); err != nil {
+		return nil, err
+	}
+
+	for i := range normalized.Entities {
+		entity := &normalized.Entities[i]
+
+		sort.Slice(entity.Issuers, func(a, b int) bool {
+			return entity.Issuers[a].X509certificate < entity.Issuers[b].X509certificate
+		})
+
+		for c := range entity.Clients {
+			sortPins(entity.Clients[c].Pins)
+		}
+		sort.SliceStable(entity.Clients, func(a, b int) bool {
+			return jsonKey(entity.Clients[a]) < jsonKey(entity.Clients[b])
+		})
+
+		for s := range entity.Servers {
+			sortPins(entity.Servers[s].Pins)
+			sort.Strings(entity.Servers[s].Tags)
+		}
+		sort.SliceStable(entity.Servers, func(a, b int) bool {
+			return jsonKey(entity.Servers[a]) < jsonKey(entity.Servers[b])
+		})
+	}
+
+	sort.SliceStable(normalized.Entities, func(a, b int) bool {
+		return normalized.Entities[a].EntityID < normalized.Entities[b].EntityID
+	})
+	return &normalized, nil
+}
+
+// Writes the metadata as pretty-printed JSON in a deterministic order, so
+// that exports of the same metadata are identical
+func exportMetadata(md *Metadata, path string) error {
+	normalized, err := normalizedMetadata(md)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.MarshalIndent(normalized, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(encoded, '\n'), 0644)
+}
+
+// Exports the current metadata, see ExportPath. Exports are serialized so
+// that an older export can't replace a newer one.
+func (mdstore *MetadataStore) export(path string) {
+	mdstore.exportLock.Lock()
+	defer mdstore.exportLock.Unlock()
+
+	if err := exportMetadata(mdstore.getParsed(), path); err != nil {
+		log.Printf("Failed to export metadata (%s): %v", path, err)
+	}
+}
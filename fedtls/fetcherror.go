@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package fedtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Classes of errors which can occur when downloading metadata, see FetchError
+const (
+	FetchErrorDNS               = "dns"
+	FetchErrorConnectionRefused = "connection refused"
+	FetchErrorTLS               = "tls"
+	FetchErrorTimeout           = "timeout"
+	FetchErrorContentType       = "content type"
+	FetchErrorOther             = "other"
+)
+
+// A FetchError is an error which occurred when downloading metadata
+// (as opposed to verifying or parsing it)
+type FetchError struct {
+	// Class is one of the FetchError* constants
+	Class string
+
+	URL string
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("Failed to fetch %s (%s): %v", e.URL, e.Class, e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// Figures out which class of error a failed HTTP GET resulted in
+func classifyFetchError(err error) string {
+	var dnsError *net.DNSError
+	var verificationError *tls.CertificateVerificationError
+	var recordHeaderError tls.RecordHeaderError
+	var unknownAuthorityError x509.UnknownAuthorityError
+	var hostnameError x509.HostnameError
+	var invalidError x509.CertificateInvalidError
+	var netError net.Error
+
+	switch {
+	case errors.As(err, &dnsError):
+		return FetchErrorDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return FetchErrorConnectionRefused
+	case errors.As(err, &verificationError),
+		errors.As(err, &recordHeaderError),
+		errors.As(err, &unknownAuthorityError),
+		errors.As(err, &hostnameError),
+		errors.As(err, &invalidError):
+		return FetchErrorTLS
+	case errors.As(err, &netError) && netError.Timeout():
+		return FetchErrorTimeout
+	}
+	return FetchErrorOther
+}
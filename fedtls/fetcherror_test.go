@@ -0,0 +1,40 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package fedtls
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClassifyFetchError(t *testing.T) {
+	// A port nobody listens to
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	must(err, t)
+	closedURL := "http://" + listener.Addr().String()
+	listener.Close()
+
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+
+	cases := map[string]string{
+		closedURL:                    FetchErrorConnectionRefused,
+		tlsServer.URL:                FetchErrorTLS,
+		"http://nonexistent.invalid": FetchErrorDNS,
+	}
+
+	for url, want := range cases {
+		_, err := http.Get(url)
+		if err == nil {
+			t.Fatalf("%s: expected an error", url)
+		}
+		shouldEqualString(classifyFetchError(err), want, url, t)
+	}
+}
@@ -0,0 +1,251 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package fedtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joesiltberg/bowness/util"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+)
+
+const testKeyID = "test-key"
+
+// A testFederation plays the role of a federation operator in tests,
+// it has a signing key and can sign metadata with it.
+type testFederation struct {
+	key  jwk.Key
+	jwks []byte
+}
+
+func newTestFederation(t *testing.T) *testFederation {
+	t.Helper()
+
+	raw, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	must(err, t)
+
+	key, err := jwk.FromRaw(raw)
+	must(err, t)
+	must(key.Set(jwk.KeyIDKey, testKeyID), t)
+	must(key.Set(jwk.AlgorithmKey, jwa.ES256), t)
+
+	public, err := jwk.PublicKeyOf(key)
+	must(err, t)
+
+	set := jwk.NewSet()
+	must(set.AddKey(public), t)
+
+	jwks, err := json.Marshal(set)
+	must(err, t)
+
+	return &testFederation{key: key, jwks: jwks}
+}
+
+// Writes the federation's JWKS to a temporary file and returns its path
+func (f *testFederation) jwksFile(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	must(os.WriteFile(path, f.jwks, 0600), t)
+	return path
+}
+
+// Signs metadata as a JWS with an exp header
+func (f *testFederation) sign(t *testing.T, md *Metadata, exp time.Time) []byte {
+	t.Helper()
+	return f.signWithHeaders(t, md, map[string]interface{}{"exp": exp.Unix()})
+}
+
+// Signs metadata as a JWS with arbitrary protected headers
+func (f *testFederation) signWithHeaders(t *testing.T, md *Metadata, extra map[string]interface{}) []byte {
+	t.Helper()
+
+	payload, err := json.Marshal(md)
+	must(err, t)
+
+	headers := jws.NewHeaders()
+	for k, v := range extra {
+		must(headers.Set(k, v), t)
+	}
+
+	signed, err := jws.Sign(payload, jws.WithKey(jwa.ES256, f.key, jws.WithProtectedHeaders(headers)))
+	must(err, t)
+
+	return signed
+}
+
+// Signs metadata as a JWS with a detached payload, returns the JWS
+// (without payload) and the payload
+func (f *testFederation) signDetached(t *testing.T, md *Metadata, exp time.Time) ([]byte, []byte) {
+	t.Helper()
+
+	payload, err := json.Marshal(md)
+	must(err, t)
+
+	headers := jws.NewHeaders()
+	must(headers.Set("exp", exp.Unix()), t)
+
+	signed, err := jws.Sign(nil, jws.WithKey(jwa.ES256, f.key, jws.WithProtectedHeaders(headers)), jws.WithDetachedPayload(payload))
+	must(err, t)
+
+	return signed, payload
+}
+
+// A testMetadataServer serves signed metadata over HTTP, the content
+// can be replaced while the server is running.
+type testMetadataServer struct {
+	*httptest.Server
+
+	lock    sync.Mutex
+	content []byte
+	fetches int
+}
+
+func newTestMetadataServer(t *testing.T, content []byte) *testMetadataServer {
+	t.Helper()
+
+	s := &testMetadataServer{content: content}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.fetches++
+		w.Header().Set("Content-Type", "application/jose")
+		w.Write(s.content)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testMetadataServer) setContent(content []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.content = content
+}
+
+func (s *testMetadataServer) fetchCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.fetches
+}
+
+// Metadata with a single entity with one client pin
+func testMetadata(entityID, pin string) *Metadata {
+	return &Metadata{
+		Version:  "1.0.0",
+		CacheTTL: 3600,
+		Entities: []Entity{
+			{
+				EntityID: entityID,
+				Issuers:  []Issuer{},
+				Clients: []Client{
+					{Pins: []Pin{{Alg: "sha256", Digest: pin}}},
+				},
+			},
+		},
+	}
+}
+
+// Creates a store with the given metadata, without any goroutines
+func newTestStore(md *Metadata, setters ...OptionSetter) *MetadataStore {
+	options := defaultOptions()
+	for _, setter := range setters {
+		setter(options)
+	}
+	return &MetadataStore{parsed: md, perSource: []*Metadata{md}, loaded: []bool{true}, options: options}
+}
+
+// Polls cond until it's true, fails the test if it takes too long
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A testChain is a client certificate and the CA which issued it
+type testChain struct {
+	issuer *x509.Certificate
+	leaf   *x509.Certificate
+}
+
+func newTestCertificate(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	must(err, t)
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	must(err, t)
+
+	cert, err := x509.ParseCertificate(der)
+	must(err, t)
+
+	return cert, key
+}
+
+func newTestChain(t *testing.T) *testChain {
+	t.Helper()
+
+	issuer, issuerKey := newTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+
+	leaf, _ := newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, issuer, issuerKey)
+
+	return &testChain{issuer: issuer, leaf: leaf}
+}
+
+func (c *testChain) issuerPEM() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.issuer.Raw}))
+}
+
+func (c *testChain) pin() string {
+	return util.Fingerprint(c.leaf)
+}
+
+func (c *testChain) verifiedChains() [][]*x509.Certificate {
+	return [][]*x509.Certificate{{c.leaf, c.issuer}}
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package fedtls
+
+import (
+	"time"
+)
+
+// A client pin which has disappeared from metadata, see RemovedPinGrace
+type removedPin struct {
+	// The entity the pin belonged to, as it was in the old metadata
+	entity *Entity
+
+	removed time.Time
+}
+
+// Returns the client pins in oldMetadata which aren't in newMetadata,
+// with the entity each pin belonged to
+func removedClientPins(oldMetadata, newMetadata *Metadata) map[string]*Entity {
+	present := make(map[string]bool)
+	for i := range newMetadata.Entities {
+		for _, client := range newMetadata.Entities[i].Clients {
+			for _, pin := range client.Pins {
+				present[pin.Digest] = true
+			}
+		}
+	}
+
+	removed := make(map[string]*Entity)
+	for i := range oldMetadata.Entities {
+		for _, client := range oldMetadata.Entities[i].Clients {
+			for _, pin := range client.Pins {
+				if !present[pin.Digest] {
+					removed[pin.Digest] = &oldMetadata.Entities[i]
+				}
+			}
+		}
+	}
+	return removed
+}
+
+// Remembers the pins removed when going from oldMetadata to newMetadata,
+// and forgets pins whose grace period is over or which are back in
+// metadata. Must be called with the lock held.
+func (mdstore *MetadataStore) trackRemovedPins(oldMetadata, newMetadata *Metadata, now time.Time) {
+	if mdstore.removedPins == nil {
+		mdstore.removedPins = make(map[string]removedPin)
+	}
+
+	for digest, pin := range mdstore.removedPins {
+		if now.Sub(pin.removed) > mdstore.options.RemovedPinGrace || findClient(newMetadata, digest) != nil {
+			delete(mdstore.removedPins, digest)
+		}
+	}
+
+	for digest, entity := range removedClientPins(oldMetadata, newMetadata) {
+		mdstore.removedPins[digest] = removedPin{entity: entity, removed: now}
+	}
+}
+
+// Returns the entity a recently removed pin belonged to, if the pin is
+// still within its grace period
+func (mdstore *MetadataStore) removedPinEntity(digest string, now time.Time) (*Entity, time.Duration, bool) {
+	mdstore.lock.Lock()
+	defer mdstore.lock.Unlock()
+
+	pin, ok := mdstore.removedPins[digest]
+	if !ok {
+		return nil, 0, false
+	}
+
+	age := now.Sub(pin.removed)
+	if age > mdstore.options.RemovedPinGrace {
+		return nil, 0, false
+	}
+	return pin.entity, age, true
+}
+
+// Adds the issuers of the entities whose removed pins are still within their
+// grace period to issuers, unless the entity already has them. Must be
+// called with the lock held.
+func (mdstore *MetadataStore) addRemovedPinIssuers(issuers IssuersPerEntity, now time.Time) {
+	for _, pin := range mdstore.removedPins {
+		if now.Sub(pin.removed) > mdstore.options.RemovedPinGrace {
+			continue
+		}
+
+		entityID := pin.entity.EntityID
+		for _, issuer := range pin.entity.Issuers {
+			if !hasIssuer(issuers[entityID], issuer) {
+				issuers[entityID] = append(issuers[entityID], issuer)
+			}
+		}
+	}
+}
+
+func hasIssuer(issuers []Issuer, issuer Issuer) bool {
+	for _, i := range issuers {
+		if i.X509certificate == issuer.X509certificate {
+			return true
+		}
+	}
+	return false
+}
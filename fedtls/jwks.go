@@ -0,0 +1,199 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package fedtls
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// ErrNoUsableKeys is returned by ReadJWKS when the JWKS doesn't contain any
+// keys which can be used to verify signatures
+var ErrNoUsableKeys = errors.New("JWKS contains no usable keys")
+
+// Whether a key can be used to verify signatures
+func usableForVerification(key jwk.Key) bool {
+	switch key.KeyType() {
+	case jwa.EC, jwa.RSA, jwa.OKP, jwa.OctetSeq:
+	default:
+		return false
+	}
+
+	if key.KeyUsage() == string(jwk.ForEncryption) {
+		return false
+	}
+
+	if ops := key.KeyOps(); len(ops) > 0 {
+		for _, op := range ops {
+			if op == jwk.KeyOpVerify {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Returns ErrNoUsableKeys if none of the keys in set can be used to verify
+// signatures
+func checkUsableKeys(set jwk.Set) error {
+	for i := 0; i < set.Len(); i++ {
+		if key, ok := set.Key(i); ok && usableForVerification(key) {
+			return nil
+		}
+	}
+	return ErrNoUsableKeys
+}
+
+// ReadJWKS reads the federation's signing keys from path.
+//
+// If path is a file, its contents are returned as they are. If it's a
+// directory, every .json and .jwk file in it (each containing a single JWK
+// or a JWKS) is read and the keys are merged into one JWKS. Files which
+// can't be parsed are logged and skipped, but it's an error if no keys
+// could be loaded at all.
+//
+// If there are no keys which can be used to verify signatures (for
+// instance an empty JWKS, or only encryption keys) the error wraps
+// ErrNoUsableKeys, since all verification would fail anyway.
+func ReadJWKS(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		set, err := jwk.Parse(content)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse JWKS (%s): %v", path, err)
+		}
+
+		if err := checkUsableKeys(set); err != nil {
+			return nil, fmt.Errorf("%w (%s)", err, path)
+		}
+		return content, nil
+	}
+
+	entries, err := os.ReadDir(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if !entry.IsDir() && (ext == ".json" || ext == ".jwk") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	merged := jwk.NewSet()
+	for _, name := range names {
+		file := filepath.Join(path, name)
+		content, err := os.ReadFile(file)
+
+		if err != nil {
+			log.Printf("Failed to read JWK file (%s): %v", file, err)
+			continue
+		}
+
+		set, err := jwk.Parse(content)
+
+		if err != nil {
+			log.Printf("Failed to parse JWK file (%s): %v", file, err)
+			continue
+		}
+
+		for i := 0; i < set.Len(); i++ {
+			key, _ := set.Key(i)
+			if err := merged.AddKey(key); err != nil {
+				log.Printf("Failed to add key from JWK file (%s): %v", file, err)
+			}
+		}
+	}
+
+	if merged.Len() == 0 {
+		return nil, fmt.Errorf("No keys found in JWKS directory (%s)", path)
+	}
+
+	if err := checkUsableKeys(merged); err != nil {
+		return nil, fmt.Errorf("%w (%s)", err, path)
+	}
+	return json.Marshal(merged)
+}
+
+// ErrJWKSThumbprintMismatch is returned by CheckJWKSThumbprints when the
+// JWKS contains a key which isn't pinned
+var ErrJWKSThumbprintMismatch = errors.New("JWKS contains a key with an unexpected thumbprint")
+
+// JWKSThumbprints returns the RFC 7638 thumbprints (SHA-256, base64url
+// encoded without padding) of the keys in a JWKS
+func JWKSThumbprints(jwks []byte) ([]string, error) {
+	set, err := jwk.Parse(jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	thumbprints := make([]string, 0, set.Len())
+	for i := 0; i < set.Len(); i++ {
+		key, _ := set.Key(i)
+		tp, err := key.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		thumbprints = append(thumbprints, base64.RawURLEncoding.EncodeToString(tp))
+	}
+	return thumbprints, nil
+}
+
+// CheckJWKSThumbprints verifies that every key in a JWKS has one of the
+// pinned thumbprints (as given by JWKSThumbprints), so that a JWKS which
+// has been swapped or extended with other keys isn't trusted. Pins which
+// don't match any key are allowed, to make it possible to pin a key before
+// it's rolled out. Without pins any JWKS is accepted.
+func CheckJWKSThumbprints(jwks []byte, pinned []string) error {
+	if len(pinned) == 0 {
+		return nil
+	}
+
+	thumbprints, err := JWKSThumbprints(jwks)
+	if err != nil {
+		return err
+	}
+
+	allowed := make(map[string]bool, len(pinned))
+	for _, pin := range pinned {
+		allowed[strings.TrimRight(strings.TrimSpace(pin), "=")] = true
+	}
+
+	for _, tp := range thumbprints {
+		if !allowed[tp] {
+			return fmt.Errorf("%w: %s", ErrJWKSThumbprintMismatch, tp)
+		}
+	}
+	return nil
+}
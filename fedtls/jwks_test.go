@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package fedtls
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+func TestReadJWKSDirectory(t *testing.T) {
+	current := newTestFederation(t)
+	next := newTestFederation(t)
+
+	// Keys in the merged set must have distinct key IDs
+	must(next.key.Set(jwk.KeyIDKey, "next"), t)
+	public, err := jwk.PublicKeyOf(next.key)
+	must(err, t)
+	set := jwk.NewSet()
+	must(set.AddKey(public), t)
+	next.jwks, err = json.Marshal(set)
+	must(err, t)
+
+	dir := t.TempDir()
+	must(os.WriteFile(filepath.Join(dir, "current.json"), current.jwks, 0600), t)
+	must(os.WriteFile(filepath.Join(dir, "next.jwk"), next.jwks, 0600), t)
+	must(os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{not json"), 0600), t)
+	must(os.WriteFile(filepath.Join(dir, "README.txt"), []byte("ignored"), 0600), t)
+
+	jwks, err := ReadJWKS(dir)
+	must(err, t)
+
+	for _, fed := range []*testFederation{current, next} {
+		signed := fed.sign(t, testMetadata("https://example.com", "pin"), time.Now().Add(time.Hour))
+		if _, err := verify(signed, jwks, defaultOptions()); err != nil {
+			t.Errorf("Failed to verify with merged JWKS: %v", err)
+		}
+	}
+}
+
+func TestReadJWKSEmptyDirectory(t *testing.T) {
+	dir := t.TempDir()
+	must(os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{not json"), 0600), t)
+
+	if _, err := ReadJWKS(dir); err == nil {
+		t.Errorf("Expected an error for a directory without usable keys")
+	}
+}
+
+func TestReadJWKSNoUsableKeys(t *testing.T) {
+	fed := newTestFederation(t)
+
+	public, err := jwk.PublicKeyOf(fed.key)
+	must(err, t)
+	must(public.Set(jwk.KeyUsageKey, jwk.ForEncryption), t)
+	encryptionOnly := jwk.NewSet()
+	must(encryptionOnly.AddKey(public), t)
+	encryptionJWKS, err := json.Marshal(encryptionOnly)
+	must(err, t)
+
+	dir := t.TempDir()
+	write := func(name string, content []byte) string {
+		path := filepath.Join(dir, name)
+		must(os.WriteFile(path, content, 0600), t)
+		return path
+	}
+
+	for _, path := range []string{
+		write("empty.json", []byte(`{"keys": []}`)),
+		write("encryption.json", encryptionJWKS),
+	} {
+		if _, err := ReadJWKS(path); !errors.Is(err, ErrNoUsableKeys) {
+			t.Errorf("Expected ErrNoUsableKeys for %s, got %v", filepath.Base(path), err)
+		}
+	}
+
+	if _, err := ReadJWKS(fed.jwksFile(t)); err != nil {
+		t.Errorf("Failed to read valid JWKS: %v", err)
+	}
+}
+
+func TestCheckJWKSThumbprints(t *testing.T) {
+	current := newTestFederation(t)
+	other := newTestFederation(t)
+
+	// Computed independently of JWKSThumbprints
+	thumbprint := func(fed *testFederation) string {
+		tp, err := fed.key.Thumbprint(crypto.SHA256)
+		must(err, t)
+		return base64.RawURLEncoding.EncodeToString(tp)
+	}
+
+	if err := CheckJWKSThumbprints(current.jwks, nil); err != nil {
+		t.Errorf("JWKS refused without pins: %v", err)
+	}
+
+	// A pin for a key which isn't rolled out yet is fine
+	if err := CheckJWKSThumbprints(current.jwks, []string{thumbprint(other), thumbprint(current)}); err != nil {
+		t.Errorf("JWKS with pinned key refused: %v", err)
+	}
+
+	if err := CheckJWKSThumbprints(other.jwks, []string{thumbprint(current)}); !errors.Is(err, ErrJWKSThumbprintMismatch) {
+		t.Errorf("Expected ErrJWKSThumbprintMismatch for swapped JWKS, got %v", err)
+	}
+
+	// A key added next to the pinned one
+	must(other.key.Set(jwk.KeyIDKey, "other"), t)
+	public, err := jwk.PublicKeyOf(other.key)
+	must(err, t)
+	set, err := jwk.Parse(current.jwks)
+	must(err, t)
+	must(set.AddKey(public), t)
+	extended, err := json.Marshal(set)
+	must(err, t)
+
+	if err := CheckJWKSThumbprints(extended, []string{thumbprint(current)}); !errors.Is(err, ErrJWKSThumbprintMismatch) {
+		t.Errorf("Expected ErrJWKSThumbprintMismatch for extended JWKS, got %v", err)
+	}
+}
@@ -79,9 +79,89 @@ type Entity struct {
 	OrganizationID *string  `json:"organization_id"`
 }
 
+// Copies a string pointer, so that the copy doesn't share the string
+func copyString(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	return &c
+}
+
+// Makes a deep copy of an entity, which shares nothing with the original
+func (e *Entity) deepCopy() *Entity {
+	c := *e
+	c.Organization = copyString(e.Organization)
+	c.OrganizationID = copyString(e.OrganizationID)
+	c.Issuers = append([]Issuer(nil), e.Issuers...)
+
+	if e.Clients != nil {
+		c.Clients = make([]Client, len(e.Clients))
+		for i, client := range e.Clients {
+			c.Clients[i] = Client{
+				Description: copyString(client.Description),
+				Pins:        append([]Pin(nil), client.Pins...),
+			}
+		}
+	}
+
+	if e.Servers != nil {
+		c.Servers = make([]Server, len(e.Servers))
+		for i, server := range e.Servers {
+			c.Servers[i] = Server{
+				Description: copyString(server.Description),
+				BaseURI:     server.BaseURI,
+				Tags:        append([]string(nil), server.Tags...),
+				Pins:        append([]Pin(nil), server.Pins...),
+			}
+		}
+	}
+	return &c
+}
+
 // Metadata is the complete representation of all entities in the federation
 type Metadata struct {
 	Version  string   `json:"version"`
 	CacheTTL int      `json:"cache_ttl"`
 	Entities []Entity `json:"entities"`
 }
+
+// The only pin algorithm we can match client certificates against
+const supportedPinAlg = "sha256"
+
+// MetadataStats counts what was found when parsing metadata
+type MetadataStats struct {
+	Entities int
+	Clients  int
+	Servers  int
+	Issuers  int
+
+	// Client pins, including those with an unsupported algorithm
+	ClientPins int
+
+	// Client pins with an algorithm other than sha256, which will never
+	// match a client's certificate
+	UnsupportedPins int
+}
+
+// Stats counts the entities, clients etc. in the metadata
+func (md *Metadata) Stats() MetadataStats {
+	var stats MetadataStats
+
+	for _, entity := range md.Entities {
+		stats.Entities++
+		stats.Clients += len(entity.Clients)
+		stats.Servers += len(entity.Servers)
+		stats.Issuers += len(entity.Issuers)
+
+		for _, client := range entity.Clients {
+			for _, pin := range client.Pins {
+				stats.ClientPins++
+				if pin.Alg != supportedPinAlg {
+					stats.UnsupportedPins++
+				}
+			}
+		}
+	}
+	return stats
+}
@@ -73,3 +73,18 @@ func TestUnmarshalOrganization(t *testing.T) {
 	shouldEqualString(*e.Organization, "Example Organization Ltd.", "organization", t)
 	shouldEqualString(*e.OrganizationID, "123456-7890", "organization_id", t)
 }
+
+func TestMetadataStats(t *testing.T) {
+	md := testMetadata("https://example.com", "pin")
+	md.Entities[0].Clients[0].Pins = append(md.Entities[0].Clients[0].Pins, Pin{Alg: "sha512", Digest: "other"})
+	md.Entities = append(md.Entities, Entity{
+		EntityID: "https://server.example.com",
+		Issuers:  []Issuer{{X509certificate: "issuer"}},
+		Servers:  []Server{{BaseURI: "https://server.example.com/"}},
+	})
+
+	expected := MetadataStats{Entities: 2, Clients: 1, Servers: 1, Issuers: 1, ClientPins: 2, UnsupportedPins: 1}
+	if stats := md.Stats(); stats != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+}
@@ -8,13 +8,25 @@
 package fedtls
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/joesiltberg/bowness/util"
@@ -24,31 +36,246 @@ import (
 type IssuersPerEntity map[string][]Issuer
 
 // A MetadataStore regularly downloads, verifies and parses the metadata from
-// a federation.
+// a federation (or several federations).
 type MetadataStore struct {
-	quit        chan int
-	addListener chan chan int
+	// One quit channel per source's goroutine
+	quit []chan int
+
+	// Channels to notify when metadata changes, protected by listenerLock
+	listeners    []chan int
+	listenerLock sync.Mutex
 
 	// This is the in-memory, latest verified metadata. It should never be nil,
 	// but it can be a pointer to a default constructed Metadata (which has
 	// no entries). This is the case before we've managed to read, verify and
 	// parse the metadata, or if we fail to do so.
+	// With several sources, this is the merged metadata from all of them.
 	parsed *Metadata
 
-	// This mutex protects the parsed pointer
+	// The latest verified metadata per source (never nil)
+	perSource []*Metadata
+
+	// Which sources have loaded valid metadata
+	loaded []bool
+
+	// Information about how the store is doing, see Status()
+	status MetadataStoreStatus
+
+	// When each source will be refreshed next
+	schedules []refreshSchedule
+
+	// Incremented every time new metadata is loaded, see Version()
+	version atomic.Uint64
+
+	// Hash of parsed, see MetadataHash()
+	hash string
+
+	// When the store was created
+	created time.Time
+
+	// Client pins recently removed from metadata, only kept with
+	// RemovedPinGrace
+	removedPins map[string]removedPin
+
+	// Serializes exports (with ExportPath) from the sources' fetchers
+	exportLock sync.Mutex
+
+	options *MetadataStoreOptions
+
+	// This mutex protects the parsed pointers and the status
 	lock sync.Mutex
 }
 
+// A MetadataSource is a federation's metadata, along with the keys to verify
+// it with and where to cache it
+type MetadataSource struct {
+	URL       string
+	JWKSPath  string
+	CachePath string
+
+	// Additional locations the verified metadata is cached in, for
+	// instance on a shared volume. At start up the first cache (starting
+	// with CachePath) which verifies is used. Like CachePath they may be
+	// directories.
+	SecondaryCachePaths []string
+
+	// If set, the RFC 7638 thumbprints of the keys allowed in the JWKS
+	// (see CheckJWKSThumbprints). A JWKS with any other key is refused.
+	JWKSThumbprints []string
+
+	// Where to get the payload when the DetachedPayload option is used,
+	// URL is then expected to serve a JWS without payload
+	PayloadURL string
+}
+
+// MetadataStoreStatus describes the current state of a MetadataStore
+type MetadataStoreStatus struct {
+	// Loaded is false until valid metadata has been read from the cache
+	// or downloaded from the federation operator. Until then no clients
+	// will be trusted. With several sources, Loaded is false until every
+	// source has loaded (clients from the sources which have loaded are
+	// trusted meanwhile).
+	Loaded bool
+
+	// LastUpdate is when the current metadata was loaded (zero if never)
+	LastUpdate time.Time
+
+	// LastError is the error from the latest attempt to fetch and verify
+	// metadata, nil if it succeeded (or if there hasn't been an attempt yet)
+	LastError error
+
+	// InitialSource tells where the first valid metadata came from,
+	// SourceCache or SourceNetwork (empty if not loaded yet). With several
+	// sources, it's where the last source to load got its metadata from.
+	InitialSource string
+
+	// TimeToFirstLoad is the time from the store's creation until valid
+	// metadata was first loaded (from every source)
+	TimeToFirstLoad time.Duration
+
+	// CacheTTL is the cache TTL in effect, from the metadata's cache_ttl
+	// or DefaultCacheTTL (zero if no metadata is loaded)
+	CacheTTL time.Duration
+
+	// NextRefresh is when the metadata will be fetched next, which may be
+	// sooner than CacheTTL indicates after a failed attempt.
+	// With several sources, CacheTTL and NextRefresh are for the source
+	// which will be refreshed first.
+	NextRefresh time.Time
+
+	// Stats counts the entities, clients etc. in the current metadata
+	// (merged from all sources)
+	Stats MetadataStats
+}
+
+// A source's effective cache TTL and when it will be refreshed next
+type refreshSchedule struct {
+	cacheTTL time.Duration
+	next     time.Time
+}
+
+// Sources of metadata, see MetadataStoreStatus.InitialSource
+const (
+	SourceCache   = "cache"
+	SourceNetwork = "network"
+
+	// Set with SetMetadata, see NewStaticMetadataStore
+	SourceStatic = "static"
+)
+
 // MetadataStoreOptions are configuration options for the metadata store
 type MetadataStoreOptions struct {
 	// Used when the metadata doesn't have a CacheTTL attribute
 	DefaultCacheTTL time.Duration
 
+	// A smaller cache_ttl in the metadata is raised to this (0 disables)
+	MinCacheTTL time.Duration
+
 	// Used when we fail to get the jws from the federation's web server
 	NetworkRetry time.Duration
 
+	// The shortest time between two downloads from the same source,
+	// whatever triggers them (0 disables)
+	MinRefreshInterval time.Duration
+
 	// Used when the verification fails or we can't parse the metadata
 	BadContentRetry time.Duration
+
+	// Log a distinct error on each failed attempt as long as we've never
+	// managed to load any valid metadata
+	ColdStartErrors bool
+
+	// If set, the metadata's iss header must match this
+	ExpectedIssuer string
+
+	// If set, metadata whose iat header is older than this is rejected
+	MaxMetadataAge time.Duration
+
+	// Turns the verified payload into Metadata
+	Parser MetadataParser
+
+	// If not empty, the metadata must be served with one of these content
+	// types. A mismatch is treated like a network error.
+	AllowedContentTypes []string
+
+	// Match client pins against every certificate in the client's verified
+	// chain, not just the leaf
+	MatchChainPins bool
+
+	// Read the cache file at start up, but never write to it
+	ReadOnlyCache bool
+
+	// If set, a cache file modified longer ago than this isn't used at
+	// start up until an attempt has been made to download fresh metadata.
+	// If that attempt fails, the (still valid) cache is used anyway.
+	MaxCacheAge time.Duration
+
+	// How long to wait for the attempt above before using the old cache
+	// anyway (the attempt continues, and its metadata replaces the cache
+	// if it succeeds)
+	MaxCacheAgeWait time.Duration
+
+	// The metadata is published as a JWS with a detached payload, the
+	// payload is downloaded separately from each source's PayloadURL
+	DetachedPayload bool
+
+	// Called when downloading metadata fails, with a *FetchError
+	OnFetchError func(err *FetchError)
+
+	// Called with the IDs of entities which were present in the previous
+	// metadata but not in newly loaded metadata
+	OnEntitiesRemoved func(entityIDs []string)
+
+	// Called after every attempt to load metadata, successful or not
+	OnRefresh func(event *RefreshEvent)
+
+	// Clients matching this list are rejected by LookupClient even if
+	// they're found in metadata
+	DenyList *DenyList
+
+	// If set, only clients matching this list are accepted by LookupClient
+	AllowList *AllowList
+
+	// After this many consecutive failures to verify or parse downloaded
+	// metadata, OnBadContentThreshold is called (0 disables)
+	BadContentThreshold int
+
+	// Called when a source's downloaded metadata has failed verification
+	// BadContentThreshold times in a row, with the latest error
+	OnBadContentThreshold func(url string, failures int, err error)
+
+	// The HTTP client used to download metadata
+	HTTPClient *http.Client
+
+	// Clients whose pins have been removed from metadata are still
+	// accepted by LookupClient for this long after the removal (0 disables)
+	RemovedPinGrace time.Duration
+
+	// Called when a client is accepted because of RemovedPinGrace
+	OnRemovedPinAccepted func(entityID, fingerprint string)
+
+	// If set, the verified metadata (merged from all sources) is written
+	// here as normalized JSON whenever new metadata is loaded
+	ExportPath string
+}
+
+// A RefreshEvent describes an attempt to load metadata from a source
+type RefreshEvent struct {
+	// The source's metadata URL
+	URL string
+
+	// Where the metadata was loaded from, SourceCache or SourceNetwork
+	Source string
+
+	// Number of entities in the loaded metadata (from this source only)
+	Entities int
+
+	// Why loading failed, nil on success
+	Err error
+
+	// The hash of the metadata in effect after loading (merged from all
+	// sources, see MetadataHash), empty if loading failed
+	MetadataHash string
 }
 
 // An OptionSetter is a function for modifying the metadata store options
@@ -61,6 +288,14 @@ func DefaultCacheTTL(duration time.Duration) OptionSetter {
 	}
 }
 
+// MinCacheTTL creates an OptionSetter for setting the minimum cache TTL,
+// which protects against metadata published with a too small cache_ttl
+func MinCacheTTL(duration time.Duration) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.MinCacheTTL = duration
+	}
+}
+
 // NetworkRetry creates an OptionSetter for setting the network retry
 func NetworkRetry(duration time.Duration) OptionSetter {
 	return func(options *MetadataStoreOptions) {
@@ -68,6 +303,15 @@ func NetworkRetry(duration time.Duration) OptionSetter {
 	}
 }
 
+// MinRefreshInterval creates an OptionSetter for setting the shortest time
+// between two downloads from a source, which protects the metadata server
+// from scheduled refreshes and retries being too frequent
+func MinRefreshInterval(duration time.Duration) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.MinRefreshInterval = duration
+	}
+}
+
 // BadContentRetry creates an OptionSetter for setting the bad content retry
 func BadContentRetry(duration time.Duration) OptionSetter {
 	return func(options *MetadataStoreOptions) {
@@ -75,32 +319,283 @@ func BadContentRetry(duration time.Duration) OptionSetter {
 	}
 }
 
-// NewMetadataStore constructs a new MetadataStore and starts its goroutine
-func NewMetadataStore(url, jwksPath, cachedPath string, setters ...OptionSetter) *MetadataStore {
-	ms := MetadataStore{
-		quit:        make(chan int),
-		addListener: make(chan chan int),
-		parsed:      &Metadata{},
+// ColdStartErrors creates an OptionSetter for enabling extra error logging
+// while the store has never loaded valid metadata
+func ColdStartErrors(enabled bool) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.ColdStartErrors = enabled
+	}
+}
+
+// Parser creates an OptionSetter for replacing the metadata parser.
+// A nil parser is ignored (DefaultMetadataParser is kept).
+func Parser(parser MetadataParser) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		if parser != nil {
+			options.Parser = parser
+		}
+	}
+}
+
+// OnEntitiesRemoved creates an OptionSetter for setting a callback which is
+// called when entities disappear from the metadata
+func OnEntitiesRemoved(callback func(entityIDs []string)) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.OnEntitiesRemoved = callback
+	}
+}
+
+// ReadOnlyCache creates an OptionSetter for making the cache file read only
+// (it's read at start up but not updated when new metadata is downloaded)
+func ReadOnlyCache(readOnly bool) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.ReadOnlyCache = readOnly
+	}
+}
+
+// MaxCacheAge creates an OptionSetter for setting how old the cache file may
+// be (according to its modification time) to be used at start up before
+// trying to download fresh metadata
+func MaxCacheAge(maxAge time.Duration) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.MaxCacheAge = maxAge
+	}
+}
+
+// MaxCacheAgeWait creates an OptionSetter for setting how long to wait for
+// fresh metadata, when the cache is older than MaxCacheAge, before using
+// the cache anyway. The default is 10 seconds.
+func MaxCacheAgeWait(wait time.Duration) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.MaxCacheAgeWait = wait
+	}
+}
+
+// DetachedPayload creates an OptionSetter for verifying metadata published
+// as a JWS with a detached payload
+func DetachedPayload(detached bool) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.DetachedPayload = detached
+	}
+}
+
+// ExpectedIssuer creates an OptionSetter for requiring a specific issuer
+// (iss header) in the signed metadata
+func ExpectedIssuer(issuer string) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.ExpectedIssuer = issuer
+	}
+}
+
+// MaxMetadataAge creates an OptionSetter for rejecting metadata which was
+// issued (according to its iat header) longer ago than maxAge, even if it
+// hasn't expired. This protects against an old copy being replayed.
+func MaxMetadataAge(maxAge time.Duration) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.MaxMetadataAge = maxAge
 	}
+}
+
+// DefaultAllowedContentTypes are content types commonly used when serving
+// signed metadata, suitable for use with AllowedContentTypes
+var DefaultAllowedContentTypes = []string{
+	"application/jose",
+	"application/jose+json",
+	"application/jwt",
+	"application/octet-stream",
+}
+
+// AllowedContentTypes creates an OptionSetter for restricting which content
+// types the metadata may be served with
+func AllowedContentTypes(contentTypes ...string) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.AllowedContentTypes = contentTypes
+	}
+}
+
+// OnFetchError creates an OptionSetter for setting a callback which is called
+// when downloading metadata fails
+func OnFetchError(callback func(err *FetchError)) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.OnFetchError = callback
+	}
+}
+
+// OnRefresh creates an OptionSetter for setting a callback which is called
+// after every attempt to load metadata
+func OnRefresh(callback func(event *RefreshEvent)) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.OnRefresh = callback
+	}
+}
+
+// BadContentThreshold creates an OptionSetter for setting a callback which
+// is called when downloaded metadata has failed verification threshold times
+// in a row. Retries continue as usual, this is meant for alerting.
+func BadContentThreshold(threshold int, callback func(url string, failures int, err error)) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.BadContentThreshold = threshold
+		options.OnBadContentThreshold = callback
+	}
+}
+
+// Deny creates an OptionSetter for setting a local deny list
+func Deny(list *DenyList) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.DenyList = list
+	}
+}
+
+// ExportPath creates an OptionSetter for writing the verified metadata to
+// a file as pretty-printed JSON whenever it changes. Entities, clients,
+// pins etc. are sorted so the file is stable and can be diffed.
+func ExportPath(path string) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.ExportPath = path
+	}
+}
+
+// RemovedPinGrace creates an OptionSetter for accepting clients for a while
+// after their pins have been removed from metadata, for instance to avoid
+// abruptly breaking a member during a planned migration. callback (if not
+// nil) is called whenever a client is accepted because of the grace period.
+func RemovedPinGrace(grace time.Duration, callback func(entityID, fingerprint string)) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.RemovedPinGrace = grace
+		options.OnRemovedPinAccepted = callback
+	}
+}
+
+// Allow creates an OptionSetter for setting a local allow list
+func Allow(list *AllowList) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.AllowList = list
+	}
+}
+
+// MatchChainPins creates an OptionSetter for matching client pins against
+// all certificates in the client's chain (for federations which pin CAs)
+func MatchChainPins(enabled bool) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.MatchChainPins = enabled
+	}
+}
 
-	options := &MetadataStoreOptions{
+// HTTPClient creates an OptionSetter for setting the HTTP client used to
+// download metadata, for instance to use a proxy or special timeouts
+func HTTPClient(client *http.Client) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		options.HTTPClient = client
+	}
+}
+
+// Resolver creates an OptionSetter for resolving the metadata host with a
+// specific resolver rather than the system's, as may be needed with split
+// horizon DNS. It replaces any client set with HTTPClient.
+func Resolver(resolver *net.Resolver) OptionSetter {
+	return func(options *MetadataStoreOptions) {
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Resolver:  resolver,
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = dialer.DialContext
+		options.HTTPClient = &http.Client{Transport: transport}
+	}
+}
+
+// ResolverAt returns a resolver which sends all DNS queries to a specific
+// DNS server, address is a host and port (for instance "10.0.0.53:53")
+func ResolverAt(address string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+func defaultOptions() *MetadataStoreOptions {
+	return &MetadataStoreOptions{
 		DefaultCacheTTL: 3600 * time.Second,
 		NetworkRetry:    1 * time.Minute,
 		BadContentRetry: 1 * time.Hour,
+		MaxCacheAgeWait: 10 * time.Second,
+		Parser:          DefaultMetadataParser,
+		HTTPClient:      http.DefaultClient,
+	}
+}
+
+// NewMetadataStore constructs a new MetadataStore and starts its goroutine
+func NewMetadataStore(url, jwksPath, cachedPath string, setters ...OptionSetter) *MetadataStore {
+	return NewMultiMetadataStore([]MetadataSource{
+		{URL: url, JWKSPath: jwksPath, CachePath: cachedPath},
+	}, setters...)
+}
+
+// NewMultiMetadataStore constructs a MetadataStore which trusts the entities
+// of several federations. Each source is refreshed independently, and the
+// entities from all sources are merged.
+func NewMultiMetadataStore(sources []MetadataSource, setters ...OptionSetter) *MetadataStore {
+	ms := MetadataStore{
+		quit:      make([]chan int, len(sources)),
+		parsed:    &Metadata{},
+		perSource: make([]*Metadata, len(sources)),
+		loaded:    make([]bool, len(sources)),
+		schedules: make([]refreshSchedule, len(sources)),
+		created:   time.Now(),
+		options:   defaultOptions(),
 	}
 
+	options := ms.options
+
 	for _, setter := range setters {
 		setter(options)
 	}
 
-	go metadataFetcher(url, jwksPath, cachedPath, options, &ms)
+	for i := range sources {
+		ms.quit[i] = make(chan int)
+		ms.perSource[i] = &Metadata{}
+	}
+
+	for i, source := range sources {
+		go metadataFetcher(i, source, options, &ms)
+	}
 	return &ms
 }
 
-// Quit tells the MetadataStore's goroutine to quit and waits until it's done
+// NewStaticMetadataStore constructs a MetadataStore which doesn't fetch
+// any metadata itself, instead it's given already verified metadata with
+// SetMetadata. This is useful for tests, and for applications which get
+// their metadata some other way.
+func NewStaticMetadataStore(setters ...OptionSetter) *MetadataStore {
+	mdstore := NewMultiMetadataStore(nil, setters...)
+	mdstore.perSource = []*Metadata{{}}
+	mdstore.loaded = make([]bool, 1)
+	mdstore.schedules = make([]refreshSchedule, 1)
+	return mdstore
+}
+
+// SetMetadata replaces the metadata of a store created with
+// NewStaticMetadataStore, and notifies everyone interested like when new
+// metadata has been fetched
+func (mdstore *MetadataStore) SetMetadata(md *Metadata) {
+	oldParsed, merged, _ := mdstore.setNewParsed(0, md, SourceStatic)
+	mdstore.notifyAll()
+
+	if removed := removedEntities(oldParsed, merged); len(removed) > 0 && mdstore.options.OnEntitiesRemoved != nil {
+		mdstore.options.OnEntitiesRemoved(removed)
+	}
+}
+
+// Quit tells the MetadataStore's goroutines to quit and waits until they're done
 func (mdstore *MetadataStore) Quit() {
-	mdstore.quit <- 0
-	<-mdstore.quit
+	for _, quit := range mdstore.quit {
+		quit <- 0
+		<-quit
+	}
 }
 
 func (mdstore *MetadataStore) getParsed() *Metadata {
@@ -109,18 +604,198 @@ func (mdstore *MetadataStore) getParsed() *Metadata {
 	return mdstore.parsed
 }
 
-func (mdstore *MetadataStore) setNewParsed(newParsed *Metadata) {
+// Merges the metadata from several sources, entities from all sources are
+// included. Entity IDs found in more than one source are logged.
+// The merged version is the sources' versions (comma separated unless
+// they're all the same), and the cache TTL is the shortest one.
+func mergeMetadata(perSource []*Metadata) *Metadata {
+	if len(perSource) == 1 {
+		return perSource[0]
+	}
+
+	merged := &Metadata{}
+	seen := make(map[string]bool)
+	var versions []string
+
+	for _, md := range perSource {
+		if md.Version != "" && !slices.Contains(versions, md.Version) {
+			versions = append(versions, md.Version)
+		}
+		if md.CacheTTL > 0 && (merged.CacheTTL == 0 || md.CacheTTL < merged.CacheTTL) {
+			merged.CacheTTL = md.CacheTTL
+		}
+		for i := range md.Entities {
+			entityID := md.Entities[i].EntityID
+			if seen[entityID] {
+				log.Printf("Entity %s is present in more than one federation", entityID)
+			}
+			seen[entityID] = true
+			merged.Entities = append(merged.Entities, md.Entities[i])
+		}
+	}
+	merged.Version = strings.Join(versions, ",")
+	return merged
+}
+
+// Sets new metadata for one of the sources, returns the previous
+// and the new (merged) metadata, and the new metadata's hash
+func (mdstore *MetadataStore) setNewParsed(index int, newParsed *Metadata, source string) (*Metadata, *Metadata, string) {
+	mdstore.lock.Lock()
+	defer mdstore.lock.Unlock()
+	oldParsed := mdstore.parsed
+	mdstore.perSource[index] = newParsed
+	mdstore.loaded[index] = true
+	mdstore.parsed = mergeMetadata(mdstore.perSource)
+	mdstore.version.Add(1)
+	mdstore.hash = hashMetadata(mdstore.parsed)
+	if mdstore.options.RemovedPinGrace > 0 {
+		mdstore.trackRemovedPins(oldParsed, mdstore.parsed, time.Now())
+	}
+	if !mdstore.status.Loaded && !slices.Contains(mdstore.loaded, false) {
+		mdstore.status.InitialSource = source
+		mdstore.status.TimeToFirstLoad = time.Since(mdstore.created)
+		mdstore.status.Loaded = true
+		log.Printf("Initial metadata loaded from %s after %v", source, mdstore.status.TimeToFirstLoad)
+	}
+	mdstore.status.LastUpdate = time.Now()
+	mdstore.status.LastError = nil
+	mdstore.status.Stats = mdstore.parsed.Stats()
+	return oldParsed, mdstore.parsed, mdstore.hash
+}
+
+// Version returns a number which changes whenever something affecting the
+// result of LookupClient changes (new metadata is loaded or the deny list is
+// reloaded). It can be used to cheaply detect if a previous lookup is stale.
+func (mdstore *MetadataStore) Version() uint64 {
+	version := mdstore.version.Load()
+	if mdstore.options.DenyList != nil {
+		version += mdstore.options.DenyList.loaded()
+	}
+	if mdstore.options.AllowList != nil {
+		version += mdstore.options.AllowList.loaded()
+	}
+	return version
+}
+
+// Hashes the metadata as it was parsed, so that the hash doesn't depend on
+// formatting or the signature. The entities are encoded one at a time,
+// to avoid holding an encoding of the whole metadata in memory.
+func hashMetadata(md *Metadata) string {
+	digest := sha256.New()
+	enc := json.NewEncoder(digest)
+
+	header := struct {
+		Version  string `json:"version"`
+		CacheTTL int    `json:"cache_ttl"`
+	}{md.Version, md.CacheTTL}
+
+	if err := enc.Encode(header); err != nil {
+		return ""
+	}
+	for i := range md.Entities {
+		if err := enc.Encode(&md.Entities[i]); err != nil {
+			return ""
+		}
+	}
+	return fmt.Sprintf("%x", digest.Sum(nil))
+}
+
+// MetadataHash returns a SHA-256 hash (hex encoded) of the current
+// metadata (merged from all sources), or an empty string if no metadata
+// has been loaded. Unlike Version it's the same across restarts and
+// instances, so it identifies the exact metadata a decision was based on.
+func (mdstore *MetadataStore) MetadataHash() string {
 	mdstore.lock.Lock()
 	defer mdstore.lock.Unlock()
-	mdstore.parsed = newParsed
+
+	return mdstore.hash
 }
 
+func (mdstore *MetadataStore) setLastError(err error) {
+	mdstore.lock.Lock()
+	defer mdstore.lock.Unlock()
+	mdstore.status.LastError = err
+}
+
+// Status returns the current state of the metadata store
+func (mdstore *MetadataStore) Status() MetadataStoreStatus {
+	mdstore.lock.Lock()
+	defer mdstore.lock.Unlock()
+
+	status := mdstore.status
+	for _, schedule := range mdstore.schedules {
+		if !schedule.next.IsZero() && (status.NextRefresh.IsZero() || schedule.next.Before(status.NextRefresh)) {
+			status.CacheTTL = schedule.cacheTTL
+			status.NextRefresh = schedule.next
+		}
+	}
+	return status
+}
+
+func (mdstore *MetadataStore) setSchedule(index int, schedule refreshSchedule) {
+	mdstore.lock.Lock()
+	defer mdstore.lock.Unlock()
+	mdstore.schedules[index] = schedule
+}
+
+// AddChangeListener registers a channel which will be sent to every time
+// new metadata has been loaded
 func (mdstore *MetadataStore) AddChangeListener(listener chan int) {
-	mdstore.addListener <- listener
+	mdstore.listenerLock.Lock()
+	defer mdstore.listenerLock.Unlock()
+	mdstore.listeners = append(mdstore.listeners, listener)
+}
+
+func (mdstore *MetadataStore) notifyAll() {
+	mdstore.listenerLock.Lock()
+	listeners := make([]chan int, len(mdstore.listeners))
+	copy(listeners, mdstore.listeners)
+	mdstore.listenerLock.Unlock()
+
+	for _, listener := range listeners {
+		listener <- 0
+	}
 }
 
+// GetIssuerCertificates returns the issuers of every entity in the current
+// metadata. With RemovedPinGrace, the issuers of entities with client pins
+// still within their grace period are included too (as they were in the
+// old metadata), so that those clients' handshakes can still be verified.
 func (mdstore *MetadataStore) GetIssuerCertificates() IssuersPerEntity {
-	return issuersPerEntity(mdstore.getParsed())
+	mdstore.lock.Lock()
+	defer mdstore.lock.Unlock()
+
+	issuers := issuersPerEntity(mdstore.parsed)
+	if mdstore.options.RemovedPinGrace > 0 {
+		mdstore.addRemovedPinIssuers(issuers, time.Now())
+	}
+	return issuers
+}
+
+// EntityIDs returns the IDs of all entities in the current metadata
+func (mdstore *MetadataStore) EntityIDs() []string {
+	parsed := mdstore.getParsed()
+	result := make([]string, len(parsed.Entities))
+
+	for i := range parsed.Entities {
+		result[i] = parsed.Entities[i].EntityID
+	}
+	return result
+}
+
+// Entity returns a copy of an entity in the current metadata. The copy
+// shares nothing with the store, so the caller may modify it.
+//
+// The second return value is false if there is no entity with the given ID.
+func (mdstore *MetadataStore) Entity(entityID string) (*Entity, bool) {
+	parsed := mdstore.getParsed()
+
+	for i := range parsed.Entities {
+		if parsed.Entities[i].EntityID == entityID {
+			return parsed.Entities[i].deepCopy(), true
+		}
+	}
+	return nil, false
 }
 
 func durationToRefresh(lastFetch time.Time, cacheTTL time.Duration) time.Duration {
@@ -143,25 +818,107 @@ func durationToRefresh(lastFetch time.Time, cacheTTL time.Duration) time.Duratio
 // The result of an async HTTP GET (see fetch())
 type fetchResult struct {
 	body []byte
-	err  error
+
+	// Only set when fetching a detached payload
+	payload []byte
+
+	err error
+}
+
+// Checks the response's content type against the allowed content types,
+// an empty list allows anything
+func checkContentType(response *http.Response, allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	contentType := response.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	if err == nil {
+		for _, a := range allowed {
+			if strings.EqualFold(mediaType, a) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Unexpected content type (%s), expected one of %v", contentType, allowed)
+}
+
+// A synchronous HTTP GET, errors are returned as *FetchError
+func get(client *http.Client, url string, allowedContentTypes []string) ([]byte, error) {
+	response, err := client.Get(url)
+
+	if err != nil {
+		return nil, &FetchError{Class: classifyFetchError(err), URL: url, Err: err}
+	}
+	defer response.Body.Close()
+
+	if err := checkContentType(response, allowedContentTypes); err != nil {
+		return nil, &FetchError{Class: FetchErrorContentType, URL: url, Err: err}
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, &FetchError{Class: classifyFetchError(err), URL: url, Err: err}
+	}
+	return body, nil
 }
 
-// An async HTTP GET, sends its result to a channel
-func fetch(url string, fetched chan<- fetchResult) {
+// An async HTTP GET, sends its result to a channel. If payloadURL isn't
+// empty the detached payload is downloaded from there as well.
+func fetch(url, payloadURL string, options *MetadataStoreOptions, fetched chan<- fetchResult) {
 	log.Printf("Fetching new metadata from %s", url)
 	go func() {
-		response, err := http.Get(url)
+		body, err := get(options.HTTPClient, url, options.AllowedContentTypes)
 
 		if err != nil {
-			fetched <- fetchResult{nil, err}
-		} else {
-			body, err := ioutil.ReadAll(response.Body)
-			fetched <- fetchResult{body, err}
-			response.Body.Close()
+			fetched <- fetchResult{err: err}
+			return
+		}
+
+		var payload []byte
+		if payloadURL != "" {
+			// The payload is plain JSON, so the allowed content types
+			// for the JWS don't apply
+			payload, err = get(options.HTTPClient, payloadURL, nil)
 		}
+		fetched <- fetchResult{body: body, payload: payload, err: err}
 	}()
 }
 
+// If cachePath is a directory, returns a path to a file in that directory
+// with a name derived from the metadata URL. This way several metadata
+// sources can share a cache directory. Otherwise cachePath is returned as is.
+func resolveCachePath(cachePath, url string) string {
+	info, err := os.Stat(cachePath)
+
+	if err != nil || !info.IsDir() {
+		return cachePath
+	}
+
+	digest := sha256.Sum256([]byte(url))
+	return filepath.Join(cachePath, fmt.Sprintf("metadata-%x.jws", digest[:8]))
+}
+
+// CheckMetadataSources verifies that the sources can be used together,
+// sources sharing a cache file would overwrite each other's metadata
+func CheckMetadataSources(sources []MetadataSource) error {
+	usedBy := make(map[string]int)
+
+	for i, src := range sources {
+		paths := append([]string{src.CachePath}, src.SecondaryCachePaths...)
+		for _, path := range paths {
+			resolved := filepath.Clean(resolveCachePath(path, src.URL))
+			if j, used := usedBy[resolved]; used && j != i {
+				return fmt.Errorf("Cache path %s is used by both %s and %s", path, sources[j].URL, src.URL)
+			}
+			usedBy[resolved] = i
+		}
+	}
+	return nil
+}
+
 // Gives a files modification time, or now if we fail to stat the file
 func fileModTimeOrNow(path string) time.Time {
 	file, err := os.Stat(path)
@@ -173,130 +930,529 @@ func fileModTimeOrNow(path string) time.Time {
 	return file.ModTime()
 }
 
-func cacheTTL(metadataTTL, defaultTTL time.Duration) time.Duration {
-	if metadataTTL != 0 {
-		return metadataTTL
+// A larger cache_ttl is most likely the result of a bad publish (and could
+// overflow when converted to a time.Duration)
+const maxCacheTTL = 365 * 24 * time.Hour
+
+// Returns the cache TTL to use given the metadata's cache_ttl (in seconds)
+func cacheTTL(metadataTTL int, options *MetadataStoreOptions) time.Duration {
+	if metadataTTL == 0 {
+		return options.DefaultCacheTTL
+	}
+
+	if metadataTTL < 0 {
+		log.Printf("WARNING: Metadata has a negative cache_ttl (%d), using the default (%v)",
+			metadataTTL, options.DefaultCacheTTL)
+		return options.DefaultCacheTTL
+	}
+
+	if metadataTTL < int(options.MinCacheTTL/time.Second) {
+		log.Printf("WARNING: Metadata cache_ttl (%d) is below the minimum, using %v", metadataTTL, options.MinCacheTTL)
+		return options.MinCacheTTL
+	}
+
+	if metadataTTL > int(maxCacheTTL/time.Second) {
+		log.Printf("WARNING: Metadata cache_ttl (%d) is too large, using %v", metadataTTL, maxCacheTTL)
+		return maxCacheTTL
+	}
+	return time.Duration(metadataTTL) * time.Second
+}
+
+// Returns the IDs of entities in oldMetadata which aren't in newMetadata
+func removedEntities(oldMetadata, newMetadata *Metadata) []string {
+	present := make(map[string]bool)
+
+	for i := range newMetadata.Entities {
+		present[newMetadata.Entities[i].EntityID] = true
 	}
-	return defaultTTL
+
+	var removed []string
+	for i := range oldMetadata.Entities {
+		if !present[oldMetadata.Entities[i].EntityID] {
+			removed = append(removed, oldMetadata.Entities[i].EntityID)
+		}
+	}
+	return removed
 }
 
 func issuersPerEntity(metadata *Metadata) IssuersPerEntity {
 	result := make(IssuersPerEntity)
 
+	// An entity ID can occur more than once (for instance when merging
+	// several federations), all of its issuers should be trusted
 	for _, entity := range metadata.Entities {
-		issuers := make([]Issuer, len(entity.Issuers))
-		copy(issuers, entity.Issuers)
-		result[entity.EntityID] = issuers
+		result[entity.EntityID] = append(result[entity.EntityID], entity.Issuers...)
 	}
 
 	return result
 }
 
-// LookupClient finds an entity with a client that has a pin that matches the peer's leaf certificate
-// Returns the entity id and if available also the organization and organization id
-func (mdstore *MetadataStore) LookupClient(verifiedChains [][]*x509.Certificate) (string, *string, *string, error) {
-	fingerprint := util.Fingerprint(verifiedChains[0][0])
-	parsed := mdstore.getParsed()
+// ErrNoClientCertificate is returned by LookupClient when there is no verified
+// client certificate to look up
+var ErrNoClientCertificate = errors.New("No verified client certificate")
+
+// UnknownClientError is returned by LookupClient when the client's certificate
+// neither matches a client pin nor was issued by any entity's issuer
+type UnknownClientError struct {
+	Fingerprint string
+}
+
+func (e *UnknownClientError) Error() string {
+	return fmt.Sprintf("Failed to find client pin (%s) in metadata", e.Fingerprint)
+}
+
+// NotAClientError is returned by LookupClient when the client's certificate
+// doesn't match any client pin, but was issued by the issuer of one or more
+// known entities. Typically this means the entity is registered in metadata
+// without (this) client, for instance if it's only registered as a server.
+type NotAClientError struct {
+	Fingerprint string
+	EntityIDs   []string
+}
+
+func (e *NotAClientError) Error() string {
+	return fmt.Sprintf("Client pin (%s) not registered for entity %v", e.Fingerprint, e.EntityIDs)
+}
+
+// Returns true if any of the certificates in the chains (apart from the leaves)
+// is one of the entity's issuer certificates
+func issuedByEntity(entity *Entity, verifiedChains [][]*x509.Certificate) bool {
+	for _, issuer := range entity.Issuers {
+		rest := []byte(issuer.X509certificate)
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+
+			if block == nil {
+				break
+			}
+
+			for _, chain := range verifiedChains {
+				if len(chain) < 2 {
+					continue
+				}
+				for _, cert := range chain[1:] {
+					if bytes.Equal(cert.Raw, block.Bytes) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
 
+// Finds the entity with a client pin matching fingerprint, or nil
+func findClient(parsed *Metadata, fingerprint string) *Entity {
 	for i := range parsed.Entities {
-		entity := parsed.Entities[i].EntityID
 		for c := range parsed.Entities[i].Clients {
 			for _, pin := range parsed.Entities[i].Clients[c].Pins {
 				if pin.Digest == fingerprint {
-					return entity, parsed.Entities[i].Organization, parsed.Entities[i].OrganizationID, nil
+					return &parsed.Entities[i]
 				}
 			}
 		}
 	}
-	return "", nil, nil, fmt.Errorf("Failed to find client pin (%s) in metadata", fingerprint)
+	return nil
 }
 
-// This function is the actual metadata store. It runs in a goroutine and
-// contains a parsed in-memory copy of the latest verified metadata.
+// Checks a client found in metadata against the local deny and allow lists
+func (mdstore *MetadataStore) checkLocalLists(entity *Entity, fingerprint, candidate string) error {
+	if list := mdstore.options.DenyList; list != nil {
+		if entry, denied := list.match(entity.EntityID, fingerprint, candidate); denied {
+			return &DeniedError{EntityID: entity.EntityID, Fingerprint: fingerprint, Entry: entry}
+		}
+	}
+	if list := mdstore.options.AllowList; list != nil {
+		if _, allowed := list.match(entity.EntityID, fingerprint, candidate); !allowed {
+			return &NotAllowedError{EntityID: entity.EntityID, Fingerprint: fingerprint}
+		}
+	}
+	return nil
+}
+
+// LookupClient finds an entity with a client that has a pin that matches the peer's leaf certificate
+// (or any certificate in the peer's chain if MatchChainPins is enabled)
+// Returns the entity id and if available also the organization and organization id
+func (mdstore *MetadataStore) LookupClient(verifiedChains [][]*x509.Certificate) (string, *string, *string, error) {
+	lookup, err := mdstore.LookupClientWithMetadata(verifiedChains)
+	return lookup.EntityID, lookup.Organization, lookup.OrganizationID, err
+}
+
+// ClientLookup is the result of LookupClientWithMetadata
+type ClientLookup struct {
+	EntityID       string
+	Organization   *string
+	OrganizationID *string
+
+	// The Version and MetadataHash of the metadata the lookup was
+	// based on, also set when the lookup fails
+	Version      uint64
+	MetadataHash string
+}
+
+// Returns the current metadata together with its version and hash
+func (mdstore *MetadataStore) snapshot() (*Metadata, uint64, string) {
+	mdstore.lock.Lock()
+	defer mdstore.lock.Unlock()
+	return mdstore.parsed, mdstore.version.Load(), mdstore.hash
+}
+
+// LookupClientWithMetadata works like LookupClient, but also returns which
+// metadata the lookup was based on. Unlike calling Version and MetadataHash
+// separately, they can't refer to metadata loaded during the lookup.
+func (mdstore *MetadataStore) LookupClientWithMetadata(verifiedChains [][]*x509.Certificate) (ClientLookup, error) {
+	// The local lists' versions are read first, so a list reloaded
+	// during the lookup makes the result stale rather than missed
+	var lookup ClientLookup
+	if mdstore.options.DenyList != nil {
+		lookup.Version += mdstore.options.DenyList.loaded()
+	}
+	if mdstore.options.AllowList != nil {
+		lookup.Version += mdstore.options.AllowList.loaded()
+	}
+
+	parsed, version, hash := mdstore.snapshot()
+	lookup.Version += version
+	lookup.MetadataHash = hash
+
+	entity, err := mdstore.lookupClient(parsed, verifiedChains)
+	if err != nil {
+		return lookup, err
+	}
+	lookup.EntityID = entity.EntityID
+	lookup.Organization = entity.Organization
+	lookup.OrganizationID = entity.OrganizationID
+	return lookup, nil
+}
+
+// Finds the entity with the client in parsed (or recently removed from it)
+func (mdstore *MetadataStore) lookupClient(parsed *Metadata, verifiedChains [][]*x509.Certificate) (*Entity, error) {
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+		return nil, ErrNoClientCertificate
+	}
+
+	fingerprint := util.Fingerprint(verifiedChains[0][0])
+
+	// The leaf is always tried first, so a leaf pin takes precedence
+	// over a pin for one of the CAs
+	candidates := []string{fingerprint}
+	if mdstore.options.MatchChainPins {
+		for _, cert := range verifiedChains[0][1:] {
+			candidates = append(candidates, util.Fingerprint(cert))
+		}
+	}
+
+	for _, candidate := range candidates {
+		if entity := findClient(parsed, candidate); entity != nil {
+			if err := mdstore.checkLocalLists(entity, fingerprint, candidate); err != nil {
+				return nil, err
+			}
+			return entity, nil
+		}
+	}
+
+	if mdstore.options.RemovedPinGrace > 0 {
+		for _, candidate := range candidates {
+			entity, age, ok := mdstore.removedPinEntity(candidate, time.Now())
+			if !ok {
+				continue
+			}
+			if err := mdstore.checkLocalLists(entity, fingerprint, candidate); err != nil {
+				return nil, err
+			}
+
+			log.Printf("WARNING: Accepting client %s (%s) although its pin was removed from metadata %v ago (RemovedPinGrace)",
+				entity.EntityID, fingerprint, age.Round(time.Second))
+			if mdstore.options.OnRemovedPinAccepted != nil {
+				mdstore.options.OnRemovedPinAccepted(entity.EntityID, fingerprint)
+			}
+			return entity, nil
+		}
+	}
+
+	var issuedBy []string
+	for i := range parsed.Entities {
+		if issuedByEntity(&parsed.Entities[i], verifiedChains) {
+			issuedBy = append(issuedBy, parsed.Entities[i].EntityID)
+		}
+	}
+
+	if len(issuedBy) > 0 {
+		return nil, &NotAClientError{Fingerprint: fingerprint, EntityIDs: issuedBy}
+	}
+	return nil, &UnknownClientError{Fingerprint: fingerprint}
+}
+
+// This function is the actual metadata store. It runs in a goroutine (one
+// per source) and keeps the store updated with the latest verified metadata.
 // If possible it will read from the cached file at start up, otherwise it will
 // fetch from the federation's URL. It will regularly fetch new versions from
 // the federation URL as often as the cache TTL indicates in the latest
 // metadata.
 func metadataFetcher(
-	url, jwksPath, cachedPath string,
+	index int,
+	src MetadataSource,
 	options *MetadataStoreOptions,
 	mdstore *MetadataStore) {
 
-	listeners := make([]chan int, 0)
+	url, jwksPath := src.URL, src.JWKSPath
+	cachedPath := resolveCachePath(src.CachePath, url)
+	quit := mdstore.quit[index]
 
-	notifyAll := func() {
-		for _, listener := range listeners {
-			listener <- 0
+	// With a detached payload, the payload is cached next to the JWS
+	// (with a .payload suffix)
+	payloadURL := ""
+	if options.DetachedPayload {
+		payloadURL = src.PayloadURL
+	}
+
+	// hash is the hash of the merged metadata md resulted in
+	refreshed := func(source string, md *Metadata, hash string, err error) {
+		if options.OnRefresh != nil {
+			event := &RefreshEvent{URL: url, Source: source, Err: err}
+			if md != nil {
+				event.Entities = len(md.Entities)
+				event.MetadataHash = hash
+			}
+			options.OnRefresh(event)
 		}
 	}
 
-	jwks, err := ioutil.ReadFile(jwksPath)
+	// Replaces the current metadata and notifies everyone interested
+	update := func(newParsed *Metadata, source string) {
+		stats := newParsed.Stats()
+		log.Printf("Loaded metadata from %s (%s): %d entities, %d clients, %d client pins "+
+			"(%d with unsupported algorithm), %d servers, %d issuers",
+			url, source, stats.Entities, stats.Clients, stats.ClientPins,
+			stats.UnsupportedPins, stats.Servers, stats.Issuers)
+
+		oldParsed, merged, hash := mdstore.setNewParsed(index, newParsed, source)
+		mdstore.notifyAll()
+		refreshed(source, newParsed, hash, nil)
+
+		if options.ExportPath != "" {
+			mdstore.export(options.ExportPath)
+		}
+
+		if removed := removedEntities(oldParsed, merged); len(removed) > 0 {
+			log.Printf("Entities removed from metadata: %v", removed)
+			if options.OnEntitiesRemoved != nil {
+				options.OnEntitiesRemoved(removed)
+			}
+		}
+	}
+
+	jwks, err := ReadJWKS(jwksPath)
 
 	if err != nil {
-		log.Fatalf("Failed to read from JWKS file (%s): %v", jwksPath, err)
+		log.Fatalf("Failed to read JWKS (%s): %v", jwksPath, err)
+	}
+
+	if err := CheckJWKSThumbprints(jwks, src.JWKSThumbprints); err != nil {
+		log.Fatalf("Refusing JWKS (%s): %v", jwksPath, err)
 	}
 
-	workingCache := false
+	retry := time.After(0) // When to do the next fetch
+	var ttl time.Duration  // The effective cache TTL of the loaded metadata
+	var lastFetch time.Time
 
-	content, err := ioutil.ReadFile(cachedPath)
+	// How long until MinRefreshInterval allows another fetch
+	untilFetchAllowed := func() time.Duration {
+		if lastFetch.IsZero() {
+			return 0
+		}
+		return options.MinRefreshInterval - time.Since(lastFetch)
+	}
 
-	if err != nil && !os.IsNotExist(err) {
-		log.Fatalf("Failed to read from metadata cache file (%s): %v", cachedPath, err)
+	// Schedules the next fetch, no sooner than MinRefreshInterval allows
+	scheduleRetry := func(d time.Duration) {
+		if wait := untilFetchAllowed(); d < wait {
+			d = wait
+		}
+		retry = time.After(d)
+		mdstore.setSchedule(index, refreshSchedule{cacheTTL: ttl, next: time.Now().Add(d)})
 	}
 
-	if err == nil {
-		metadata, err := verify(content, jwks)
+	verifyContent := func(signed, payload []byte) (*Metadata, error) {
+		if options.DetachedPayload {
+			return verifyDetached(signed, payload, jwks, options)
+		}
+		return verify(signed, jwks, options)
+	}
+
+	cachePaths := []string{cachedPath}
+	for _, path := range src.SecondaryCachePaths {
+		cachePaths = append(cachePaths, resolveCachePath(path, url))
+	}
+
+	// Reads a cache file (and its payload)
+	readCache := func(path string) ([]byte, []byte, error) {
+		content, err := ioutil.ReadFile(path)
+		if err != nil || !options.DetachedPayload {
+			return content, nil, err
+		}
+		payload, err := ioutil.ReadFile(path + ".payload")
+		return content, payload, err
+	}
+
+	// The first cache which verifies
+	var cached *Metadata
+	var cachedAt time.Time
+
+	for i, path := range cachePaths {
+		content, payload, err := readCache(path)
+
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil && i == 0 {
+			log.Fatalf("Failed to read from metadata cache file (%s): %v", path, err)
+		} else if err != nil {
+			log.Printf("Failed to read from secondary metadata cache file (%s): %v", path, err)
+			continue
+		}
+
+		metadata, err := verifyContent(content, payload)
 
 		if err != nil {
-			log.Printf("Failed to verify cached file: %v", err)
+			log.Printf("Failed to verify cached file (%s): %v", path, err)
+			mdstore.setLastError(err)
+			refreshed(SourceCache, nil, "", err)
+			continue
+		}
+
+		if i > 0 {
+			log.Printf("Using metadata from secondary cache file (%s)", path)
+		}
+		cached, cachedAt = metadata, fileModTimeOrNow(path)
+		break
+	}
+
+	// A valid cache which is older than MaxCacheAge, only used if the
+	// first attempt to download fresh metadata fails
+	var oldCache *Metadata
+
+	if cached != nil {
+		if age := time.Since(cachedAt); options.MaxCacheAge > 0 && age > options.MaxCacheAge {
+			log.Printf("Cached metadata is %v old (more than %v), downloading fresh metadata before using it",
+				age.Round(time.Second), options.MaxCacheAge)
+			oldCache = cached
 		} else {
-			workingCache = true
-			mdstore.setNewParsed(metadata)
-			notifyAll()
+			update(cached, SourceCache)
+			ttl = cacheTTL(cached.CacheTTL, options)
+			scheduleRetry(durationToRefresh(cachedAt, ttl))
 		}
 	}
 
-	retry := time.After(0) // When to do the next fetch
-	if workingCache {
-		parsed := mdstore.getParsed()
-		duration := durationToRefresh(fileModTimeOrNow(cachedPath),
-			cacheTTL(time.Duration(parsed.CacheTTL)*time.Second, options.DefaultCacheTTL))
-		retry = time.After(duration)
+	// Uses the old cache if the first download failed, the next attempt
+	// is scheduled by the caller as usual
+	fallBackToOldCache := func() {
+		if oldCache != nil {
+			log.Printf("Failed to download fresh metadata, using old cached metadata")
+			update(oldCache, SourceCache)
+			ttl = cacheTTL(oldCache.CacheTTL, options)
+			oldCache = nil
+		}
+	}
+
+	// The first download may hang (the HTTP client might not have a
+	// timeout), so the old cache is used if it takes too long
+	var oldCacheWait <-chan time.Time
+	if oldCache != nil {
+		oldCacheWait = time.After(options.MaxCacheAgeWait)
 	}
 
 	fetched := make(chan fetchResult)
 
+	// Consecutive failures to verify downloaded metadata
+	badContent := 0
+
+	// Called whenever an attempt to fetch and verify metadata fails
+	failed := func(err error) {
+		mdstore.setLastError(err)
+		refreshed(SourceNetwork, nil, "", err)
+		if options.ColdStartErrors && !mdstore.Status().Loaded {
+			log.Printf("No valid metadata has been loaded yet, all clients will be rejected until it is (%v)", err)
+		}
+	}
+
 	for {
 		select {
-		case <-mdstore.quit:
-			mdstore.quit <- 0
+		case <-quit:
+			quit <- 0
 			return
-		case newListener := <-mdstore.addListener:
-			listeners = append(listeners, newListener)
+		case <-oldCacheWait:
+			oldCacheWait = nil
+			if oldCache != nil {
+				log.Printf("No fresh metadata from %s after %v", url, options.MaxCacheAgeWait)
+				fallBackToOldCache()
+			}
 		case fetchResult := <-fetched:
 			if fetchResult.err != nil {
 				log.Printf("Failed to get metadata from federation operator: %v", fetchResult.err)
-				retry = time.After(options.NetworkRetry)
+				fallBackToOldCache()
+				failed(fetchResult.err)
+				var fetchError *FetchError
+				if options.OnFetchError != nil && errors.As(fetchResult.err, &fetchError) {
+					options.OnFetchError(fetchError)
+				}
+				scheduleRetry(options.NetworkRetry)
 				continue
 			}
-			newParsed, err := verify(fetchResult.body, jwks)
+			newParsed, err := verifyContent(fetchResult.body, fetchResult.payload)
 
 			if err != nil {
 				log.Printf("Failed to verify metadata: %v", err)
-				retry = time.After(options.BadContentRetry)
+				fallBackToOldCache()
+				failed(err)
+
+				badContent++
+				if options.BadContentThreshold > 0 && badContent == options.BadContentThreshold {
+					log.Printf("CRITICAL: Metadata from %s has failed verification %d times in a row: %v",
+						url, badContent, err)
+					if options.OnBadContentThreshold != nil {
+						options.OnBadContentThreshold(url, badContent, err)
+					}
+				}
+				if errors.Is(err, ErrMetadataStale) {
+					// Probably an old copy from a cache, a fresh one
+					// may be available soon
+					scheduleRetry(options.NetworkRetry)
+				} else {
+					scheduleRetry(options.BadContentRetry)
+				}
 			} else {
 				log.Println("Successfully downloaded and verified new metadata")
-				mdstore.setNewParsed(newParsed)
-				notifyAll()
-				retry = time.After(durationToRefresh(time.Now(),
-					cacheTTL(time.Duration(newParsed.CacheTTL)*time.Second, options.DefaultCacheTTL)))
-				err := ioutil.WriteFile(cachedPath, fetchResult.body, 0600)
-				if err != nil {
-					log.Printf("Failed to write to cache file (%s): %v", cachedPath, err)
+				badContent = 0
+				oldCache = nil
+				update(newParsed, SourceNetwork)
+				ttl = cacheTTL(newParsed.CacheTTL, options)
+				scheduleRetry(durationToRefresh(time.Now(), ttl))
+				if !options.ReadOnlyCache {
+					// A failure to write one cache doesn't stop the others
+					for _, path := range cachePaths {
+						err := writeFileAtomic(path, fetchResult.body, 0600)
+						if err != nil {
+							log.Printf("Failed to write to cache file (%s): %v", path, err)
+						}
+						if options.DetachedPayload {
+							err := writeFileAtomic(path+".payload", fetchResult.payload, 0600)
+							if err != nil {
+								log.Printf("Failed to write to cache file (%s): %v", path+".payload", err)
+							}
+						}
+					}
 				}
 			}
 		case <-retry:
-			fetch(url, fetched)
+			if wait := untilFetchAllowed(); wait > 0 {
+				// Whatever scheduled this fetch, the metadata server
+				// shouldn't see us more often than this
+				scheduleRetry(wait)
+				continue
+			}
+			lastFetch = time.Now()
+			fetch(url, payloadURL, options, fetched)
 		}
 	}
 }
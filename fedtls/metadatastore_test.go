@@ -0,0 +1,739 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package fedtls
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/joesiltberg/bowness/util"
+)
+
+func TestFetchAndCache(t *testing.T) {
+	fed := newTestFederation(t)
+	signed := fed.sign(t, testMetadata("https://example.com", "pin"), time.Now().Add(time.Hour))
+	srv := newTestMetadataServer(t, signed)
+	cachePath := filepath.Join(t.TempDir(), "cache.jws")
+
+	mdstore := NewMetadataStore(srv.URL, fed.jwksFile(t), cachePath)
+	defer mdstore.Quit()
+
+	waitFor(t, "metadata to load", func() bool { return mdstore.Status().Loaded })
+
+	if _, ok := mdstore.Entity("https://example.com"); !ok {
+		t.Errorf("Entity missing after metadata was loaded")
+	}
+
+	waitFor(t, "cache to be written", func() bool {
+		cached, err := os.ReadFile(cachePath)
+		return err == nil && string(cached) == string(signed)
+	})
+}
+
+func TestSecondaryCachePaths(t *testing.T) {
+	fed := newTestFederation(t)
+	signed := fed.sign(t, testMetadata("https://example.com", "pin"), time.Now().Add(time.Hour))
+	srv := newTestMetadataServer(t, signed)
+	dir := t.TempDir()
+	primary := filepath.Join(dir, "primary.jws")
+	secondary := filepath.Join(dir, "secondary.jws")
+
+	// Writing to an unwritable secondary doesn't stop the other caches
+	sources := []MetadataSource{{
+		URL:                 srv.URL,
+		JWKSPath:            fed.jwksFile(t),
+		CachePath:           primary,
+		SecondaryCachePaths: []string{filepath.Join(dir, "missing", "cache.jws"), secondary},
+	}}
+
+	mdstore := NewMultiMetadataStore(sources)
+	waitFor(t, "caches to be written", func() bool {
+		p, perr := os.ReadFile(primary)
+		s, serr := os.ReadFile(secondary)
+		return perr == nil && serr == nil && string(p) == string(signed) && string(s) == string(signed)
+	})
+	mdstore.Quit()
+
+	// A replacement instance without a primary cache starts from the
+	// secondary, even if the download fails
+	srv.setContent([]byte("not a JWS"))
+	must(os.Remove(primary), t)
+	must(os.WriteFile(filepath.Join(dir, "invalid.jws"), []byte("garbage"), 0600), t)
+
+	sources[0].SecondaryCachePaths = []string{filepath.Join(dir, "invalid.jws"), secondary}
+	mdstore = NewMultiMetadataStore(sources)
+	defer mdstore.Quit()
+
+	waitFor(t, "metadata to load", func() bool { return mdstore.Status().Loaded })
+	if source := mdstore.Status().InitialSource; source != SourceCache {
+		t.Errorf("Expected metadata from the secondary cache, got %s", source)
+	}
+}
+
+func TestExpiredMetadataNotLoaded(t *testing.T) {
+	fed := newTestFederation(t)
+	signed := fed.sign(t, testMetadata("https://example.com", "pin"), time.Now().Add(-time.Hour))
+	srv := newTestMetadataServer(t, signed)
+
+	mdstore := NewMetadataStore(srv.URL, fed.jwksFile(t), filepath.Join(t.TempDir(), "cache.jws"))
+	defer mdstore.Quit()
+
+	waitFor(t, "failed verification", func() bool { return mdstore.Status().LastError != nil })
+
+	if mdstore.Status().Loaded {
+		t.Errorf("Expired metadata was loaded")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	fed := newTestFederation(t)
+	md := testMetadata("https://example.com", "pin")
+	md.CacheTTL = 1
+	srv := newTestMetadataServer(t, fed.sign(t, md, time.Now().Add(time.Hour)))
+
+	mdstore := NewMetadataStore(srv.URL, fed.jwksFile(t), filepath.Join(t.TempDir(), "cache.jws"))
+	defer mdstore.Quit()
+
+	waitFor(t, "metadata to load", func() bool { return mdstore.Status().Loaded })
+
+	srv.setContent(fed.sign(t, testMetadata("https://other.example.com", "pin"), time.Now().Add(time.Hour)))
+
+	waitFor(t, "refreshed metadata", func() bool {
+		_, ok := mdstore.Entity("https://other.example.com")
+		return ok
+	})
+
+	if srv.fetchCount() < 2 {
+		t.Errorf("Expected at least 2 fetches, got %d", srv.fetchCount())
+	}
+}
+
+func TestLookupClientWithoutCertificate(t *testing.T) {
+	mdstore := newTestStore(testMetadata("https://example.com", "pin"))
+
+	for _, chains := range [][][]*x509.Certificate{nil, {{}}} {
+		_, _, _, err := mdstore.LookupClient(chains)
+
+		if !errors.Is(err, ErrNoClientCertificate) {
+			t.Errorf("Expected ErrNoClientCertificate for %v, got %v", chains, err)
+		}
+	}
+}
+
+func TestRemovedEntities(t *testing.T) {
+	oldMetadata := testMetadata("https://a.example.com", "pin")
+	oldMetadata.Entities = append(oldMetadata.Entities, testMetadata("https://b.example.com", "pin").Entities...)
+	newMetadata := testMetadata("https://b.example.com", "pin")
+
+	removed := removedEntities(oldMetadata, newMetadata)
+
+	if len(removed) != 1 || removed[0] != "https://a.example.com" {
+		t.Errorf("Unexpected removed entities: %v", removed)
+	}
+
+	if removed := removedEntities(newMetadata, oldMetadata); len(removed) != 0 {
+		t.Errorf("Unexpected removed entities: %v", removed)
+	}
+}
+
+func TestLookupClient(t *testing.T) {
+	chain := newTestChain(t)
+	md := testMetadata("https://example.com", chain.pin())
+	md.Entities[0].Issuers = []Issuer{{X509certificate: chain.issuerPEM()}}
+	mdstore := newTestStore(md)
+
+	entityID, _, _, err := mdstore.LookupClient(chain.verifiedChains())
+	must(err, t)
+	shouldEqualString(entityID, "https://example.com", "entity_id", t)
+}
+
+func TestLookupClientWithMetadata(t *testing.T) {
+	chain := newTestChain(t)
+	mdstore := NewStaticMetadataStore()
+	mdstore.SetMetadata(testMetadata("https://example.com", chain.pin()))
+
+	lookup, err := mdstore.LookupClientWithMetadata(chain.verifiedChains())
+	must(err, t)
+	shouldEqualString(lookup.EntityID, "https://example.com", "entity_id", t)
+	shouldEqualString(lookup.MetadataHash, mdstore.MetadataHash(), "metadata hash", t)
+	if lookup.Version != mdstore.Version() {
+		t.Errorf("Expected version %d, got %d", mdstore.Version(), lookup.Version)
+	}
+
+	// A failed lookup is also based on a specific version
+	mdstore.SetMetadata(testMetadata("https://example.com", "newpin"))
+
+	lookup, err = mdstore.LookupClientWithMetadata(chain.verifiedChains())
+	var unknown *UnknownClientError
+	if !errors.As(err, &unknown) {
+		t.Fatalf("Expected UnknownClientError, got %v", err)
+	}
+	shouldEqualString(lookup.MetadataHash, mdstore.MetadataHash(), "metadata hash", t)
+	if lookup.Version != mdstore.Version() {
+		t.Errorf("Expected version %d, got %d", mdstore.Version(), lookup.Version)
+	}
+}
+
+func TestLookupClientNotAClient(t *testing.T) {
+	chain := newTestChain(t)
+	md := testMetadata("https://example.com", "some other pin")
+	md.Entities[0].Issuers = []Issuer{{X509certificate: chain.issuerPEM()}}
+	mdstore := newTestStore(md)
+
+	_, _, _, err := mdstore.LookupClient(chain.verifiedChains())
+
+	var notAClient *NotAClientError
+	if !errors.As(err, &notAClient) {
+		t.Fatalf("Expected NotAClientError, got %v", err)
+	}
+	shouldEqualString(notAClient.EntityIDs[0], "https://example.com", "entity_id", t)
+}
+
+func TestLookupClientUnknown(t *testing.T) {
+	chain := newTestChain(t)
+	mdstore := newTestStore(testMetadata("https://example.com", "some other pin"))
+
+	_, _, _, err := mdstore.LookupClient(chain.verifiedChains())
+
+	var unknown *UnknownClientError
+	if !errors.As(err, &unknown) {
+		t.Fatalf("Expected UnknownClientError, got %v", err)
+	}
+}
+
+func TestDisallowedContentType(t *testing.T) {
+	fed := newTestFederation(t)
+	signed := fed.sign(t, testMetadata("https://example.com", "pin"), time.Now().Add(time.Hour))
+	srv := newTestMetadataServer(t, signed)
+
+	mdstore := NewMetadataStore(srv.URL, fed.jwksFile(t), filepath.Join(t.TempDir(), "cache.jws"),
+		AllowedContentTypes("text/html"))
+	defer mdstore.Quit()
+
+	waitFor(t, "failed fetch", func() bool { return mdstore.Status().LastError != nil })
+
+	if mdstore.Status().Loaded {
+		t.Errorf("Metadata with disallowed content type was loaded")
+	}
+}
+
+func TestMultipleSources(t *testing.T) {
+	fedA := newTestFederation(t)
+	fedB := newTestFederation(t)
+	srvA := newTestMetadataServer(t, fedA.sign(t, testMetadata("https://a.example.com", "pin"), time.Now().Add(time.Hour)))
+	srvB := newTestMetadataServer(t, fedB.sign(t, testMetadata("https://b.example.com", "pin"), time.Now().Add(time.Hour)))
+	dir := t.TempDir()
+
+	mdstore := NewMultiMetadataStore([]MetadataSource{
+		{URL: srvA.URL, JWKSPath: fedA.jwksFile(t), CachePath: filepath.Join(dir, "a.jws")},
+		{URL: srvB.URL, JWKSPath: fedB.jwksFile(t), CachePath: filepath.Join(dir, "b.jws")},
+	})
+	defer mdstore.Quit()
+
+	waitFor(t, "metadata from both sources", func() bool { return len(mdstore.EntityIDs()) == 2 })
+
+	for _, entityID := range []string{"https://a.example.com", "https://b.example.com"} {
+		if _, ok := mdstore.Entity(entityID); !ok {
+			t.Errorf("Missing entity %s", entityID)
+		}
+	}
+}
+
+// The store isn't loaded until every source has loaded, but the sources
+// which have loaded are trusted meanwhile
+func TestMultipleSourcesLoaded(t *testing.T) {
+	fedA := newTestFederation(t)
+	fedB := newTestFederation(t)
+	srvA := newTestMetadataServer(t, fedA.sign(t, testMetadata("https://a.example.com", "pin"), time.Now().Add(time.Hour)))
+	srvB := newTestMetadataServer(t, []byte("not a JWS"))
+	dir := t.TempDir()
+
+	mdstore := NewMultiMetadataStore([]MetadataSource{
+		{URL: srvA.URL, JWKSPath: fedA.jwksFile(t), CachePath: filepath.Join(dir, "a.jws")},
+		{URL: srvB.URL, JWKSPath: fedB.jwksFile(t), CachePath: filepath.Join(dir, "b.jws")},
+	}, BadContentRetry(10*time.Millisecond), NetworkRetry(10*time.Millisecond))
+	defer mdstore.Quit()
+
+	waitFor(t, "metadata from the first source", func() bool { return len(mdstore.EntityIDs()) == 1 })
+
+	if mdstore.Status().Loaded {
+		t.Errorf("Loaded before every source had loaded")
+	}
+
+	srvB.setContent(fedB.sign(t, testMetadata("https://b.example.com", "pin"), time.Now().Add(time.Hour)))
+	waitFor(t, "metadata to load", func() bool { return mdstore.Status().Loaded })
+}
+
+func TestMergeMetadata(t *testing.T) {
+	a := testMetadata("https://a.example.com", "pin")
+	b := testMetadata("https://b.example.com", "pin")
+	b.CacheTTL = 600
+
+	merged := mergeMetadata([]*Metadata{a, b})
+	shouldEqualString(merged.Version, "1.0.0", "version", t)
+	if merged.CacheTTL != 600 {
+		t.Errorf("Expected the shortest cache TTL, got %d", merged.CacheTTL)
+	}
+
+	b.Version = "2.0.0"
+	merged = mergeMetadata([]*Metadata{a, b, {}})
+	shouldEqualString(merged.Version, "1.0.0,2.0.0", "version", t)
+	if len(merged.Entities) != 2 {
+		t.Errorf("Expected 2 entities, got %d", len(merged.Entities))
+	}
+}
+
+func TestCheckMetadataSources(t *testing.T) {
+	dir := t.TempDir()
+	a := MetadataSource{URL: "https://a.example.com", CachePath: filepath.Join(dir, "a.jws")}
+	b := MetadataSource{URL: "https://b.example.com", CachePath: filepath.Join(dir, "b.jws")}
+
+	must(CheckMetadataSources([]MetadataSource{a, b}), t)
+
+	// A shared directory gives each source its own file
+	must(CheckMetadataSources([]MetadataSource{
+		{URL: a.URL, CachePath: dir},
+		{URL: b.URL, CachePath: dir},
+	}), t)
+
+	b.CachePath = a.CachePath
+	if CheckMetadataSources([]MetadataSource{a, b}) == nil {
+		t.Errorf("Shared cache file was accepted")
+	}
+
+	b.CachePath = filepath.Join(dir, "b.jws")
+	b.SecondaryCachePaths = []string{filepath.Join(dir, ".", "a.jws")}
+	if CheckMetadataSources([]MetadataSource{a, b}) == nil {
+		t.Errorf("Shared secondary cache file was accepted")
+	}
+}
+
+func TestLookupClientChainPins(t *testing.T) {
+	chain := newTestChain(t)
+	md := testMetadata("https://example.com", util.Fingerprint(chain.issuer))
+
+	_, _, _, err := newTestStore(md).LookupClient(chain.verifiedChains())
+	if err == nil {
+		t.Errorf("CA pin matched without MatchChainPins")
+	}
+
+	entityID, _, _, err := newTestStore(md, MatchChainPins(true)).LookupClient(chain.verifiedChains())
+	must(err, t)
+	shouldEqualString(entityID, "https://example.com", "entity_id", t)
+}
+
+func TestResolveCachePath(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "cache.jws")
+
+	shouldEqualString(resolveCachePath(file, "https://a.example.com"), file, "file path", t)
+
+	a := resolveCachePath(dir, "https://a.example.com")
+	b := resolveCachePath(dir, "https://b.example.com")
+
+	if filepath.Dir(a) != dir || a == b {
+		t.Errorf("Unexpected cache paths %s and %s", a, b)
+	}
+	shouldEqualString(resolveCachePath(dir, "https://a.example.com"), a, "deterministic", t)
+}
+
+func TestDetachedPayload(t *testing.T) {
+	fed := newTestFederation(t)
+	signed, payload := fed.signDetached(t, testMetadata("https://example.com", "pin"), time.Now().Add(time.Hour))
+	srv := newTestMetadataServer(t, signed)
+	payloadSrv := newTestMetadataServer(t, payload)
+	cachePath := filepath.Join(t.TempDir(), "cache.jws")
+
+	mdstore := NewMultiMetadataStore([]MetadataSource{
+		{URL: srv.URL, JWKSPath: fed.jwksFile(t), CachePath: cachePath, PayloadURL: payloadSrv.URL},
+	}, DetachedPayload(true))
+	defer mdstore.Quit()
+
+	waitFor(t, "metadata to load", func() bool { return mdstore.Status().Loaded })
+
+	if _, ok := mdstore.Entity("https://example.com"); !ok {
+		t.Errorf("Entity missing after metadata was loaded")
+	}
+
+	waitFor(t, "payload to be cached", func() bool {
+		cached, err := os.ReadFile(cachePath + ".payload")
+		return err == nil && string(cached) == string(payload)
+	})
+}
+
+func TestOnRefresh(t *testing.T) {
+	fed := newTestFederation(t)
+	signed := fed.sign(t, testMetadata("https://example.com", "pin"), time.Now().Add(time.Hour))
+	srv := newTestMetadataServer(t, signed)
+
+	events := make(chan *RefreshEvent, 10)
+	mdstore := NewMetadataStore(srv.URL, fed.jwksFile(t), filepath.Join(t.TempDir(), "cache.jws"),
+		OnRefresh(func(event *RefreshEvent) { events <- event }))
+	defer mdstore.Quit()
+
+	select {
+	case event := <-events:
+		if event.Err != nil || event.Source != SourceNetwork || event.Entities != 1 || event.URL != srv.URL {
+			t.Errorf("Unexpected refresh event: %+v", event)
+		}
+		if event.MetadataHash == "" || event.MetadataHash != mdstore.MetadataHash() {
+			t.Errorf("Expected the current metadata hash in refresh event, got %q", event.MetadataHash)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for refresh event")
+	}
+}
+
+func TestHashMetadata(t *testing.T) {
+	hash := hashMetadata(testMetadata("https://example.com", "pin"))
+
+	if again := hashMetadata(testMetadata("https://example.com", "pin")); again != hash {
+		t.Errorf("Hash of the same metadata differs: %s != %s", again, hash)
+	}
+	if other := hashMetadata(testMetadata("https://example.com", "other pin")); other == hash {
+		t.Errorf("Different metadata got the same hash")
+	}
+	if len(hash) != 64 {
+		t.Errorf("Expected a hex encoded SHA-256 hash, got %s", hash)
+	}
+}
+
+func TestStatusSchedule(t *testing.T) {
+	fed := newTestFederation(t)
+	signed := fed.sign(t, testMetadata("https://example.com", "pin"), time.Now().Add(time.Hour))
+	srv := newTestMetadataServer(t, signed)
+
+	mdstore := NewMetadataStore(srv.URL, fed.jwksFile(t), filepath.Join(t.TempDir(), "cache.jws"))
+	defer mdstore.Quit()
+
+	waitFor(t, "refresh to be scheduled", func() bool { return !mdstore.Status().NextRefresh.IsZero() })
+
+	status := mdstore.Status()
+	if mdstore.Version() == 0 {
+		t.Errorf("Version didn't change when metadata was loaded")
+	}
+
+	if status.CacheTTL != 3600*time.Second {
+		t.Errorf("Expected cache TTL of 1 hour, got %v", status.CacheTTL)
+	}
+
+	if until := time.Until(status.NextRefresh); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("Expected next refresh in about an hour, got %v", until)
+	}
+}
+
+func TestIssuersPerEntityKeepsAllIssuers(t *testing.T) {
+	md := &Metadata{
+		Entities: []Entity{
+			{EntityID: "https://example.com", Issuers: []Issuer{{X509certificate: "old"}, {X509certificate: "new"}}},
+			{EntityID: "https://example.com", Issuers: []Issuer{{X509certificate: "other federation"}}},
+		},
+	}
+
+	issuers := issuersPerEntity(md)["https://example.com"]
+	if len(issuers) != 3 {
+		t.Fatalf("Expected 3 issuers, got %d", len(issuers))
+	}
+	shouldEqualString(issuers[0].X509certificate, "old", "first issuer", t)
+	shouldEqualString(issuers[2].X509certificate, "other federation", "last issuer", t)
+}
+
+func TestBadContentThreshold(t *testing.T) {
+	fed := newTestFederation(t)
+	srv := newTestMetadataServer(t, []byte("not a JWS"))
+
+	alerts := make(chan int, 10)
+	mdstore := NewMetadataStore(srv.URL, fed.jwksFile(t), filepath.Join(t.TempDir(), "cache.jws"),
+		BadContentRetry(10*time.Millisecond),
+		BadContentThreshold(3, func(url string, failures int, err error) { alerts <- failures }))
+	defer mdstore.Quit()
+
+	select {
+	case failures := <-alerts:
+		if failures != 3 || srv.fetchCount() < 3 {
+			t.Errorf("Alert after %d failures (%d fetches), expected 3", failures, srv.fetchCount())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for bad content alert")
+	}
+
+	waitFor(t, "more retries", func() bool { return srv.fetchCount() >= 6 })
+
+	if len(alerts) != 0 {
+		t.Errorf("Alert repeated while failures continued")
+	}
+}
+
+func TestMinRefreshInterval(t *testing.T) {
+	fed := newTestFederation(t)
+	srv := newTestMetadataServer(t, []byte("not a JWS"))
+
+	start := time.Now()
+	mdstore := NewMetadataStore(srv.URL, fed.jwksFile(t), filepath.Join(t.TempDir(), "cache.jws"),
+		BadContentRetry(time.Millisecond),
+		MinRefreshInterval(200*time.Millisecond))
+	defer mdstore.Quit()
+
+	waitFor(t, "3 fetches", func() bool { return srv.fetchCount() >= 3 })
+
+	// Without MinRefreshInterval the retries would be almost immediate
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("3 fetches in %v, expected at least 400ms", elapsed)
+	}
+}
+
+func TestResolver(t *testing.T) {
+	fed := newTestFederation(t)
+
+	var queries atomic.Int32
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			queries.Add(1)
+			return nil, errors.New("no DNS server in test")
+		},
+	}
+
+	events := make(chan *RefreshEvent, 10)
+	mdstore := NewMetadataStore("http://metadata.example.com/md.jws", fed.jwksFile(t),
+		filepath.Join(t.TempDir(), "cache.jws"),
+		Resolver(resolver),
+		OnRefresh(func(event *RefreshEvent) { events <- event }))
+	defer mdstore.Quit()
+
+	select {
+	case event := <-events:
+		if event.Err == nil {
+			t.Errorf("Expected the fetch to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for refresh event")
+	}
+
+	if queries.Load() == 0 {
+		t.Errorf("Expected the metadata host to be resolved with the configured resolver")
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	options := defaultOptions()
+	options.DefaultCacheTTL = time.Hour
+	options.MinCacheTTL = time.Minute
+
+	tests := []struct {
+		name        string
+		metadataTTL int
+		expected    time.Duration
+	}{
+		{"zero", 0, time.Hour},
+		{"negative", -100, time.Hour},
+		{"too small", 5, time.Minute},
+		{"normal", 7200, 2 * time.Hour},
+		{"huge", math.MaxInt, maxCacheTTL},
+	}
+
+	for _, test := range tests {
+		if got := cacheTTL(test.metadataTTL, options); got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+
+	// Without a minimum, small values are used as they are
+	options.MinCacheTTL = 0
+	if got := cacheTTL(5, options); got != 5*time.Second {
+		t.Errorf("Expected 5s without a minimum, got %v", got)
+	}
+}
+
+func TestMaxCacheAge(t *testing.T) {
+	fed := newTestFederation(t)
+	cached := fed.sign(t, testMetadata("https://cached.example.com", "pin"), time.Now().Add(time.Hour))
+
+	writeOldCache := func() string {
+		cachePath := filepath.Join(t.TempDir(), "cache.jws")
+		must(os.WriteFile(cachePath, cached, 0600), t)
+		old := time.Now().Add(-48 * time.Hour)
+		must(os.Chtimes(cachePath, old, old), t)
+		return cachePath
+	}
+
+	// Fresh metadata is downloaded before the old cache is used
+	fresh := fed.sign(t, testMetadata("https://fresh.example.com", "pin"), time.Now().Add(time.Hour))
+	srv := newTestMetadataServer(t, fresh)
+
+	mdstore := NewMetadataStore(srv.URL, fed.jwksFile(t), writeOldCache(), MaxCacheAge(24*time.Hour))
+	waitFor(t, "metadata to load", func() bool { return mdstore.Status().Loaded })
+	mdstore.Quit()
+
+	if source := mdstore.Status().InitialSource; source != SourceNetwork {
+		t.Errorf("Expected metadata to be loaded from the network first, got %s", source)
+	}
+
+	// The old cache is used if the download fails
+	srv.setContent([]byte("not a JWS"))
+
+	mdstore = NewMetadataStore(srv.URL, fed.jwksFile(t), writeOldCache(), MaxCacheAge(24*time.Hour))
+	defer mdstore.Quit()
+	waitFor(t, "metadata to load", func() bool { return mdstore.Status().Loaded })
+
+	if source := mdstore.Status().InitialSource; source != SourceCache {
+		t.Errorf("Expected fallback to the cache, got %s", source)
+	}
+	if _, ok := mdstore.Entity("https://cached.example.com"); !ok {
+		t.Errorf("Entity from cache missing")
+	}
+}
+
+// Until the first download finishes, the status shows why the cache
+// couldn't be used
+func TestStatusInvalidCache(t *testing.T) {
+	fed := newTestFederation(t)
+	cachePath := filepath.Join(t.TempDir(), "cache.jws")
+	must(os.WriteFile(cachePath, []byte("not a JWS"), 0600), t)
+
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(hang) })
+
+	mdstore := NewMetadataStore(srv.URL, fed.jwksFile(t), cachePath)
+	defer mdstore.Quit()
+
+	waitFor(t, "failed verification", func() bool { return mdstore.Status().LastError != nil })
+
+	if mdstore.Status().Loaded {
+		t.Errorf("Invalid cache was loaded")
+	}
+}
+
+func TestMaxCacheAgeHangingServer(t *testing.T) {
+	fed := newTestFederation(t)
+	cachePath := filepath.Join(t.TempDir(), "cache.jws")
+	must(os.WriteFile(cachePath, fed.sign(t, testMetadata("https://cached.example.com", "pin"), time.Now().Add(time.Hour)), 0600), t)
+	old := time.Now().Add(-48 * time.Hour)
+	must(os.Chtimes(cachePath, old, old), t)
+
+	// A server which never answers
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(hang) })
+
+	mdstore := NewMetadataStore(srv.URL, fed.jwksFile(t), cachePath,
+		MaxCacheAge(24*time.Hour), MaxCacheAgeWait(100*time.Millisecond))
+	defer mdstore.Quit()
+
+	waitFor(t, "metadata to load", func() bool { return mdstore.Status().Loaded })
+
+	if source := mdstore.Status().InitialSource; source != SourceCache {
+		t.Errorf("Expected fallback to the cache, got %s", source)
+	}
+}
+
+func TestRemovedPinGrace(t *testing.T) {
+	chain := newTestChain(t)
+	accepted := 0
+	mdstore := newTestStore(testMetadata("https://example.com", chain.pin()),
+		RemovedPinGrace(time.Hour, func(entityID, fingerprint string) { accepted++ }))
+
+	// The client gets a new pin
+	mdstore.setNewParsed(0, testMetadata("https://example.com", "newpin"), SourceNetwork)
+
+	entityID, _, _, err := mdstore.LookupClient(chain.verifiedChains())
+	must(err, t)
+	shouldEqualString(entityID, "https://example.com", "entity_id", t)
+	if accepted != 1 {
+		t.Errorf("Expected callback for accepted client, got %d calls", accepted)
+	}
+
+	// After the grace period
+	pin := mdstore.removedPins[chain.pin()]
+	pin.removed = pin.removed.Add(-2 * time.Hour)
+	mdstore.removedPins[chain.pin()] = pin
+
+	var unknown *UnknownClientError
+	if _, _, _, err := mdstore.LookupClient(chain.verifiedChains()); !errors.As(err, &unknown) {
+		t.Errorf("Expected UnknownClientError after the grace period, got %v", err)
+	}
+
+	// Expired pins are forgotten on the next update
+	mdstore.setNewParsed(0, testMetadata("https://example.com", "newpin"), SourceNetwork)
+	if len(mdstore.removedPins) != 0 {
+		t.Errorf("Expired pin wasn't forgotten")
+	}
+}
+
+func TestExportPath(t *testing.T) {
+	fed := newTestFederation(t)
+	md := testMetadata("https://b.example.com", "pin-b2")
+	md.Entities[0].Clients[0].Pins = append(md.Entities[0].Clients[0].Pins, Pin{Alg: "sha256", Digest: "pin-b1"})
+	md.Entities = append(md.Entities, testMetadata("https://a.example.com", "pin-a").Entities...)
+	srv := newTestMetadataServer(t, fed.sign(t, md, time.Now().Add(time.Hour)))
+
+	exportPath := filepath.Join(t.TempDir(), "export.json")
+	mdstore := NewMetadataStore(srv.URL, fed.jwksFile(t), filepath.Join(t.TempDir(), "cache.jws"),
+		ExportPath(exportPath))
+	defer mdstore.Quit()
+
+	var exported Metadata
+	waitFor(t, "metadata to be exported", func() bool {
+		content, err := os.ReadFile(exportPath)
+		return err == nil && json.Unmarshal(content, &exported) == nil
+	})
+
+	if len(exported.Entities) != 2 {
+		t.Fatalf("Expected 2 exported entities, got %d", len(exported.Entities))
+	}
+	shouldEqualString(exported.Entities[0].EntityID, "https://a.example.com", "first entity", t)
+	shouldEqualString(exported.Entities[1].Clients[0].Pins[0].Digest, "pin-b1", "first pin", t)
+
+	// The store's own metadata isn't reordered
+	if entity, _ := mdstore.Entity("https://b.example.com"); entity.Clients[0].Pins[0].Digest != "pin-b2" {
+		t.Errorf("Export modified the loaded metadata")
+	}
+}
+
+// Modifying the entity returned by Entity mustn't affect the store
+func TestEntityIsCopy(t *testing.T) {
+	org := "Example"
+	md := testMetadata("https://example.com", "pin")
+	md.Entities[0].Organization = &org
+	md.Entities[0].Issuers = []Issuer{{X509certificate: "issuer"}}
+	md.Entities[0].Servers = []Server{{BaseURI: "https://example.com/", Tags: []string{"tag"}}}
+	mdstore := newTestStore(md)
+
+	entity, ok := mdstore.Entity("https://example.com")
+	if !ok {
+		t.Fatalf("Missing entity")
+	}
+	*entity.Organization = "Changed"
+	entity.Issuers[0].X509certificate = "changed"
+	entity.Clients[0].Pins[0].Digest = "changed"
+	entity.Servers[0].Tags[0] = "changed"
+
+	original, _ := mdstore.Entity("https://example.com")
+	shouldEqualString(*original.Organization, "Example", "organization", t)
+	shouldEqualString(original.Issuers[0].X509certificate, "issuer", "issuer", t)
+	shouldEqualString(original.Clients[0].Pins[0].Digest, "pin", "pin", t)
+	shouldEqualString(original.Servers[0].Tags[0], "tag", "tag", t)
+}
@@ -10,14 +10,310 @@ package fedtls
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/lestrrat-go/jwx/v2/jwk"
 	"github.com/lestrrat-go/jwx/v2/jws"
 )
 
-func verify(signed, jwks []byte) (*Metadata, error) {
+// A MetadataParser turns the verified payload of the signed metadata into
+// Metadata. This makes it possible to support federations which publish
+// metadata in a schema which differs from the standard one.
+type MetadataParser interface {
+	Parse(payload []byte) (*Metadata, error)
+}
+
+// MetadataParserFunc lets an ordinary function be used as a MetadataParser
+type MetadataParserFunc func(payload []byte) (*Metadata, error)
+
+// Parse calls f(payload)
+func (f MetadataParserFunc) Parse(payload []byte) (*Metadata, error) {
+	return f(payload)
+}
+
+// DefaultMetadataParser parses metadata in the schema defined by the
+// Federated TLS Authentication specification
+var DefaultMetadataParser MetadataParser = MetadataParserFunc(parseMetadata)
+
+func parseMetadata(payload []byte) (*Metadata, error) {
+	return decodeMetadata(payload, func(dec *json.Decoder, i int) (*Entity, error) {
+		var entity Entity
+
+		if err := dec.Decode(&entity); err != nil {
+			return nil, err
+		}
+		return &entity, nil
+	})
+}
+
+// LenientMetadataParser parses metadata like DefaultMetadataParser, except
+// that malformed entities are logged and skipped instead of rejecting the
+// whole metadata. The metadata is still rejected if its top level structure
+// is malformed, or if every entity is.
+var LenientMetadataParser MetadataParser = MetadataParserFunc(parseMetadataLeniently)
+
+func parseMetadataLeniently(payload []byte) (*Metadata, error) {
+	total := 0
+
+	result, err := decodeMetadata(payload, func(dec *json.Decoder, i int) (*Entity, error) {
+		var data json.RawMessage
+
+		if err := dec.Decode(&data); err != nil {
+			return nil, err
+		}
+		total++
+
+		var entity Entity
+		if err := json.Unmarshal(data, &entity); err != nil {
+			// The entity ID may still be readable
+			var id struct {
+				EntityID string `json:"entity_id"`
+			}
+			json.Unmarshal(data, &id)
+
+			log.Printf("Skipping malformed entity %d (%s) in metadata: %v", i, id.EntityID, err)
+			return nil, nil
+		}
+		return &entity, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if total > 0 && len(result.Entities) == 0 {
+		return nil, errors.New("All entities in metadata are malformed")
+	}
+
+	return result, nil
+}
+
+// Decodes metadata with the same result as json.Unmarshal, but the entities
+// are decoded one at a time with decodeEntity, which should consume one
+// value from dec and return the entity (nil to skip it). This keeps the
+// memory needed while parsing large metadata down, since only one entity
+// at a time is held in any intermediate form.
+func decodeMetadata(payload []byte, decodeEntity func(dec *json.Decoder, i int) (*Entity, error)) (*Metadata, error) {
+	var result Metadata
+
+	dec := json.NewDecoder(bytes.NewReader(payload))
+
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	if token == nil {
+		// Like json.Unmarshal, null leaves the metadata empty
+		if err := checkEOF(dec); err != nil {
+			return nil, err
+		}
+		return &result, nil
+	} else if token != json.Delim('{') {
+		return nil, fmt.Errorf("Metadata must be a JSON object, got %v", token)
+	}
+
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := token.(string)
+
+		if !strings.EqualFold(key, "entities") {
+			// Other members are few and small, decoding them as a
+			// single member object keeps json.Unmarshal's semantics
+			var value json.RawMessage
+			if err := dec.Decode(&value); err != nil {
+				return nil, err
+			}
+			member, err := json.Marshal(map[string]json.RawMessage{key: value})
+			if err != nil {
+				return nil, err
+			}
+			if err := json.Unmarshal(member, &result); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		token, err = dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		// A repeated entities member replaces the previous one
+		result.Entities = nil
+		if token == nil {
+			continue
+		} else if token != json.Delim('[') {
+			return nil, fmt.Errorf("Metadata entities must be a JSON array, got %v", token)
+		}
+
+		result.Entities = []Entity{}
+		for i := 0; dec.More(); i++ {
+			entity, err := decodeEntity(dec, i)
+			if err != nil {
+				return nil, err
+			}
+			if entity != nil {
+				result.Entities = append(result.Entities, *entity)
+			}
+		}
+
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+
+	if err := checkEOF(dec); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Fails if there's anything but whitespace left after the metadata
+func checkEOF(dec *json.Decoder) error {
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("Unexpected data after metadata")
+	}
+	return nil
+}
+
+// ErrIssuerMismatch is returned when verifying metadata whose iss header
+// doesn't match the expected issuer (or is missing)
+var ErrIssuerMismatch = errors.New("Metadata issuer mismatch")
+
+// Checks the iss protected header against the expected issuer
+func checkIssuer(headers jws.Headers, expected string) error {
+	iss, ok := headers.Get("iss")
+
+	if !ok {
+		return fmt.Errorf("%w: missing iss, expected %s", ErrIssuerMismatch, expected)
+	}
+
+	if issStr, ok := iss.(string); !ok || issStr != expected {
+		return fmt.Errorf("%w: got %v, expected %s", ErrIssuerMismatch, iss, expected)
+	}
+	return nil
+}
+
+// ErrMetadataStale is returned when verifying metadata whose iat header is
+// older than MaxMetadataAge (or missing, or too far in the future). It could
+// be an old copy served by a cache, so it's worth retrying soon.
+var ErrMetadataStale = errors.New("Metadata is not fresh")
+
+// How far in the future iat may be, to allow for clocks being out of sync
+const iatClockSkew = 5 * time.Minute
+
+// Checks the iat protected header against the maximum age
+func checkIssuedAt(headers jws.Headers, maxAge time.Duration, now time.Time) error {
+	iatValue, ok := headers.Get("iat")
+
+	if !ok {
+		return fmt.Errorf("%w: missing iat", ErrMetadataStale)
+	}
+
+	iatNumber, ok := iatValue.(float64)
+	if !ok {
+		return fmt.Errorf("%w: invalid iat (%v)", ErrMetadataStale, iatValue)
+	}
+	iat := time.Unix(int64(iatNumber), 0)
+
+	if iat.After(now.Add(iatClockSkew)) {
+		return fmt.Errorf("%w: issued in the future (%v), current time: %v", ErrMetadataStale, iat, now)
+	}
+
+	if now.Sub(iat) > maxAge {
+		return fmt.Errorf("%w: issued at %v, which is more than %v ago", ErrMetadataStale, iat, maxAge)
+	}
+	return nil
+}
+
+// VerifyMetadata verifies and parses signed metadata the same way a
+// MetadataStore does, which is useful for tools inspecting metadata.
+// Only the options affecting verification and parsing are used.
+func VerifyMetadata(signed, jwks []byte, setters ...OptionSetter) (*Metadata, error) {
+	options := defaultOptions()
+
+	for _, setter := range setters {
+		setter(options)
+	}
+	return verify(signed, jwks, options)
+}
+
+// A MetadataFile is signed metadata which has been read and verified by
+// ReadMetadataFile
+type MetadataFile struct {
+	// The verified metadata
+	Metadata *Metadata
+
+	// The JWS as it was read
+	Signed []byte
+
+	// The JWKS the metadata was verified with
+	JWKS []byte
+}
+
+// ReadMetadataFile reads a JWKS (see ReadJWKS) and signed metadata from a
+// file, or from stdin if path is -, and verifies it like VerifyMetadata.
+// It's meant for tools which inspect metadata, the returned error tells
+// which of the steps failed.
+func ReadMetadataFile(jwksPath, path string, setters ...OptionSetter) (*MetadataFile, error) {
+	jwks, err := ReadJWKS(jwksPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read JWKS: %w", err)
+	}
+
+	var signed []byte
+	if path == "-" {
+		signed, err = io.ReadAll(os.Stdin)
+	} else {
+		signed, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read metadata: %w", err)
+	}
+
+	md, err := VerifyMetadata(signed, jwks, setters...)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to verify metadata: %w", err)
+	}
+
+	return &MetadataFile{Metadata: md, Signed: signed, JWKS: jwks}, nil
+}
+
+// ProtectedHeaders returns the verified JWS' protected headers
+func (f *MetadataFile) ProtectedHeaders() (jws.Headers, error) {
+	message, err := jws.Parse(f.Signed)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse JWS: %w", err)
+	}
+	return message.Signatures()[0].ProtectedHeaders(), nil
+}
+
+func verify(signed, jwks []byte, options *MetadataStoreOptions) (*Metadata, error) {
+	return verifyJWS(signed, jwks, options)
+}
+
+// Verifies a JWS with a detached payload (RFC 7515 appendix F), the signing
+// input is reconstructed from the protected header and the separately
+// published payload.
+func verifyDetached(signed, payload, jwks []byte, options *MetadataStoreOptions) (*Metadata, error) {
+	return verifyJWS(signed, jwks, options, jws.WithDetachedPayload(payload))
+}
+
+func verifyJWS(signed, jwks []byte, options *MetadataStoreOptions, extra ...jws.VerifyOption) (*Metadata, error) {
 	keyset, err := jwk.Parse(jwks)
 
 	if err != nil {
@@ -30,7 +326,8 @@ func verify(signed, jwks []byte) (*Metadata, error) {
 		return nil, fmt.Errorf("Failed to parse JWS: %v", err)
 	}
 
-	payload, err := jws.Verify(signed, jws.WithKeySet(keyset))
+	verifyOptions := append([]jws.VerifyOption{jws.WithKeySet(keyset)}, extra...)
+	payload, err := jws.Verify(signed, verifyOptions...)
 
 	if err != nil {
 		return nil, fmt.Errorf("Failed to verify JWS: %v", err)
@@ -44,13 +341,17 @@ func verify(signed, jwks []byte) (*Metadata, error) {
 		}
 	}
 
-	var result Metadata
-
-	err = json.Unmarshal(payload, &result)
+	if options.MaxMetadataAge > 0 {
+		if err := checkIssuedAt(message.Signatures()[0].ProtectedHeaders(), options.MaxMetadataAge, time.Now()); err != nil {
+			return nil, err
+		}
+	}
 
-	if err != nil {
-		return nil, err
+	if options.ExpectedIssuer != "" {
+		if err := checkIssuer(message.Signatures()[0].ProtectedHeaders(), options.ExpectedIssuer); err != nil {
+			return nil, err
+		}
 	}
 
-	return &result, nil
+	return options.Parser.Parse(payload)
 }
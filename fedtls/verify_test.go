@@ -0,0 +1,264 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package fedtls
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	fed := newTestFederation(t)
+	signed := fed.sign(t, testMetadata("https://example.com", "pin"), time.Now().Add(time.Hour))
+
+	md, err := verify(signed, fed.jwks, defaultOptions())
+	must(err, t)
+
+	if len(md.Entities) != 1 {
+		t.Fatalf("Expected 1 entity, got %d", len(md.Entities))
+	}
+	shouldEqualString(md.Entities[0].EntityID, "https://example.com", "entity_id", t)
+}
+
+func TestVerifyExpired(t *testing.T) {
+	fed := newTestFederation(t)
+	signed := fed.sign(t, testMetadata("https://example.com", "pin"), time.Now().Add(-time.Minute))
+
+	if _, err := verify(signed, fed.jwks, defaultOptions()); err == nil {
+		t.Errorf("Expired metadata was accepted")
+	}
+}
+
+func TestVerifyWrongKey(t *testing.T) {
+	fed := newTestFederation(t)
+	other := newTestFederation(t)
+	signed := other.sign(t, testMetadata("https://example.com", "pin"), time.Now().Add(time.Hour))
+
+	if _, err := verify(signed, fed.jwks, defaultOptions()); err == nil {
+		t.Errorf("Metadata signed with unknown key was accepted")
+	}
+}
+
+func TestCustomParser(t *testing.T) {
+	fed := newTestFederation(t)
+	signed := fed.sign(t, testMetadata("https://example.com", "pin"), time.Now().Add(time.Hour))
+
+	options := defaultOptions()
+	Parser(MetadataParserFunc(func(payload []byte) (*Metadata, error) {
+		return testMetadata("https://parsed.example.com", "pin"), nil
+	}))(options)
+
+	md, err := verify(signed, fed.jwks, options)
+	must(err, t)
+	shouldEqualString(md.Entities[0].EntityID, "https://parsed.example.com", "entity_id", t)
+}
+
+func TestNilParser(t *testing.T) {
+	fed := newTestFederation(t)
+	signed := fed.sign(t, testMetadata("https://example.com", "pin"), time.Now().Add(time.Hour))
+
+	options := defaultOptions()
+	Parser(nil)(options)
+
+	md, err := verify(signed, fed.jwks, options)
+	must(err, t)
+	shouldEqualString(md.Entities[0].EntityID, "https://example.com", "entity_id", t)
+}
+
+func TestExpectedIssuer(t *testing.T) {
+	fed := newTestFederation(t)
+	md := testMetadata("https://example.com", "pin")
+	exp := time.Now().Add(time.Hour).Unix()
+
+	options := defaultOptions()
+	ExpectedIssuer("https://fed.example.com")(options)
+
+	signed := fed.signWithHeaders(t, md, map[string]interface{}{"exp": exp, "iss": "https://fed.example.com"})
+	_, err := verify(signed, fed.jwks, options)
+	must(err, t)
+
+	signed = fed.signWithHeaders(t, md, map[string]interface{}{"exp": exp, "iss": "https://other.example.com"})
+	if _, err := verify(signed, fed.jwks, options); !errors.Is(err, ErrIssuerMismatch) {
+		t.Errorf("Expected ErrIssuerMismatch for wrong issuer, got %v", err)
+	}
+
+	signed = fed.signWithHeaders(t, md, map[string]interface{}{"exp": exp})
+	if _, err := verify(signed, fed.jwks, options); !errors.Is(err, ErrIssuerMismatch) {
+		t.Errorf("Expected ErrIssuerMismatch for missing issuer, got %v", err)
+	}
+}
+
+func TestVerifyDetached(t *testing.T) {
+	fed := newTestFederation(t)
+	signed, payload := fed.signDetached(t, testMetadata("https://example.com", "pin"), time.Now().Add(time.Hour))
+
+	if !bytes.Contains(signed, []byte("..")) {
+		t.Fatalf("Expected a JWS without payload, got %s", signed)
+	}
+
+	md, err := verifyDetached(signed, payload, fed.jwks, defaultOptions())
+	must(err, t)
+	shouldEqualString(md.Entities[0].EntityID, "https://example.com", "entity_id", t)
+
+	tampered := bytes.Replace(payload, []byte("example.com"), []byte("example.org"), 1)
+	if _, err := verifyDetached(signed, tampered, fed.jwks, defaultOptions()); err == nil {
+		t.Errorf("Tampered detached payload was accepted")
+	}
+}
+
+func TestVerifyMaxMetadataAge(t *testing.T) {
+	fed := newTestFederation(t)
+	md := testMetadata("https://example.com", "pin")
+	now := time.Now()
+	exp := now.Add(time.Hour).Unix()
+
+	options := defaultOptions()
+	MaxMetadataAge(24 * time.Hour)(options)
+
+	signed := fed.signWithHeaders(t, md, map[string]interface{}{"exp": exp, "iat": now.Add(-time.Hour).Unix()})
+	_, err := verify(signed, fed.jwks, options)
+	must(err, t)
+
+	stale := []struct {
+		name    string
+		headers map[string]interface{}
+	}{
+		{"old", map[string]interface{}{"exp": exp, "iat": now.Add(-48 * time.Hour).Unix()}},
+		{"future", map[string]interface{}{"exp": exp, "iat": now.Add(time.Hour).Unix()}},
+		{"missing", map[string]interface{}{"exp": exp}},
+	}
+
+	for _, s := range stale {
+		signed := fed.signWithHeaders(t, md, s.headers)
+		if _, err := verify(signed, fed.jwks, options); !errors.Is(err, ErrMetadataStale) {
+			t.Errorf("Expected ErrMetadataStale for %s iat, got %v", s.name, err)
+		}
+	}
+}
+
+func TestLenientMetadataParser(t *testing.T) {
+	payload := []byte(`{"entities": [
+		{"entity_id": "https://malformed.example.com", "issuers": "x"},
+		{"entity_id": "https://example.com", "servers": [], "clients": []}
+	]}`)
+
+	if _, err := DefaultMetadataParser.Parse(payload); err == nil {
+		t.Errorf("Default parser accepted a malformed entity")
+	}
+
+	md, err := LenientMetadataParser.Parse(payload)
+	must(err, t)
+	if len(md.Entities) != 1 {
+		t.Fatalf("Expected 1 entity, got %d", len(md.Entities))
+	}
+	shouldEqualString(md.Entities[0].EntityID, "https://example.com", "entity_id", t)
+
+	allMalformed := []byte(`{"entities": [{"entity_id": "https://example.com", "issuers": "x"}]}`)
+	if _, err := LenientMetadataParser.Parse(allMalformed); err == nil {
+		t.Errorf("Metadata with only malformed entities was accepted")
+	}
+
+	if _, err := LenientMetadataParser.Parse([]byte(`{"entities": {}}`)); err == nil {
+		t.Errorf("Metadata with malformed top level was accepted")
+	}
+}
+
+func TestParseMetadataLikeUnmarshal(t *testing.T) {
+	md := testMetadata("https://example.com", "pin")
+	md.Entities = append(md.Entities, testMetadata("https://other.example.com", "other pin").Entities...)
+	encoded, err := json.Marshal(md)
+	must(err, t)
+
+	payloads := []string{
+		string(encoded),
+		`null`,
+		`{}`,
+		`{"entities": null}`,
+		`{"entities": []}`,
+		`{"entities": [null, {"entity_id": "https://example.com"}]}`,
+		`{"Entities": [{"entity_id": "https://example.com"}], "VERSION": "2"}`,
+		`{"entities": [{"entity_id": "a"}], "version": "1", "entities": [{"entity_id": "b"}]}`,
+		`{"unknown": {"nested": [1, 2]}, "cache_ttl": 60, "entities": []}`,
+		`{"cache_ttl": "60"}`,
+		`{"entities": [{"entity_id": 1}]}`,
+		`{"entities": {}}`,
+		`{"entities": []} trailing`,
+		`[]`,
+		`{"entities": [`,
+		``,
+	}
+
+	for _, payload := range payloads {
+		var expected Metadata
+		expectedErr := json.Unmarshal([]byte(payload), &expected)
+
+		got, err := parseMetadata([]byte(payload))
+
+		if (err != nil) != (expectedErr != nil) {
+			t.Errorf("%s: expected error %v, got %v", payload, expectedErr, err)
+		} else if err == nil && !reflect.DeepEqual(*got, expected) {
+			t.Errorf("%s: expected %+v, got %+v", payload, expected, *got)
+		}
+	}
+}
+
+func TestReadMetadataFile(t *testing.T) {
+	fed := newTestFederation(t)
+	signed := fed.signWithHeaders(t, testMetadata("https://example.com", "pin"),
+		map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix(), "iss": "https://fed.example.com"})
+	jwksPath := fed.jwksFile(t)
+	path := filepath.Join(t.TempDir(), "md.jws")
+	must(os.WriteFile(path, signed, 0600), t)
+
+	file, err := ReadMetadataFile(jwksPath, path, ExpectedIssuer("https://fed.example.com"))
+	must(err, t)
+	shouldEqualString(file.Metadata.Entities[0].EntityID, "https://example.com", "entity_id", t)
+	if !bytes.Equal(file.JWKS, fed.jwks) {
+		t.Errorf("Unexpected JWKS")
+	}
+
+	headers, err := file.ProtectedHeaders()
+	must(err, t)
+	iss, _ := headers.Get("iss")
+	if iss != "https://fed.example.com" {
+		t.Errorf("Unexpected iss header: %v", iss)
+	}
+
+	// - reads from stdin
+	stdin, err := os.Open(path)
+	must(err, t)
+	defer stdin.Close()
+	oldStdin := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = oldStdin }()
+
+	file, err = ReadMetadataFile(jwksPath, "-")
+	must(err, t)
+	shouldEqualString(file.Metadata.Entities[0].EntityID, "https://example.com", "entity_id", t)
+
+	// The errors tell which step failed
+	failures := map[string]error{}
+	_, failures["Failed to read JWKS"] = ReadMetadataFile(filepath.Join(t.TempDir(), "missing"), path)
+	_, failures["Failed to read metadata"] = ReadMetadataFile(jwksPath, filepath.Join(t.TempDir(), "missing"))
+	_, failures["Failed to verify metadata"] = ReadMetadataFile(newTestFederation(t).jwksFile(t), path)
+	_, failures["Failed to verify metadata: "+ErrIssuerMismatch.Error()] =
+		ReadMetadataFile(jwksPath, path, ExpectedIssuer("https://other.example.com"))
+
+	for prefix, err := range failures {
+		if err == nil || !strings.HasPrefix(err.Error(), prefix) {
+			t.Errorf("Expected an error starting with %q, got %v", prefix, err)
+		}
+	}
+}
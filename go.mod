@@ -5,7 +5,7 @@ go 1.22
 require (
 	github.com/lestrrat-go/jwx/v2 v2.0.21
 	github.com/spf13/viper v1.10.1
-	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
+	golang.org/x/time v0.5.0
 )
 
 require (
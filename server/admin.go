@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/joesiltberg/bowness/fedtls"
+)
+
+// ReadinessHandler returns an HTTP handler suitable for readiness probes
+//
+// It responds with 200 OK once the metadata store has loaded valid metadata,
+// and 503 Service Unavailable as long as it hasn't (in which case all client
+// connections will be rejected). It's meant to be served on a separate,
+// non-authenticated listener.
+func ReadinessHandler(mdstore *fedtls.MetadataStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := mdstore.Status()
+
+		if !status.Loaded {
+			msg := "No valid metadata loaded yet"
+			if status.LastError != nil {
+				msg = fmt.Sprintf("%s: %v", msg, status.LastError)
+			}
+			http.Error(w, msg, http.StatusServiceUnavailable)
+			return
+		}
+
+		fmt.Fprintf(w, "Ready, metadata loaded at %s\n", status.LastUpdate.UTC().Format(time.RFC3339))
+	})
+}
+
+// HealthCheck returns a middleware which answers requests for path itself
+// (like ReadinessHandler), all other requests are passed on to h.
+//
+// This is meant for load balancers doing health checks on the authenticated
+// listener, without the health checks reaching the backend. Placed after
+// the authentication middleware, the health check still requires a valid
+// client certificate.
+func HealthCheck(h http.Handler, path string, mdstore *fedtls.MetadataStore) http.Handler {
+	readiness := ReadinessHandler(mdstore)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestPath, normalize := matchingPath(r); requestPath == normalize(path) {
+			readiness.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// TrustedIssuersHandler returns an HTTP handler which lists the issuer
+// certificates currently trusted per entity (see TrustedIssuers), in JSON
+// format. The query parameter entity limits the response to one entity.
+//
+// Like ReadinessHandler it's meant to be served on a separate,
+// non-authenticated listener.
+func TrustedIssuersHandler(mgr *MetadataTLSConfigManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issuers := mgr.TrustedIssuers()
+
+		if entityID := r.URL.Query().Get("entity"); entityID != "" {
+			entityIssuers, ok := issuers[entityID]
+			if !ok {
+				http.Error(w, "No trusted issuers for "+entityID, http.StatusNotFound)
+				return
+			}
+			issuers = map[string][]IssuerInfo{entityID: entityIssuers}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(issuers)
+	})
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/joesiltberg/bowness/fedtls"
+)
+
+func TestHealthCheck(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	// A store which hasn't loaded any metadata
+	h := HealthCheck(backend, "/health", &fedtls.MetadataStore{})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 from health check before metadata is loaded, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/other", nil))
+	if rec.Code != http.StatusTeapot {
+		t.Errorf("Other paths should reach the backend, got %d", rec.Code)
+	}
+}
+
+func TestReadinessHandler(t *testing.T) {
+	mdstore := fedtls.NewStaticMetadataStore()
+	h := ReadinessHandler(mdstore)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "No valid metadata") {
+		t.Errorf("Expected 503 before metadata is loaded, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	mdstore.SetMetadata(&fedtls.Metadata{})
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Body.String(), "Ready") {
+		t.Errorf("Expected 200 once metadata is loaded, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
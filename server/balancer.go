@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"sync"
+)
+
+// A WeightedBackend is a handler (typically a reverse proxy to one backend
+// replica) with a weight for WeightedRoundRobin
+type WeightedBackend struct {
+	Handler http.Handler
+
+	// The share of requests the backend gets is its weight divided by the
+	// sum of all weights. A backend with weight 0 gets no requests.
+	Weight int
+}
+
+// Smooth weighted round-robin (as in nginx), which spreads out the
+// requests to a heavy backend instead of sending them in a row
+type weightedRoundRobin struct {
+	backends []WeightedBackend
+	current  []int
+	total    int
+	lock     sync.Mutex
+}
+
+// Returns the index of the next backend, or -1 if all weights are 0
+func (b *weightedRoundRobin) next() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	best := -1
+	for i := range b.backends {
+		if b.backends[i].Weight <= 0 {
+			continue
+		}
+		b.current[i] += b.backends[i].Weight
+		if best == -1 || b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+
+	if best != -1 {
+		b.current[best] -= b.total
+	}
+	return best
+}
+
+// WeightedRoundRobin returns a handler which distributes requests over
+// backends in proportion to their weights. If all backends have weight 0
+// requests get 503 Service Unavailable.
+func WeightedRoundRobin(backends []WeightedBackend) http.Handler {
+	b := &weightedRoundRobin{
+		backends: backends,
+		current:  make([]int, len(backends)),
+	}
+
+	for _, backend := range backends {
+		if backend.Weight > 0 {
+			b.total += backend.Weight
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := b.next()
+
+		if i == -1 {
+			http.Error(w, "No backend available", http.StatusServiceUnavailable)
+			return
+		}
+		b.backends[i].Handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWeightedRoundRobin(t *testing.T) {
+	counts := make([]int, 3)
+	backend := func(i int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			counts[i]++
+		})
+	}
+
+	h := WeightedRoundRobin([]WeightedBackend{
+		{Handler: backend(0), Weight: 3},
+		{Handler: backend(1), Weight: 1},
+		{Handler: backend(2), Weight: 0},
+	})
+
+	for i := 0; i < 400; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	if counts[0] != 300 || counts[1] != 100 || counts[2] != 0 {
+		t.Errorf("Unexpected distribution of requests: %v", counts)
+	}
+}
+
+func TestWeightedRoundRobinAllDrained(t *testing.T) {
+	h := WeightedRoundRobin([]WeightedBackend{
+		{Handler: http.NotFoundHandler(), Weight: 0},
+	})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 when all backends are drained, got %d", w.Code)
+	}
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/joesiltberg/bowness/fedtls"
+	"golang.org/x/time/rate"
+)
+
+// ServerOptions are the settings for a server created with New
+type ServerOptions struct {
+	// The server's certificate and key, not needed if TLSConfigManager is set
+	CertFile string
+	KeyFile  string
+
+	// Options for the TLS configuration created from CertFile and KeyFile
+	TLSOptions []TLSOptionSetter
+
+	// An existing TLS configuration, instead of creating one
+	TLSConfigManager *MetadataTLSConfigManager
+
+	// Address to listen to, ":443" by default
+	Address string
+
+	// If set, this (unencrypted) listener is used instead of listening
+	// to Address, for instance to wrap it with LifetimeListener
+	Listener net.Listener
+
+	// The handler for authenticated requests, either Handler or Target
+	// must be set
+	Handler http.Handler
+
+	// The backend to proxy authenticated requests to, with ProxyOptions
+	Target       *url.URL
+	ProxyOptions []ProxyOptionSetter
+
+	// API key added to requests by the middleware (none if nil)
+	APIKey *APIKey
+
+	// Options for the authentication middleware
+	MiddlewareOptions []MiddlewareOptionSetter
+
+	// Rate limiting per entity (see LimiterWithContext), disabled if
+	// LimitRate is zero
+	LimitRate    rate.Limit
+	LimitBurst   int
+	LimitContext context.Context
+	LimitCosts   []PathCost
+
+	// Requests which haven't been responded to within this are answered
+	// with 503 Service Unavailable (see RouteTimeouts), zero means no timeout
+	BackendTimeout time.Duration
+
+	// Timeouts for the http.Server
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+}
+
+// A ServerOptionSetter is a function for modifying the options for New
+type ServerOptionSetter func(*ServerOptions)
+
+// ServerCertificate creates a ServerOptionSetter for setting the server's
+// certificate and key files, and options for the TLS configuration
+func ServerCertificate(certFile, keyFile string, setters ...TLSOptionSetter) ServerOptionSetter {
+	return func(options *ServerOptions) {
+		options.CertFile = certFile
+		options.KeyFile = keyFile
+		options.TLSOptions = setters
+	}
+}
+
+// ServerTLSConfigManager creates a ServerOptionSetter for using an existing
+// TLS configuration instead of creating one with ServerCertificate
+func ServerTLSConfigManager(mgr *MetadataTLSConfigManager) ServerOptionSetter {
+	return func(options *ServerOptions) {
+		options.TLSConfigManager = mgr
+	}
+}
+
+// ServerAddress creates a ServerOptionSetter for setting the address
+// to listen to
+func ServerAddress(address string) ServerOptionSetter {
+	return func(options *ServerOptions) {
+		options.Address = address
+	}
+}
+
+// ServerListener creates a ServerOptionSetter for using an existing
+// (unencrypted) listener, the TLS listener is created on top of it
+func ServerListener(l net.Listener) ServerOptionSetter {
+	return func(options *ServerOptions) {
+		options.Listener = l
+	}
+}
+
+// ServerHandler creates a ServerOptionSetter for setting the handler for
+// authenticated requests
+func ServerHandler(h http.Handler) ServerOptionSetter {
+	return func(options *ServerOptions) {
+		options.Handler = h
+	}
+}
+
+// ServerTarget creates a ServerOptionSetter for proxying authenticated
+// requests to a backend, see NewReverseProxy
+func ServerTarget(target *url.URL, setters ...ProxyOptionSetter) ServerOptionSetter {
+	return func(options *ServerOptions) {
+		options.Target = target
+		options.ProxyOptions = setters
+	}
+}
+
+// ServerAPIKey creates a ServerOptionSetter for setting an API key to add
+// to all requests
+func ServerAPIKey(apiKey *APIKey) ServerOptionSetter {
+	return func(options *ServerOptions) {
+		options.APIKey = apiKey
+	}
+}
+
+// ServerMiddleware creates a ServerOptionSetter for setting the options
+// for the authentication middleware
+func ServerMiddleware(setters ...MiddlewareOptionSetter) ServerOptionSetter {
+	return func(options *ServerOptions) {
+		options.MiddlewareOptions = setters
+	}
+}
+
+// ServerLimit creates a ServerOptionSetter for rate limiting requests per
+// entity, see LimiterWithContext
+func ServerLimit(ctx context.Context, r rate.Limit, b int, costs ...PathCost) ServerOptionSetter {
+	return func(options *ServerOptions) {
+		options.LimitContext = ctx
+		options.LimitRate = r
+		options.LimitBurst = b
+		options.LimitCosts = costs
+	}
+}
+
+// ServerBackendTimeout creates a ServerOptionSetter for limiting how long
+// the handler may take to respond
+func ServerBackendTimeout(timeout time.Duration) ServerOptionSetter {
+	return func(options *ServerOptions) {
+		options.BackendTimeout = timeout
+	}
+}
+
+// ServerTimeouts creates a ServerOptionSetter for setting the http.Server's
+// timeouts
+func ServerTimeouts(readHeader, read, write, idle time.Duration) ServerOptionSetter {
+	return func(options *ServerOptions) {
+		options.ReadHeaderTimeout = readHeader
+		options.ReadTimeout = read
+		options.WriteTimeout = write
+		options.IdleTimeout = idle
+	}
+}
+
+// New creates an http.Server for federated TLS authentication, together
+// with the TLS listener it should serve (with srv.Serve(listener)).
+//
+// The pieces are composed like this, from the outside in: the
+// authentication middleware, the backend timeout, the rate limiter and
+// finally the handler (or reverse proxy). The server's ConnContext is set up
+// with ContextModifier, so the middleware can find the connection.
+//
+// The returned server can be modified before it's started, for instance to
+// wrap its Handler or set ConnState.
+func New(mdstore *fedtls.MetadataStore, setters ...ServerOptionSetter) (*http.Server, net.Listener, error) {
+	options := &ServerOptions{
+		Address:      ":443",
+		LimitContext: context.Background(),
+	}
+
+	for _, setter := range setters {
+		setter(options)
+	}
+
+	h := options.Handler
+	if h == nil && options.Target == nil {
+		return nil, nil, errors.New("either a handler or a target is required")
+	} else if h != nil && options.Target != nil {
+		return nil, nil, errors.New("only one of handler and target can be set")
+	} else if h == nil {
+		h = NewReverseProxy(options.Target, options.ProxyOptions...)
+	}
+
+	if options.LimitRate > 0 {
+		h = NewEntityLimiter(options.LimitContext, h, options.LimitRate, options.LimitBurst,
+			options.LimitCosts...)
+	}
+
+	h = withTimeout(h, options.BackendTimeout)
+
+	h = AuthMiddleware(h, mdstore, options.APIKey, options.MiddlewareOptions...)
+
+	mgr := options.TLSConfigManager
+	if mgr == nil {
+		if options.CertFile == "" || options.KeyFile == "" {
+			return nil, nil, errors.New("either a certificate and key or a TLS configuration is required")
+		}
+
+		var err error
+		mgr, err = NewMetadataTLSConfigManager(options.CertFile, options.KeyFile, mdstore, options.TLSOptions...)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	listener := options.Listener
+	if listener == nil {
+		var err error
+		listener, err = net.Listen("tcp", options.Address)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	srv := &http.Server{
+		Handler:           h,
+		ConnContext:       ContextModifier(),
+		ReadHeaderTimeout: options.ReadHeaderTimeout,
+		ReadTimeout:       options.ReadTimeout,
+		WriteTimeout:      options.WriteTimeout,
+		IdleTimeout:       options.IdleTimeout,
+	}
+
+	return srv, tls.NewListener(listener, mgr.Config()), nil
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joesiltberg/bowness/fedtls"
+	"golang.org/x/time/rate"
+)
+
+func TestNew(t *testing.T) {
+	mdstore := &fedtls.MetadataStore{}
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	if _, _, err := New(mdstore, ServerAddress("127.0.0.1:0")); err == nil {
+		t.Errorf("Expected error without handler or target")
+	}
+
+	if _, _, err := New(mdstore, ServerHandler(backend), ServerAddress("127.0.0.1:0")); err == nil {
+		t.Errorf("Expected error without certificate")
+	}
+
+	ca := newTestCert(t, "ca", true, nil)
+	serverCert := newTestServerCert(t, ca)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	der, err := x509.MarshalPKCS8PrivateKey(serverCert.key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	if err := os.WriteFile(certFile, []byte(toPEM(serverCert)), 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	srv, listener, err := New(mdstore,
+		ServerCertificate(certFile, keyFile),
+		ServerAddress("127.0.0.1:0"),
+		ServerHandler(backend))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer listener.Close()
+
+	if srv.ConnContext == nil {
+		t.Fatalf("Server has no ConnContext")
+	}
+
+	// The handler should be wrapped with the middleware, which refuses
+	// requests without a connection in the context
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil).WithContext(context.Background()))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected request without connection to be refused, got %d", rec.Code)
+	}
+}
+
+// Starts a server with New for requests to h, and returns its address
+func startTestServer(t *testing.T, mdstore *fedtls.MetadataStore, h http.Handler, setters ...ServerOptionSetter) string {
+	t.Helper()
+
+	certFile, keyFile := writeServerCertificate(t)
+	setters = append([]ServerOptionSetter{
+		ServerCertificate(certFile, keyFile),
+		ServerAddress("127.0.0.1:0"),
+		ServerHandler(h),
+	}, setters...)
+
+	srv, listener, err := New(mdstore, setters...)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+	return listener.Addr().String()
+}
+
+// Creates an HTTP client which authenticates with client's certificate,
+// and uses HTTP/2 if the server offers it
+func newTestClient(client *testCert) *http.Client {
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			ForceAttemptHTTP2: true,
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				Certificates:       []tls.Certificate{toTLSCertificate(client)},
+			},
+		},
+	}
+}
+
+// Concurrent HTTP/2 streams on one connection while metadata changes,
+// run with -race
+func TestHTTP2Streams(t *testing.T) {
+	root := newTestCert(t, "Root CA", true, nil)
+	client := newTestCert(t, "client", false, root)
+
+	mdstore := fedtls.NewStaticMetadataStore()
+	mdstore.SetMetadata(metadataWithClient("https://example.com", root, client))
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		w.Write([]byte(EntityIDFromContext(r.Context())))
+	})
+
+	certFile, keyFile := writeServerCertificate(t)
+	addr := startTestServer(t, mdstore, backend,
+		ServerCertificate(certFile, keyFile, TLSNextProtos([]string{"h2", "http/1.1"})),
+		ServerMiddleware(RecheckAuth(true)))
+
+	httpClient := newTestClient(client)
+
+	// Once a connection is established, the requests below are streams on it
+	response, err := httpClient.Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	response.Body.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := httpClient.Get("https://" + addr + "/")
+			if err != nil {
+				t.Errorf("Request failed: %v", err)
+				return
+			}
+			response.Body.Close()
+
+			if response.ProtoMajor != 2 {
+				t.Errorf("Expected HTTP/2, got %s", response.Proto)
+			}
+			if response.StatusCode != http.StatusOK {
+				t.Errorf("Expected 200, got %d", response.StatusCode)
+			}
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		mdstore.SetMetadata(metadataWithClient("https://example.com", root, client))
+	}
+	wg.Wait()
+}
+
+// A server-sent event must reach the client while the backend is still
+// responding, through the backend timeout and rate limiting
+func TestServerSentEvents(t *testing.T) {
+	root := newTestCert(t, "Root CA", true, nil)
+	client := newTestCert(t, "client", false, root)
+
+	mdstore := fedtls.NewStaticMetadataStore()
+	mdstore.SetMetadata(metadataWithClient("https://example.com", root, client))
+
+	received := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+
+		// The rest of the response waits until the client has the event
+		select {
+		case <-received:
+		case <-r.Context().Done():
+			return
+		}
+		fmt.Fprint(w, "data: last\n\n")
+	}))
+	defer backend.Close()
+
+	target, _ := url.Parse(backend.URL)
+	addr := startTestServer(t, mdstore, NewReverseProxy(target),
+		ServerBackendTimeout(time.Minute),
+		ServerLimit(context.Background(), rate.Limit(10), 10))
+
+	response, err := newTestClient(client).Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer response.Body.Close()
+
+	lines := make(chan string)
+	go func() {
+		line, _ := bufio.NewReader(response.Body).ReadString('\n')
+		lines <- line
+	}()
+
+	select {
+	case line := <-lines:
+		if line != "data: first\n" {
+			t.Errorf("Expected the first event, got %q", line)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("The first event wasn't flushed to the client")
+	}
+	close(received)
+}
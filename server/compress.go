@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Content types which are already compressed, so compressing them again
+// would only waste CPU
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/zstd",
+	"application/x-bzip2",
+	"application/x-7z-compressed",
+}
+
+// Whether the client accepts gzip, according to Accept-Encoding
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(header, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+				continue
+			}
+			q := 1.0
+			if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				q, _ = strconv.ParseFloat(value, 64)
+			}
+			return q > 0
+		}
+	}
+	return false
+}
+
+// Whether a response with these headers should be compressed
+func compressible(h http.Header) bool {
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		// Unknown content type, it's probably not compressed
+		return true
+	}
+
+	for _, t := range incompressibleTypes {
+		if strings.HasPrefix(mediaType, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// A gzipResponseWriter buffers the start of a response until it knows
+// whether it's large enough to compress, after that it streams the
+// (possibly compressed) response.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+
+	minSize int
+	status  int
+
+	// Written data, until we've decided whether to compress
+	buf []byte
+
+	decided bool
+	gz      *gzip.Writer
+
+	// After a hijack (or a protocol switch) the connection is no longer
+	// ours to write to
+	hijacked bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	switch {
+	case status == http.StatusSwitchingProtocols:
+		// The response continues in another protocol, which can't be
+		// compressed
+		w.decided = true
+		w.hijacked = true
+		w.ResponseWriter.WriteHeader(status)
+	case status >= 100 && status < 200:
+		// Informational responses are sent before the final one
+		w.ResponseWriter.WriteHeader(status)
+	case w.status == 0:
+		w.status = status
+	}
+}
+
+// Decides whether to compress, sends the headers and any buffered data
+func (w *gzipResponseWriter) decide(compress bool) error {
+	w.decided = true
+
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+
+	if compress && compressible(h) {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+
+		// The compressed representation isn't byte for byte the same as
+		// the one a strong ETag was computed for
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := w.writeBody(buf)
+	return err
+}
+
+func (w *gzipResponseWriter) writeBody(p []byte) (int, error) {
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if w.decided {
+		return w.writeBody(p)
+	}
+
+	w.buf = append(w.buf, p...)
+
+	if len(w.buf) >= w.minSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends what has been written so far. A response being flushed is
+// likely streamed, so it's compressed even if it's smaller than minSize.
+func (w *gzipResponseWriter) Flush() {
+	if !w.decided {
+		w.decide(true)
+	}
+
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack hands over the connection, after which nothing more is written
+// through the gzipResponseWriter (for instance for a WebSocket upgrade)
+func (w *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.decided = true
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Sends anything still buffered, small responses aren't compressed
+func (w *gzipResponseWriter) finish() {
+	if w.hijacked {
+		return
+	}
+
+	if !w.decided {
+		w.decide(false)
+	}
+
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+// Compressor returns a middleware which gzips responses for clients that
+// accept it. Responses smaller than minSize bytes, and responses with
+// content types which are already compressed (such as images), are sent
+// as they are.
+func Compressor(h http.Handler, minSize int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsGzip(r) || r.Method == http.MethodHead || r.Method == http.MethodConnect {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, minSize: minSize}
+		defer gw.finish()
+
+		h.ServeHTTP(gw, r)
+	})
+}
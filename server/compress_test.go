@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	cases := map[string]bool{
+		"":                    false,
+		"gzip":                true,
+		"deflate, gzip":       true,
+		"gzip;q=0.5, br":      true,
+		"gzip;q=0":            false,
+		"br":                  false,
+		"GZIP":                true,
+		"identity, gzip; q=0": false,
+	}
+
+	for header, want := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", header)
+		if got := acceptsGzip(r); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, expected %v", header, got, want)
+		}
+	}
+}
+
+func serveCompressed(t *testing.T, contentType, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	h := Compressor(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		io.WriteString(w, body)
+	}), 100)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestCompressor(t *testing.T) {
+	large := strings.Repeat(`{"key": "value"}`, 100)
+
+	rec := serveCompressed(t, "application/json", large)
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Large JSON response wasn't compressed")
+	}
+
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("Failed to read compressed response: %v", err)
+	}
+	body, _ := io.ReadAll(gz)
+	if string(body) != large {
+		t.Errorf("Decompressed body differs from the original")
+	}
+
+	rec = serveCompressed(t, "application/json", `{"small": true}`)
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != `{"small": true}` {
+		t.Errorf("Small response was compressed")
+	}
+
+	rec = serveCompressed(t, "image/png", large)
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != large {
+		t.Errorf("Image was compressed")
+	}
+}
+
+func TestCompressorETag(t *testing.T) {
+	large := strings.Repeat(`{"key": "value"}`, 100)
+
+	for etag, want := range map[string]string{
+		`"abc"`:   `W/"abc"`,
+		`W/"abc"`: `W/"abc"`,
+	} {
+		h := Compressor(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", etag)
+			io.WriteString(w, large)
+		}), 100)
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+
+		if got := rec.Header().Get("ETag"); got != want {
+			t.Errorf("Compressed response with ETag %s got ETag %s, expected %s", etag, got, want)
+		}
+	}
+}
+
+// A ResponseRecorder which can be hijacked, and complains if it's written
+// to after that
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	t        *testing.T
+	hijacked bool
+}
+
+func (r *hijackRecorder) WriteHeader(status int) {
+	if r.hijacked {
+		r.t.Errorf("WriteHeader(%d) after hijack", status)
+	}
+	r.ResponseRecorder.WriteHeader(status)
+}
+
+func (r *hijackRecorder) Write(p []byte) (int, error) {
+	if r.hijacked {
+		r.t.Errorf("Write after hijack")
+	}
+	return r.ResponseRecorder.Write(p)
+}
+
+func (r *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.hijacked = true
+	server, client := net.Pipe()
+	client.Close()
+	return server, bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)), nil
+}
+
+func TestCompressorHijack(t *testing.T) {
+	h := Compressor(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Fatalf("Failed to hijack: %v", err)
+		}
+		conn.Close()
+	}), 100)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := &hijackRecorder{ResponseRecorder: httptest.NewRecorder(), t: t}
+	h.ServeHTTP(rec, r)
+
+	if !rec.hijacked {
+		t.Errorf("Connection wasn't hijacked")
+	}
+}
+
+func TestCompressorSwitchingProtocols(t *testing.T) {
+	h := Compressor(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Upgrade", "websocket")
+		w.WriteHeader(http.StatusSwitchingProtocols)
+	}), 100)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusSwitchingProtocols {
+		t.Errorf("Expected 101, got %d", rec.Code)
+	}
+	if rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Protocol switch was compressed")
+	}
+}
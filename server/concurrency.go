@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ConcurrencyLimiter returns a middleware which allows at most max requests
+// to be handled concurrently by h.
+//
+// Requests exceeding the limit wait for up to queueTimeout for a slot to
+// become available, after which they're rejected with 503 Service Unavailable.
+// A queueTimeout of 0 rejects excess requests immediately.
+func ConcurrencyLimiter(h http.Handler, max int, queueTimeout time.Duration) http.Handler {
+	return ConcurrencyLimiterWithContext(context.Background(), h, max, queueTimeout)
+}
+
+// ConcurrencyLimiterWithContext is like ConcurrencyLimiter, but requests
+// waiting for a slot are released with 503 Service Unavailable as soon as
+// ctx is done (see LimiterWithContext). Cancel ctx when shutdown begins.
+func ConcurrencyLimiterWithContext(ctx context.Context, h http.Handler, max int, queueTimeout time.Duration) http.Handler {
+	slots := make(chan struct{}, max)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			if !waitForSlot(ctx, r, slots, queueTimeout) {
+				http.Error(w, "Too many concurrent requests", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		defer func() { <-slots }()
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Waits until a slot is acquired (returns true), or the timeout expires,
+// the request is cancelled or ctx is done (returns false).
+func waitForSlot(ctx context.Context, r *http.Request, slots chan struct{}, timeout time.Duration) bool {
+	if timeout <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// An entity's slots, and how many of its requests are using or waiting for
+// one. The entity is forgotten when the count reaches zero.
+type entitySlots struct {
+	slots chan struct{}
+	users int
+}
+
+// The http.Handler returned by EntityConcurrencyLimiter
+type entityConcurrencyLimiter struct {
+	h            http.Handler
+	ctx          context.Context
+	max          int
+	limits       map[string]int
+	queueTimeout time.Duration
+
+	entities map[string]*entitySlots
+	lock     sync.Mutex
+}
+
+// EntityConcurrencyLimiter returns a middleware which allows each entity at
+// most max requests handled concurrently by h, so that one entity can't
+// tie up the backend with slow requests. It must be placed after the
+// authentication middleware.
+//
+// limits overrides max for individual entity IDs, zero (for max or an
+// entity's limit) means no limit. Requests exceeding the limit wait for up
+// to queueTimeout like with ConcurrencyLimiter, but are then rejected with
+// 429 Too Many Requests. An entity's state only exists while it has
+// requests in flight.
+func EntityConcurrencyLimiter(h http.Handler, max int, limits map[string]int, queueTimeout time.Duration) http.Handler {
+	return EntityConcurrencyLimiterWithContext(context.Background(), h, max, limits, queueTimeout)
+}
+
+// EntityConcurrencyLimiterWithContext is like EntityConcurrencyLimiter,
+// but requests waiting for a slot are released with 503 Service Unavailable
+// as soon as ctx is done. Cancel ctx when shutdown begins.
+func EntityConcurrencyLimiterWithContext(ctx context.Context, h http.Handler, max int, limits map[string]int,
+	queueTimeout time.Duration) http.Handler {
+	return &entityConcurrencyLimiter{
+		h:            h,
+		ctx:          ctx,
+		max:          max,
+		limits:       limits,
+		queueTimeout: queueTimeout,
+		entities:     make(map[string]*entitySlots),
+	}
+}
+
+// Returns the entity's slots (nil if it has no limit), which must be
+// released when the request is done
+func (l *entityConcurrencyLimiter) acquire(entityID string) *entitySlots {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	e, ok := l.entities[entityID]
+	if !ok {
+		limit, ok := l.limits[entityID]
+		if !ok {
+			limit = l.max
+		}
+		if limit <= 0 {
+			return nil
+		}
+		e = &entitySlots{slots: make(chan struct{}, limit)}
+		l.entities[entityID] = e
+	}
+	e.users++
+	return e
+}
+
+func (l *entityConcurrencyLimiter) release(entityID string, e *entitySlots) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	e.users--
+	if e.users == 0 {
+		delete(l.entities, entityID)
+	}
+}
+
+func (l *entityConcurrencyLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	entityID := EntityIDFromContext(r.Context())
+
+	e := l.acquire(entityID)
+	if e == nil {
+		l.h.ServeHTTP(w, r)
+		return
+	}
+	defer l.release(entityID, e)
+
+	select {
+	case e.slots <- struct{}{}:
+	default:
+		if !waitForSlot(l.ctx, r, e.slots, l.queueTimeout) {
+			if l.ctx.Err() != nil {
+				http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+			} else {
+				http.Error(w, "Too many concurrent requests", http.StatusTooManyRequests)
+			}
+			return
+		}
+	}
+	defer func() { <-e.slots }()
+
+	l.h.ServeHTTP(w, r)
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEntityConcurrencyLimiter(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+
+	h := EntityConcurrencyLimiter(backend, 1, map[string]int{
+		"https://big.example.com":       2,
+		"https://unlimited.example.com": 0,
+	}, 0)
+
+	var wg sync.WaitGroup
+	serve := func(entityID string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(httptest.NewRecorder(), newRoutedRequest(entityID))
+		}()
+		<-started
+	}
+
+	// Fill up the slots of each entity
+	serve("https://a.example.com")
+	serve("https://big.example.com")
+	serve("https://big.example.com")
+	serve("https://unlimited.example.com")
+	serve("https://unlimited.example.com")
+
+	for entityID, expected := range map[string]int{
+		"https://a.example.com":         http.StatusTooManyRequests,
+		"https://big.example.com":       http.StatusTooManyRequests,
+		"https://b.example.com":         0,
+		"https://unlimited.example.com": 0,
+	} {
+		if expected == 0 {
+			serve(entityID)
+			continue
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, newRoutedRequest(entityID))
+		if rec.Code != expected {
+			t.Errorf("Expected %d for %s, got %d", expected, entityID, rec.Code)
+		}
+	}
+
+	close(release)
+	wg.Wait()
+
+	l := h.(*entityConcurrencyLimiter)
+	if len(l.entities) != 0 {
+		t.Errorf("Expected entities to be forgotten when idle, %d remain", len(l.entities))
+	}
+}
+
+func TestEntityConcurrencyLimiterQueue(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	})
+	h := EntityConcurrencyLimiter(backend, 1, nil, time.Second)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 3)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, newRoutedRequest("https://example.com"))
+			codes[i] = rec.Code
+		}(i)
+	}
+	wg.Wait()
+
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("Queued request %d got %d", i, code)
+		}
+	}
+}
+
+func TestConcurrencyLimitersReleasedOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+
+	limiters := map[string]http.Handler{
+		"global":     ConcurrencyLimiterWithContext(ctx, backend, 1, time.Hour),
+		"per entity": EntityConcurrencyLimiterWithContext(ctx, backend, 1, nil, time.Hour),
+	}
+
+	var active sync.WaitGroup
+	queued := make(map[string]*httptest.ResponseRecorder)
+	var wg sync.WaitGroup
+
+	for name, h := range limiters {
+		// Takes the only slot until the end of the test
+		active.Add(1)
+		go func() {
+			defer active.Done()
+			h.ServeHTTP(httptest.NewRecorder(), newRoutedRequest("https://example.com"))
+		}()
+		time.Sleep(20 * time.Millisecond)
+
+		rec := httptest.NewRecorder()
+		queued[name] = rec
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(rec, newRoutedRequest("https://example.com"))
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Queued requests weren't released on shutdown")
+	}
+
+	for name, rec := range queued {
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: expected 503, got %d", name, rec.Code)
+		}
+	}
+
+	close(release)
+	active.Wait()
+}
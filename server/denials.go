@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/joesiltberg/bowness/util"
+)
+
+// DenialLogMode determines how denied connections are logged
+type DenialLogMode string
+
+// Ways of logging denied connections
+const (
+	// Every denied connection is logged
+	DenialLogFull DenialLogMode = "full"
+
+	// The first denial per client is logged, further denials from the same
+	// client within the sampling interval are only counted. The count is
+	// logged with the next denial after the interval.
+	DenialLogSampled DenialLogMode = "sampled"
+
+	// Denied connections aren't logged
+	DenialLogOff DenialLogMode = "off"
+)
+
+// Denials from one client during the current sampling interval
+type denialSample struct {
+	start      time.Time
+	suppressed int
+}
+
+// A denialSampler decides which denials to log when sampling
+type denialSampler struct {
+	interval time.Duration
+	samples  map[string]*denialSample
+	lock     sync.Mutex
+
+	// Called for clients which are forgotten with denials that were
+	// never logged, with how many there were (nil to not report them)
+	report func(key string, suppressed int)
+
+	// Whether the goroutine forgetting old samples is running
+	sweeping bool
+}
+
+func newDenialSampler(interval time.Duration, report func(key string, suppressed int)) *denialSampler {
+	return &denialSampler{
+		interval: interval,
+		samples:  make(map[string]*denialSample),
+		report:   report,
+	}
+}
+
+// Returns the fingerprint of the client's certificate, or an empty string
+// if it didn't send one
+func peerFingerprint(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) > 0 {
+		return util.Fingerprint(state.PeerCertificates[0])
+	}
+	return ""
+}
+
+// Describes a certificate presented by a client, for troubleshooting
+func describeCertificate(cert *x509.Certificate) string {
+	return fmt.Sprintf("subject: %s, issuer: %s, SPKI fingerprint: %s, valid from %s to %s",
+		cert.Subject, cert.Issuer, util.Fingerprint(cert),
+		cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339))
+}
+
+// Logs the certificates a denied client presented (the leaf first),
+// whether or not they could be verified
+func logPeerCertificates(remoteAddr string, state tls.ConnectionState) {
+	if len(state.PeerCertificates) == 0 {
+		log.Printf("Denied client %s presented no certificate", remoteAddr)
+		return
+	}
+
+	for i, cert := range state.PeerCertificates {
+		log.Printf("Denied client %s presented certificate %d of %d (%s)",
+			remoteAddr, i+1, len(state.PeerCertificates), describeCertificate(cert))
+	}
+}
+
+// Identifies a client by its certificate, or by IP address if it
+// didn't present one
+func denialKey(remoteAddr string, state tls.ConnectionState) string {
+	if fingerprint := peerFingerprint(state); fingerprint != "" {
+		return fingerprint
+	}
+
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// Returns whether a denial should be logged, and if so how many denials
+// from the same client were suppressed since the last one was logged
+func (s *denialSampler) sample(key string, now time.Time) (bool, int) {
+	// Without an interval every denial is logged, there's nothing to sample
+	if s.interval <= 0 {
+		return true, 0
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if sample, ok := s.samples[key]; ok && now.Sub(sample.start) < s.interval {
+		sample.suppressed++
+		return false, 0
+	}
+
+	suppressed := 0
+	if sample, ok := s.samples[key]; ok {
+		suppressed = sample.suppressed
+	}
+
+	s.samples[key] = &denialSample{start: now}
+
+	// Old samples are forgotten once per interval, for as long as
+	// there are any, so the map doesn't grow forever
+	if !s.sweeping {
+		s.sweeping = true
+		go s.sweepLoop()
+	}
+	return true, suppressed
+}
+
+func (s *denialSampler) sweepLoop() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if !s.sweep(now) {
+			return
+		}
+	}
+}
+
+// Forgets the clients whose sampling interval has ended, reporting those
+// with suppressed denials. Returns false (and stops the sweeping) once
+// there are no samples left.
+func (s *denialSampler) sweep(now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key, sample := range s.samples {
+		if now.Sub(sample.start) < s.interval {
+			continue
+		}
+		if sample.suppressed > 0 && s.report != nil {
+			s.report(key, sample.suppressed)
+		}
+		delete(s.samples, key)
+	}
+
+	if len(s.samples) == 0 {
+		s.sweeping = false
+		return false
+	}
+	return true
+}
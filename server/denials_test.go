@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joesiltberg/bowness/util"
+)
+
+func TestDenialSampler(t *testing.T) {
+	s := newDenialSampler(time.Minute, nil)
+	start := time.Now()
+
+	if ok, _ := s.sample("a", start); !ok {
+		t.Errorf("First denial wasn't logged")
+	}
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := s.sample("a", start.Add(time.Second)); ok {
+			t.Errorf("Repeated denial was logged")
+		}
+	}
+
+	if ok, _ := s.sample("b", start.Add(time.Second)); !ok {
+		t.Errorf("Denial from another client wasn't logged")
+	}
+
+	ok, suppressed := s.sample("a", start.Add(2*time.Minute))
+	if !ok || suppressed != 3 {
+		t.Errorf("Expected denial with 3 suppressed after the interval, got %v, %d", ok, suppressed)
+	}
+
+	s.sweep(start.Add(3 * time.Minute))
+	if len(s.samples) != 0 {
+		t.Errorf("Old samples weren't forgotten, %d left", len(s.samples))
+	}
+}
+
+// A sampler without an interval logs every denial, instead of starting a
+// sweeper which would panic
+func TestDenialSamplerNoInterval(t *testing.T) {
+	s := newDenialSampler(0, nil)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, suppressed := s.sample("a", now); !ok || suppressed != 0 {
+			t.Errorf("Expected every denial to be logged, got %v, %d", ok, suppressed)
+		}
+	}
+	if s.sweeping || len(s.samples) != 0 {
+		t.Errorf("Sampler without an interval kept samples")
+	}
+}
+
+func TestDenialSamplerSweep(t *testing.T) {
+	reported := make(map[string]int)
+	s := newDenialSampler(time.Minute, func(key string, suppressed int) {
+		reported[key] = suppressed
+	})
+	start := time.Now()
+
+	s.sample("quiet", start)
+	s.sample("noisy", start)
+	s.sample("noisy", start.Add(time.Second))
+	s.sample("noisy", start.Add(2*time.Second))
+	s.sample("recent", start.Add(90*time.Second))
+	s.sample("recent", start.Add(91*time.Second))
+
+	if !s.sweep(start.Add(2 * time.Minute)) {
+		t.Errorf("Sweeping stopped while there are recent samples")
+	}
+
+	if len(reported) != 1 || reported["noisy"] != 2 {
+		t.Errorf("Expected 2 suppressed denials reported for noisy client, got %v", reported)
+	}
+
+	if _, found := s.samples["noisy"]; found {
+		t.Errorf("Noisy client wasn't forgotten")
+	}
+
+	if _, found := s.samples["recent"]; !found {
+		t.Errorf("Recent client was forgotten")
+	}
+
+	if s.sweep(start.Add(3 * time.Minute)) {
+		t.Errorf("Sweeping didn't stop without samples")
+	}
+
+	if reported["recent"] != 1 {
+		t.Errorf("Expected 1 suppressed denial reported for recent client, got %v", reported)
+	}
+}
+
+func TestDenialKey(t *testing.T) {
+	if key := denialKey("192.0.2.1:4711", tls.ConnectionState{}); key != "192.0.2.1" {
+		t.Errorf("Expected IP address as key, got %s", key)
+	}
+
+	cert := newTestCert(t, "client", false, nil)
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.cert}}
+	if key := denialKey("192.0.2.1:4711", state); key == "192.0.2.1" {
+		t.Errorf("Expected fingerprint as key for client with certificate")
+	}
+}
+
+func TestDescribeCertificate(t *testing.T) {
+	cert := newTestCert(t, "client", false, nil)
+	description := describeCertificate(cert.cert)
+
+	for _, expected := range []string{"CN=client", util.Fingerprint(cert.cert),
+		cert.cert.NotAfter.UTC().Format(time.RFC3339)} {
+		if !strings.Contains(description, expected) {
+			t.Errorf("Expected %q in description: %s", expected, description)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// The state of an authenticated connection
+type drainedConn struct {
+	entityID string
+
+	// Whether a request is being handled (see http.ConnState)
+	active bool
+
+	// Whether the connection should be closed once it's idle
+	draining bool
+}
+
+// A ConnectionDrainer keeps track of authenticated connections per entity, so
+// that the connections of entities which have been removed from metadata can
+// be closed instead of staying open until they time out.
+//
+// Its ConnState method must be used as (or called from) the http.Server's
+// ConnState hook, and the middleware must be set up with DrainConnections.
+type ConnectionDrainer struct {
+	conns map[net.Conn]*drainedConn
+	lock  sync.Mutex
+}
+
+// NewConnectionDrainer creates a ConnectionDrainer without any connections
+func NewConnectionDrainer() *ConnectionDrainer {
+	return &ConnectionDrainer{
+		conns: make(map[net.Conn]*drainedConn),
+	}
+}
+
+// Records the entity a connection has been authenticated as
+func (d *ConnectionDrainer) register(c net.Conn, entityID string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if dc, ok := d.conns[c]; ok {
+		dc.entityID = entityID
+	} else {
+		// Requests are only authenticated while active
+		d.conns[c] = &drainedConn{entityID: entityID, active: true}
+	}
+}
+
+// Whether a connection is waiting to be closed
+func (d *ConnectionDrainer) draining(c net.Conn) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	dc, ok := d.conns[c]
+	return ok && dc.draining
+}
+
+// ConnState should be used as the http.Server's ConnState hook. Draining
+// connections are closed as soon as they become idle.
+func (d *ConnectionDrainer) ConnState(c net.Conn, state http.ConnState) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	dc, ok := d.conns[c]
+
+	switch state {
+	case http.StateActive:
+		if ok {
+			dc.active = true
+		}
+	case http.StateIdle:
+		if ok {
+			dc.active = false
+			if dc.draining {
+				c.Close()
+			}
+		}
+	case http.StateClosed, http.StateHijacked:
+		delete(d.conns, c)
+	}
+}
+
+// Drain closes the connections authenticated as any of entityIDs. Idle
+// connections are closed immediately, others once their current request
+// has been handled. Suitable as a callback for fedtls.OnEntitiesRemoved.
+func (d *ConnectionDrainer) Drain(entityIDs []string) {
+	removed := make(map[string]bool)
+	for _, entityID := range entityIDs {
+		removed[entityID] = true
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for c, dc := range d.conns {
+		if !removed[dc.entityID] || dc.draining {
+			continue
+		}
+
+		dc.draining = true
+		if dc.active {
+			log.Printf("Closing connection from %s (%s) after the current request: entity removed from metadata",
+				c.RemoteAddr(), dc.entityID)
+		} else {
+			log.Printf("Closing idle connection from %s (%s): entity removed from metadata",
+				c.RemoteAddr(), dc.entityID)
+			c.Close()
+		}
+	}
+}
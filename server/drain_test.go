@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+// A connection which only records whether it has been closed
+type closeRecorder struct {
+	net.Conn
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *closeRecorder) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+}
+
+func TestConnectionDrainer(t *testing.T) {
+	d := NewConnectionDrainer()
+
+	idle, active, other := &closeRecorder{}, &closeRecorder{}, &closeRecorder{}
+
+	for _, c := range []*closeRecorder{idle, active, other} {
+		d.ConnState(c, http.StateNew)
+		d.ConnState(c, http.StateActive)
+	}
+
+	d.register(idle, "https://removed.example.com")
+	d.register(active, "https://removed.example.com")
+	d.register(other, "https://other.example.com")
+	d.ConnState(idle, http.StateIdle)
+	d.ConnState(other, http.StateIdle)
+
+	d.Drain([]string{"https://removed.example.com"})
+
+	if !idle.closed {
+		t.Errorf("Idle connection wasn't closed")
+	}
+
+	if active.closed {
+		t.Errorf("Active connection was closed during its request")
+	}
+
+	if !d.draining(active) || d.draining(other) {
+		t.Errorf("Wrong connections are draining")
+	}
+
+	d.ConnState(active, http.StateIdle)
+	if !active.closed {
+		t.Errorf("Draining connection wasn't closed when idle")
+	}
+
+	if other.closed {
+		t.Errorf("Connection of another entity was closed")
+	}
+
+	d.ConnState(idle, http.StateClosed)
+	d.ConnState(active, http.StateClosed)
+	if len(d.conns) != 1 {
+		t.Errorf("Closed connections are still tracked")
+	}
+}
@@ -0,0 +1,259 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joesiltberg/bowness/util"
+)
+
+type handshakeListener struct {
+	net.Listener
+	timeout   time.Duration
+	onFailure func(conn net.Conn, err error)
+
+	conns chan net.Conn
+	errs  chan error
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Accepts connections from the TLS listener and starts their handshakes
+func (l *handshakeListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		go l.handshake(conn)
+	}
+}
+
+func (l *handshakeListener) handshake(conn net.Conn) {
+	tlsConn, ok := conn.(*tls.Conn)
+
+	if ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		if l.timeout > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), l.timeout)
+		}
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+
+		if err != nil {
+			if l.onFailure != nil {
+				l.onFailure(conn, err)
+			}
+			conn.Close()
+			return
+		}
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *handshakeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *handshakeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// HandshakeListener wraps a TLS listener (as created by tls.NewListener) so
+// that the TLS handshake is done before a connection is returned by Accept.
+//
+// Ordinarily handshakes fail inside net/http, where the reason can't be
+// inspected. With this listener onFailure (if not nil) is called with the
+// connection and the error for every failed handshake, and the connection
+// is then closed. Handshakes which haven't completed within timeout fail,
+// a timeout of zero (or less) means none, like for http.Server's timeouts.
+func HandshakeListener(l net.Listener, timeout time.Duration, onFailure func(conn net.Conn, err error)) net.Listener {
+	hl := &handshakeListener{
+		Listener:  l,
+		timeout:   timeout,
+		onFailure: onFailure,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error),
+		done:      make(chan struct{}),
+	}
+
+	go hl.acceptLoop()
+	return hl
+}
+
+// UntrustedCertLogger returns a function, to be used as HandshakeListener's
+// onFailure, which logs handshakes that failed since the client's
+// certificate isn't issued by any trusted issuer. The certificate's
+// subject and issuer are logged, at most once per certificate and interval.
+// onUntrusted (if not nil) is called for every such failure.
+func UntrustedCertLogger(interval time.Duration, onUntrusted func()) func(conn net.Conn, err error) {
+	sampler := newDenialSampler(interval, func(fingerprint string, suppressed int) {
+		log.Printf("%d rejected handshakes with untrusted client certificate %s not logged", suppressed, fingerprint)
+	})
+
+	return func(conn net.Conn, err error) {
+		var verifyErr *tls.CertificateVerificationError
+
+		if !errors.As(err, &verifyErr) || len(verifyErr.UnverifiedCertificates) == 0 {
+			return
+		}
+
+		if onUntrusted != nil {
+			onUntrusted()
+		}
+
+		leaf := verifyErr.UnverifiedCertificates[0]
+		fingerprint := util.Fingerprint(leaf)
+
+		if ok, suppressed := sampler.sample(fingerprint, time.Now()); ok {
+			repeated := ""
+			if suppressed > 0 {
+				repeated = fmt.Sprintf(" (%d similar rejections not logged)", suppressed)
+			}
+			log.Printf("Handshake from %s rejected, client certificate is not trusted (subject: %s, issuer: %s, fingerprint: %s): %v%s",
+				conn.RemoteAddr(), leaf.Subject, leaf.Issuer, fingerprint, verifyErr.Err, repeated)
+		}
+	}
+}
+
+// ClassifyHandshakeError returns a short description of why a handshake
+// failed, suitable as a metric label:
+//
+//   - expired_cert: the client's certificate has expired or isn't valid yet
+//   - untrusted_issuer: the client's certificate isn't issued by a trusted issuer
+//   - invalid_cert: the client's certificate failed verification for another reason
+//   - no_client_cert: the client didn't send a certificate
+//   - protocol_version: no TLS version supported by both sides
+//   - cipher_mismatch: no cipher suite or key exchange supported by both sides
+//   - no_sni: the client didn't send a server name (see TLSRequireSNI)
+//   - client_alert: the client aborted the handshake with an alert
+//   - timeout: the handshake didn't complete in time
+//   - client_closed: the client closed the connection
+//   - not_tls: the client didn't speak TLS
+//   - other: anything else
+func ClassifyHandshakeError(err error) string {
+	var verifyErr *tls.CertificateVerificationError
+	var invalidErr x509.CertificateInvalidError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var recordErr tls.RecordHeaderError
+	var opErr *net.OpError
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &verifyErr):
+		if errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired {
+			return "expired_cert"
+		} else if errors.As(err, &unknownAuthErr) {
+			return "untrusted_issuer"
+		}
+		return "invalid_cert"
+	case errors.Is(err, ErrNoSNI):
+		return "no_sni"
+	case errors.As(err, &recordErr):
+		return "not_tls"
+	case errors.As(err, &opErr) && opErr.Op == "remote error":
+		return "client_alert"
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, net.ErrClosed):
+		return "client_closed"
+	}
+
+	// crypto/tls doesn't have distinct errors for these
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "didn't provide a certificate"):
+		return "no_client_cert"
+	case strings.Contains(msg, "unsupported versions"),
+		strings.Contains(msg, "no mutually supported protocol versions"):
+		return "protocol_version"
+	case strings.Contains(msg, "no cipher suite supported"),
+		strings.Contains(msg, "no key exchanges supported"):
+		return "cipher_mismatch"
+	case strings.Contains(msg, "connection reset by peer"):
+		return "client_closed"
+	}
+	return "other"
+}
+
+// HandshakeFailureLogger returns a function, to be used as
+// HandshakeListener's onFailure, which logs every failed handshake with its
+// class (see ClassifyHandshakeError). Failures are logged at most once per
+// class and client IP address every interval. onFailure (if not nil) is
+// called with the class of every failure.
+func HandshakeFailureLogger(interval time.Duration, onFailure func(class string)) func(conn net.Conn, err error) {
+	return logHandshakeFailures(newDenialSampler(interval, reportHandshakeFailures), onFailure)
+}
+
+// Logs the failures which were suppressed for a class and client IP address
+// which hasn't failed again since
+func reportHandshakeFailures(key string, suppressed int) {
+	class, host, _ := strings.Cut(key, " ")
+	log.Printf("%d failed handshakes from %s (%s) not logged", suppressed, host, class)
+}
+
+func logHandshakeFailures(sampler *denialSampler, onFailure func(class string)) func(conn net.Conn, err error) {
+	return func(conn net.Conn, err error) {
+		class := ClassifyHandshakeError(err)
+
+		if onFailure != nil {
+			onFailure(class)
+		}
+
+		host := conn.RemoteAddr().String()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if ok, suppressed := sampler.sample(class+" "+host, time.Now()); ok {
+			repeated := ""
+			if suppressed > 0 {
+				repeated = fmt.Sprintf(" (%d similar failures not logged)", suppressed)
+			}
+			log.Printf("Handshake from %s failed (%s): %v%s", conn.RemoteAddr(), class, err, repeated)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func toTLSCertificate(c *testCert) tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{c.cert.Raw},
+		PrivateKey:  c.key,
+		Leaf:        c.cert,
+	}
+}
+
+// Connects to l with a client certificate, and reads until the server
+// closes the connection or the handshake fails
+func dialWithCert(t *testing.T, l net.Listener, client *testCert) {
+	cert := toTLSCertificate(client)
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		// Send the certificate even if the server doesn't ask for its issuer
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		},
+	})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	conn.Read(make([]byte, 1))
+}
+
+func TestHandshakeListener(t *testing.T) {
+	root := newTestCert(t, "Root CA", true, nil)
+	other := newTestCert(t, "Other CA", true, nil)
+	trusted := newTestCert(t, "trusted", false, root)
+	untrusted := newTestCert(t, "untrusted", false, other)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(root.cert)
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	tlsListener := tls.NewListener(inner, &tls.Config{
+		Certificates: []tls.Certificate{toTLSCertificate(newTestServerCert(t, root))},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+
+	failures := make(chan error, 1)
+	l := HandshakeListener(tlsListener, 5*time.Second, func(conn net.Conn, err error) {
+		failures <- err
+	})
+	defer l.Close()
+
+	go dialWithCert(t, l, untrusted)
+
+	select {
+	case err := <-failures:
+		var verifyErr *tls.CertificateVerificationError
+		if !errors.As(err, &verifyErr) {
+			t.Fatalf("Expected a certificate verification error, got: %v", err)
+		}
+		if verifyErr.UnverifiedCertificates[0].Subject.CommonName != "untrusted" {
+			t.Errorf("Unexpected certificate in error: %v", verifyErr.UnverifiedCertificates[0].Subject)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the handshake with an untrusted certificate to fail")
+	}
+
+	go dialWithCert(t, l, trusted)
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer conn.Close()
+
+	state := conn.(*tls.Conn).ConnectionState()
+	if !state.HandshakeComplete || len(state.VerifiedChains) == 0 {
+		t.Errorf("Expected a completed handshake with a verified chain")
+	}
+}
+
+// A timeout of 0 means none, rather than failing every handshake
+func TestHandshakeListenerNoTimeout(t *testing.T) {
+	root := newTestCert(t, "Root CA", true, nil)
+	trusted := newTestCert(t, "trusted", false, root)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(root.cert)
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	tlsListener := tls.NewListener(inner, &tls.Config{
+		Certificates: []tls.Certificate{toTLSCertificate(newTestServerCert(t, root))},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+
+	failures := make(chan error, 1)
+	l := HandshakeListener(tlsListener, 0, func(conn net.Conn, err error) {
+		failures <- err
+	})
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go dialWithCert(t, l, trusted)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case err := <-failures:
+		t.Errorf("Handshake failed: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Errorf("Timed out waiting for the connection")
+	}
+}
+
+func TestClassifyHandshakeError(t *testing.T) {
+	root := newTestCert(t, "Root CA", true, nil)
+	other := newTestCert(t, "Other CA", true, nil)
+	trusted := newTestCert(t, "trusted", false, root)
+	untrusted := newTestCert(t, "untrusted", false, other)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(root.cert)
+
+	newConfig := func() *tls.Config {
+		return &tls.Config{
+			Certificates: []tls.Certificate{toTLSCertificate(newTestServerCert(t, root))},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientCAs,
+		}
+	}
+
+	// Runs a handshake with dial as the client, returns the failure's class
+	classify := func(config *tls.Config, dial func(addr string)) string {
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+
+		failures := make(chan string, 1)
+		l := HandshakeListener(tls.NewListener(inner, config), 5*time.Second,
+			HandshakeFailureLogger(time.Minute, func(class string) {
+				failures <- class
+			}))
+		defer l.Close()
+
+		go dial(l.Addr().String())
+
+		select {
+		case class := <-failures:
+			return class
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the handshake to fail")
+		}
+		return ""
+	}
+
+	// Dials with TLS, with a client certificate unless client is nil
+	dialTLS := func(client *testCert, maxVersion uint16) func(string) {
+		return func(addr string) {
+			config := &tls.Config{InsecureSkipVerify: true, MaxVersion: maxVersion}
+			if client != nil {
+				cert := toTLSCertificate(client)
+				config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return &cert, nil
+				}
+			}
+			conn, err := tls.Dial("tcp", addr, config)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			conn.Read(make([]byte, 1))
+		}
+	}
+
+	expired := newConfig()
+	expired.Time = func() time.Time { return time.Now().Add(2 * time.Hour) }
+
+	tls13Only := newConfig()
+	tls13Only.MinVersion = tls.VersionTLS13
+
+	cases := []struct {
+		name     string
+		config   *tls.Config
+		dial     func(string)
+		expected string
+	}{
+		{"untrusted", newConfig(), dialTLS(untrusted, 0), "untrusted_issuer"},
+		{"expired", expired, dialTLS(trusted, 0), "expired_cert"},
+		{"no client cert", newConfig(), dialTLS(nil, 0), "no_client_cert"},
+		{"old client", tls13Only, dialTLS(trusted, tls.VersionTLS12), "protocol_version"},
+		{"plain HTTP", newConfig(), func(addr string) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			conn.Read(make([]byte, 1))
+		}, "not_tls"},
+	}
+
+	for _, c := range cases {
+		if class := classify(c.config, c.dial); class != c.expected {
+			t.Errorf("Expected %s for %s, got %s", c.expected, c.name, class)
+		}
+	}
+
+	if class := ClassifyHandshakeError(ErrNoSNI); class != "no_sni" {
+		t.Errorf("Expected no_sni, got %s", class)
+	}
+}
+
+// A connection which only has a remote address, for failure loggers
+type remoteConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *remoteConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestHandshakeFailureLoggerManyClients(t *testing.T) {
+	const clients = 1000
+	const interval = 50 * time.Millisecond
+
+	var lock sync.Mutex
+	reported := make(map[string]int)
+	sampler := newDenialSampler(interval, func(key string, suppressed int) {
+		lock.Lock()
+		defer lock.Unlock()
+		reported[key] += suppressed
+	})
+	logger := logHandshakeFailures(sampler, nil)
+
+	failure := errors.New("tls: first record does not look like a TLS handshake")
+	for i := 0; i < clients; i++ {
+		conn := &remoteConn{addr: &net.TCPAddr{IP: net.IPv4(10, 0, byte(i/256), byte(i%256)), Port: 4711}}
+		for j := 0; j < 3; j++ {
+			logger(conn, failure)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sampler.lock.Lock()
+		remaining := len(sampler.samples)
+		sampler.lock.Unlock()
+
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Samples for clients which stopped failing weren't forgotten, %d left", remaining)
+		}
+		time.Sleep(interval)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if len(reported) != clients {
+		t.Fatalf("Expected suppressed failures reported for %d clients, got %d", clients, len(reported))
+	}
+	if suppressed := reported["other 10.0.0.1"]; suppressed != 2 {
+		t.Errorf("Expected 2 suppressed failures reported for client, got %d", suppressed)
+	}
+}
@@ -0,0 +1,32 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"net/http"
+)
+
+// HeaderCountLimiter returns a middleware which rejects requests with more
+// than max header lines with 431 Request Header Fields Too Large.
+//
+// The total size of the headers is limited by http.Server's MaxHeaderBytes
+// (which also responds with 431), this limits the number of headers.
+func HeaderCountLimiter(h http.Handler, max int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := 0
+		for _, values := range r.Header {
+			count += len(values)
+		}
+
+		if count > max {
+			http.Error(w, "Too many request headers", http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
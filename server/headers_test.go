@@ -0,0 +1,38 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeaderCountLimiter(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := HeaderCountLimiter(ok, 3)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Add("A", "1")
+	r.Header.Add("A", "2")
+	r.Header.Add("B", "3")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 at the limit, got %d", rec.Code)
+	}
+
+	r.Header.Add("B", "4")
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Expected 431 above the limit, got %d", rec.Code)
+	}
+}
@@ -8,37 +8,166 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"sort"
 	"sync"
 
 	"golang.org/x/time/rate"
 )
 
-// Limiter returns a middleware with token bucket rate limiting applied per entityID
-func Limiter(h http.Handler, r rate.Limit, b int) http.Handler {
+// A PathCost sets how many tokens a request to a path costs, rather than the
+// default of 1. It applies to Prefix and all paths below it.
+type PathCost struct {
+	Prefix string
+	Cost   int
+}
 
-	limiters := make(map[string]*rate.Limiter)
-	var lock sync.Mutex
+// CheckPathCosts returns an error if any of the costs is negative, or
+// higher than the burst size b (such requests would always be rejected)
+func CheckPathCosts(costs []PathCost, b int) error {
+	for _, c := range costs {
+		if c.Cost < 0 {
+			return fmt.Errorf("Negative cost (%d) for path %s", c.Cost, c.Prefix)
+		}
+		if c.Cost > b {
+			return fmt.Errorf("Cost (%d) for path %s is higher than the burst size (%d)", c.Cost, c.Prefix, b)
+		}
+	}
+	return nil
+}
 
-	getLimiter := func(entity string) *rate.Limiter {
-		lock.Lock()
-		defer lock.Unlock()
+// Returns the cost of a request, from the PathCost with the longest matching
+// prefix (or 1 if none matches). The prefixes match whole path segments, and
+// are normalized with normalize.
+func requestCost(costs []PathCost, path string, normalize func(string) string) int {
+	cost, longest := 1, -1
 
-		if limiter, ok := limiters[entity]; ok {
-			return limiter
+	for _, c := range costs {
+		prefix := normalize(c.Prefix)
+		if hasPathPrefix(path, prefix) && len(prefix) > longest {
+			cost, longest = c.Cost, len(prefix)
 		}
-		limiter := rate.NewLimiter(r, b)
-		limiters[entity] = limiter
+	}
+	return cost
+}
+
+// Limiter returns a middleware with token bucket rate limiting applied per entityID
+//
+// Requests cost one token each, unless costs says otherwise for the request's
+// path. Note that requests costing more than the burst size will always
+// be rejected, check the costs with CheckPathCosts first.
+func Limiter(h http.Handler, r rate.Limit, b int, costs ...PathCost) http.Handler {
+	return LimiterWithContext(context.Background(), h, r, b, costs...)
+}
+
+// LimiterWithContext is like Limiter, but requests waiting for tokens are
+// released with 503 Service Unavailable as soon as ctx is done.
+//
+// The request's own context is only cancelled when the client goes away, so
+// without this a graceful shutdown would have to wait for all requests
+// queued in the limiter. Cancel ctx when shutdown begins.
+func LimiterWithContext(ctx context.Context, h http.Handler, r rate.Limit, b int, costs ...PathCost) http.Handler {
+	return NewEntityLimiter(ctx, h, r, b, costs...)
+}
+
+// An EntityLimiter is a middleware with a token bucket per entity ID,
+// see LimiterWithContext. Unlike the http.Handler returned by
+// LimiterWithContext it can also report the state of its token buckets.
+type EntityLimiter struct {
+	h     http.Handler
+	ctx   context.Context
+	limit rate.Limit
+	burst int
+	costs []PathCost
+
+	limiters map[string]*rate.Limiter
+	lock     sync.Mutex
+}
+
+// NewEntityLimiter creates an EntityLimiter, the parameters are the same as
+// for LimiterWithContext
+func NewEntityLimiter(ctx context.Context, h http.Handler, r rate.Limit, b int, costs ...PathCost) *EntityLimiter {
+	return &EntityLimiter{
+		h:        h,
+		ctx:      ctx,
+		limit:    r,
+		burst:    b,
+		costs:    costs,
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+func (l *EntityLimiter) getLimiter(entity string) *rate.Limiter {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if limiter, ok := l.limiters[entity]; ok {
 		return limiter
 	}
+	limiter := rate.NewLimiter(l.limit, l.burst)
+	l.limiters[entity] = limiter
+	return limiter
+}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		limiter := getLimiter(EntityIDFromContext(r.Context()))
+func (l *EntityLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	limiter := l.getLimiter(EntityIDFromContext(r.Context()))
+
+	waitCtx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stop := context.AfterFunc(l.ctx, cancel)
+	defer stop()
 
-		if limiter.Wait(r.Context()) != nil {
+	path, normalize := matchingPath(r)
+	if limiter.WaitN(waitCtx, requestCost(l.costs, path, normalize)) != nil {
+		if l.ctx.Err() != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
 			w.WriteHeader(http.StatusTooManyRequests)
-			return
 		}
-		h.ServeHTTP(w, r)
+		return
+	}
+	l.h.ServeHTTP(w, r)
+}
+
+// LimiterState is the state of one entity's token bucket
+type LimiterState struct {
+	EntityID string `json:"entity_id"`
+
+	// Tokens currently available, negative if requests are waiting
+	Tokens float64 `json:"tokens"`
+
+	Limit float64 `json:"limit"`
+	Burst int     `json:"burst"`
+}
+
+// Snapshot returns the state of the token bucket of every entity which
+// has made requests, sorted by entity ID
+func (l *EntityLimiter) Snapshot() []LimiterState {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	states := make([]LimiterState, 0, len(l.limiters))
+	for entityID, limiter := range l.limiters {
+		states = append(states, LimiterState{
+			EntityID: entityID,
+			Tokens:   limiter.Tokens(),
+			Limit:    float64(limiter.Limit()),
+			Burst:    limiter.Burst(),
+		})
+	}
+
+	sort.Slice(states, func(i, j int) bool { return states[i].EntityID < states[j].EntityID })
+	return states
+}
+
+// LimiterStateHandler serves the state of an EntityLimiter's token buckets
+// as JSON, meant for an admin listener
+func LimiterStateHandler(l *EntityLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(l.Snapshot())
 	})
 }
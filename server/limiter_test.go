@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestRequestCost(t *testing.T) {
+	costs := []PathCost{
+		{Prefix: "/export", Cost: 10},
+		{Prefix: "/export/small", Cost: 2},
+		{Prefix: "/ping", Cost: 0},
+	}
+
+	cases := map[string]int{
+		"/":                  1,
+		"/export":            10,
+		"/export/all":        10,
+		"/export/small/file": 2,
+		"/ping":              0,
+		"/pingpong":          1,
+		"/exports":           1,
+		"//export/all":       10,
+	}
+
+	for path, want := range cases {
+		if got := requestCost(costs, path, noNormalization); got != want {
+			t.Errorf("%s: got cost %d, want %d", path, got, want)
+		}
+	}
+}
+
+func TestCheckPathCosts(t *testing.T) {
+	if err := CheckPathCosts([]PathCost{{Prefix: "/a", Cost: 0}, {Prefix: "/b", Cost: 5}}, 5); err != nil {
+		t.Errorf("Valid costs rejected: %v", err)
+	}
+	if err := CheckPathCosts([]PathCost{{Prefix: "/a", Cost: -1}}, 5); err == nil {
+		t.Errorf("Negative cost accepted")
+	}
+	if err := CheckPathCosts([]PathCost{{Prefix: "/a", Cost: 6}}, 5); err == nil {
+		t.Errorf("Cost higher than the burst size accepted")
+	}
+}
+
+// A request from an authenticated entity, as after the auth middleware
+func newEntityRequest(entityID, path string) *http.Request {
+	r := httptest.NewRequest("GET", path, nil)
+	return r.WithContext(context.WithValue(r.Context(), entityIDKey, entityID))
+}
+
+func TestLimiterReleasedOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := LimiterWithContext(ctx, ok, rate.Every(time.Hour), 1)
+
+	// Uses up the burst
+	h.ServeHTTP(httptest.NewRecorder(), newEntityRequest("https://example.com", "/"))
+
+	done := make(chan int)
+	rec := httptest.NewRecorder()
+	go func() {
+		h.ServeHTTP(rec, newEntityRequest("https://example.com", "/"))
+		close(done)
+	}()
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Queued request wasn't released on shutdown")
+	}
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %d", rec.Code)
+	}
+}
+
+func TestLimiterSnapshot(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	l := NewEntityLimiter(context.Background(), ok, rate.Every(time.Hour), 5,
+		PathCost{Prefix: "/expensive", Cost: 3})
+
+	l.ServeHTTP(httptest.NewRecorder(), newEntityRequest("https://b.example.com", "/"))
+	l.ServeHTTP(httptest.NewRecorder(), newEntityRequest("https://a.example.com", "/expensive"))
+
+	states := l.Snapshot()
+
+	if len(states) != 2 || states[0].EntityID != "https://a.example.com" || states[1].EntityID != "https://b.example.com" {
+		t.Fatalf("Unexpected snapshot: %+v", states)
+	}
+
+	if states[0].Tokens < 1.9 || states[0].Tokens > 2.1 || states[1].Tokens < 3.9 || states[1].Tokens > 4.1 {
+		t.Errorf("Unexpected token levels: %+v", states)
+	}
+
+	if states[0].Burst != 5 {
+		t.Errorf("Unexpected burst: %d", states[0].Burst)
+	}
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// A connection which is closed when its maximum lifetime has passed, or
+// once it's idle if it's handling a request at that point
+type lifetimeConn struct {
+	net.Conn
+	timer *time.Timer
+
+	// Protects active and expired
+	lock sync.Mutex
+
+	// Whether a request is being handled (see LifetimeConnState)
+	active bool
+
+	// Whether the maximum lifetime has passed
+	expired bool
+}
+
+func (c *lifetimeConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+// Called when the maximum lifetime has passed
+func (c *lifetimeConn) expire() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.expired = true
+	if !c.active {
+		c.Conn.Close()
+	}
+}
+
+func (c *lifetimeConn) setActive(active bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.active = active
+	if !active && c.expired {
+		c.Conn.Close()
+	}
+}
+
+type lifetimeListener struct {
+	net.Listener
+	maxLifetime time.Duration
+}
+
+func (l *lifetimeListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+
+	if err != nil {
+		return nil, err
+	}
+
+	lc := &lifetimeConn{Conn: conn}
+	lc.timer = time.AfterFunc(l.maxLifetime, lc.expire)
+	return lc, nil
+}
+
+// LifetimeListener wraps a listener so that accepted connections are closed
+// once they've been open for maxLifetime. A connection which is handling a
+// request at that point is closed once the request is done, provided that
+// LifetimeConnState is called from the http.Server's ConnState hook
+// (otherwise connections are closed regardless of activity).
+//
+// It should wrap the TCP listener, before TLS is added with tls.NewListener.
+func LifetimeListener(l net.Listener, maxLifetime time.Duration) net.Listener {
+	return &lifetimeListener{
+		Listener:    l,
+		maxLifetime: maxLifetime,
+	}
+}
+
+// LifetimeConnState should be used as (or called from) the http.Server's
+// ConnState hook when LifetimeListener is used, so that connections aren't
+// closed in the middle of a request.
+func LifetimeConnState(c net.Conn, state http.ConnState) {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		c = tlsConn.NetConn()
+	}
+
+	lc, ok := c.(*lifetimeConn)
+	if !ok {
+		return
+	}
+
+	switch state {
+	case http.StateActive:
+		lc.setActive(true)
+	case http.StateIdle:
+		lc.setActive(false)
+	}
+}
+
+type keepAliveListener struct {
+	net.Listener
+	period time.Duration
+}
+
+func (l *keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if l.period > 0 {
+			tcpConn.SetKeepAlive(true)
+			tcpConn.SetKeepAlivePeriod(l.period)
+		} else {
+			tcpConn.SetKeepAlive(false)
+		}
+	}
+	return conn, nil
+}
+
+// KeepAliveListener wraps a TCP listener so that TCP keep-alive probes are
+// sent every period on accepted connections, which makes it possible to
+// detect dead peers sooner. A period of 0 disables keep-alive.
+//
+// It should wrap the TCP listener directly, before any other wrapping.
+func KeepAliveListener(l net.Listener, period time.Duration) net.Listener {
+	return &keepAliveListener{
+		Listener: l,
+		period:   period,
+	}
+}
+
+type acceptRateListener struct {
+	net.Listener
+	limiter *rate.Limiter
+	drop    bool
+	onDrop  func()
+}
+
+func (l *acceptRateListener) Accept() (net.Conn, error) {
+	for {
+		if !l.drop {
+			// Leave excess connections in the kernel's backlog until
+			// we're ready for them. Waiting can only fail if burst is
+			// below 1, then no connection could ever be accepted.
+			if err := l.limiter.Wait(context.Background()); err != nil {
+				return nil, fmt.Errorf("Accept rate limit: %v", err)
+			}
+		}
+
+		conn, err := l.Listener.Accept()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !l.drop || l.limiter.Allow() {
+			return conn, nil
+		}
+
+		conn.Close()
+		if l.onDrop != nil {
+			l.onDrop()
+		}
+	}
+}
+
+// AcceptRateListener wraps a listener so that at most limit new connections
+// per second (with bursts of up to burst connections) are accepted. This
+// protects the CPU spent on TLS handshakes, which happen before any
+// request level limiting.
+//
+// If drop is false, excess connections are left waiting to be accepted.
+// If drop is true they're closed immediately, and onDrop (if not nil) is
+// called for each closed connection. burst must be at least 1.
+func AcceptRateListener(l net.Listener, limit rate.Limit, burst int, drop bool, onDrop func()) net.Listener {
+	return &acceptRateListener{
+		Listener: l,
+		limiter:  rate.NewLimiter(limit, burst),
+		drop:     drop,
+		onDrop:   onDrop,
+	}
+}
+
+type sourceRateListener struct {
+	net.Listener
+	limit  rate.Limit
+	burst  int
+	onDrop func(addr net.Addr)
+
+	// Only used from Accept, which isn't called concurrently by net/http
+	limiters    map[string]*rate.Limiter
+	lastCleanup time.Time
+}
+
+// How often limiters which are full again are forgotten
+const sourceLimiterCleanupInterval = 1 * time.Minute
+
+func (l *sourceRateListener) allow(conn net.Conn, now time.Time) bool {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		host = conn.RemoteAddr().String()
+	}
+
+	if now.Sub(l.lastCleanup) > sourceLimiterCleanupInterval {
+		for source, limiter := range l.limiters {
+			if limiter.TokensAt(now) >= float64(l.burst) {
+				delete(l.limiters, source)
+			}
+		}
+		l.lastCleanup = now
+	}
+
+	limiter, ok := l.limiters[host]
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[host] = limiter
+	}
+	return limiter.AllowN(now, 1)
+}
+
+func (l *sourceRateListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if l.allow(conn, time.Now()) {
+			return conn, nil
+		}
+
+		if l.onDrop != nil {
+			l.onDrop(conn.RemoteAddr())
+		}
+		conn.Close()
+	}
+}
+
+// SourceRateListener wraps a listener so that each source IP address may
+// open at most limit new connections per second (with bursts of up to
+// burst connections). Excess connections are closed before the TLS
+// handshake, which protects against a single address flooding the
+// handshake path without ever authenticating. onDrop (if not nil) is
+// called for each closed connection.
+//
+// The source is the connection's RemoteAddr. Bowness doesn't implement the
+// PROXY protocol, so behind a load balancer this is the load balancer's
+// address. An application with a listener of its own handling the PROXY
+// protocol should wrap it with this one. burst must be at least 1.
+func SourceRateListener(l net.Listener, limit rate.Limit, burst int, onDrop func(addr net.Addr)) net.Listener {
+	return &sourceRateListener{
+		Listener:    l,
+		limit:       limit,
+		burst:       burst,
+		onDrop:      onDrop,
+		limiters:    make(map[string]*rate.Limiter),
+		lastCleanup: time.Now(),
+	}
+}
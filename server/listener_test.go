@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// A connection whose lifetime passes during a request is closed once the
+// response has been sent, idle connections are closed right away
+func TestLifetimeListener(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Write([]byte("done"))
+	}))
+	srv.Listener = LifetimeListener(srv.Listener, 100*time.Millisecond)
+	srv.Config.ConnState = LifetimeConnState
+	srv.Start()
+	defer srv.Close()
+
+	client := srv.Client()
+	get := func(path string) bool {
+		t.Helper()
+
+		reused := false
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+		}
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		resp, err := client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+		if err != nil {
+			t.Fatalf("Request to %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil || string(body) != "done" {
+			t.Fatalf("Unexpected response from %s: %q (%v)", path, body, err)
+		}
+		return reused
+	}
+
+	get("/slow")
+	time.Sleep(50 * time.Millisecond)
+	if get("/") {
+		t.Errorf("Connection was reused after its lifetime had passed")
+	}
+
+	// Before the lifetime has passed the connection is kept
+	if !get("/") {
+		t.Errorf("Connection wasn't reused within its lifetime")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if get("/") {
+		t.Errorf("Idle connection was reused after its lifetime had passed")
+	}
+}
+
+func TestAcceptRateListenerDrop(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	dropped := make(chan struct{}, 10)
+	l = AcceptRateListener(l, rate.Every(time.Hour), 1, true, func() { dropped <- struct{}{} })
+	defer l.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	select {
+	case <-dropped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the second connection to be dropped")
+	}
+}
+
+// With a burst below 1 no connection could ever be accepted, which is
+// reported instead of silently accepting everything
+func TestAcceptRateListenerNoBurst(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	l = AcceptRateListener(l, rate.Every(time.Second), 0, false, nil)
+	defer l.Close()
+
+	if conn, err := l.Accept(); err == nil {
+		conn.Close()
+		t.Errorf("Accept succeeded with a burst of 0")
+	}
+}
+
+func TestSourceRateListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	dropped := make(chan net.Addr, 10)
+	l = SourceRateListener(l, rate.Every(time.Hour), 2, func(addr net.Addr) { dropped <- addr })
+	defer l.Close()
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+	}
+
+	accepted := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			accepted <- struct{}{}
+		}
+	}()
+
+	select {
+	case addr := <-dropped:
+		if host, _, _ := net.SplitHostPort(addr.String()); host != "127.0.0.1" {
+			t.Errorf("Unexpected source of dropped connection: %v", addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the third connection to be dropped")
+	}
+
+	if len(accepted) != 2 {
+		t.Errorf("Expected 2 accepted connections, got %d", len(accepted))
+	}
+}
@@ -0,0 +1,72 @@
+//go:build unix
+
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Whether SO_KEEPALIVE is set on a connection's socket
+func keepAliveEnabled(t *testing.T, conn net.Conn) bool {
+	t.Helper()
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		t.Fatalf("Expected a TCP connection, got %T", conn)
+	}
+
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		t.Fatalf("Failed to get the raw connection: %v", err)
+	}
+
+	var value int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		t.Fatalf("Failed to read SO_KEEPALIVE: %v", err)
+	}
+	return value != 0
+}
+
+func TestKeepAliveListener(t *testing.T) {
+	for _, period := range []time.Duration{time.Second, 0} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		l = KeepAliveListener(l, period)
+		defer l.Close()
+
+		go func() {
+			if conn, err := net.Dial("tcp", l.Addr().String()); err == nil {
+				conn.Close()
+			}
+		}()
+
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatalf("Failed to accept: %v", err)
+		}
+		defer conn.Close()
+
+		if enabled := keepAliveEnabled(t, conn); enabled != (period > 0) {
+			t.Errorf("Period %v: expected keep-alive %t, got %t", period, period > 0, enabled)
+		}
+	}
+}
@@ -10,9 +10,13 @@ package server
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/joesiltberg/bowness/fedtls"
+	"github.com/joesiltberg/bowness/util"
 )
 
 // The MetadataTLSConfigManager creates and manages a tls.Config which can
@@ -20,52 +24,250 @@ import (
 // as a MetadataStore fetches new metadata from the federation operator.
 type MetadataTLSConfigManager struct {
 	tlsConfigManager *TLSConfigManager
+
+	// Issuer certificates parsed in the latest trust update
+	certCache certCache
+
+	// The issuer certificates currently trusted, per entity, protected by
+	// issuersLock
+	issuers     map[string][]IssuerInfo
+	issuersLock sync.Mutex
+}
+
+// IssuerInfo describes a trusted issuer certificate
+type IssuerInfo struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+
+	// SHA256 fingerprint of the Subject Public Key Info (base64 encoded)
+	SPKIFingerprint string `json:"spki_fingerprint"`
 }
 
-func buildCertPool(issuers fedtls.IssuersPerEntity) *x509.CertPool {
+// The trust anchors of issuers (see trustAnchors) keyed by their PEM data,
+// so that issuers which haven't changed don't need to be parsed again when
+// metadata is refreshed
+type certCache map[string][]*x509.Certificate
+
+// Parses all certificates in a PEM string, in the order they appear.
+// Blocks which fail to parse are logged and skipped.
+func parseCertificates(entityID, pemData string) []*x509.Certificate {
+	var certs []*x509.Certificate
+	rest := []byte(pemData)
+
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+
+		if err != nil {
+			log.Printf("Failed to parse issuer certificate for %s: %v", entityID, err)
+			continue
+		}
+		certs = append(certs, cert)
+	}
+	return certs
+}
+
+// Returns the certificates of an issuer's PEM data which are trust
+// anchors: those that didn't issue any of the others. An issuer may be an
+// intermediate CA followed by the rest of its chain (in either order), only
+// the intermediate is trusted then. Otherwise every certificate the root
+// has issued (such as other members' intermediates) would be trusted as
+// well. Unrelated certificates in the same PEM data are all trusted.
+func trustAnchors(chain []*x509.Certificate) []*x509.Certificate {
+	var anchors []*x509.Certificate
+
+	for _, c := range chain {
+		issuedOther := false
+		for _, other := range chain {
+			if other != c && !other.Equal(c) && other.CheckSignatureFrom(c) == nil {
+				issuedOther = true
+				break
+			}
+		}
+		if !issuedOther {
+			anchors = append(anchors, c)
+		}
+	}
+	return anchors
+}
+
+// Builds the pool of client certificate authorities from the issuers in metadata.
+//
+// crypto/tls uses every certificate in ClientCAs as a trust anchor, so only
+// the certificates of an issuer which are anchors (see trustAnchors) are
+// added, in the order given. A client's leaf issued by a registered
+// intermediate verifies whether the client sends the intermediate or not,
+// and a client sending its chain up to a registered root verifies too.
+//
+// Certificates found in cache aren't parsed again. The returned cache contains
+// the certificates for the current issuers only, so issuers which are no
+// longer present are dropped.
+func buildCertPool(issuers fedtls.IssuersPerEntity, cache certCache) (*x509.CertPool, certCache) {
 	pool := x509.NewCertPool()
+	newCache := make(certCache)
 
-	for issuer, certs := range issuers {
+	for entityID, certs := range issuers {
 		for _, cert := range certs {
-			ok := pool.AppendCertsFromPEM([]byte(cert.X509certificate))
-
+			anchors, ok := cache[cert.X509certificate]
 			if !ok {
-				log.Printf("Failed to add any certificates for issuer %s", issuer)
+				anchors = trustAnchors(parseCertificates(entityID, cert.X509certificate))
+			}
+			newCache[cert.X509certificate] = anchors
+
+			if len(anchors) == 0 {
+				log.Printf("Failed to add any certificates for issuer %s", entityID)
+			}
+
+			for _, c := range anchors {
+				pool.AddCert(c)
+			}
+		}
+	}
+	return pool, newCache
+}
+
+// Describes the certificates each entity contributed to the trust pool,
+// entities without any usable certificates are left out
+func describeIssuers(issuers fedtls.IssuersPerEntity, cache certCache) map[string][]IssuerInfo {
+	result := make(map[string][]IssuerInfo)
+
+	for entityID, certs := range issuers {
+		for _, cert := range certs {
+			for _, c := range cache[cert.X509certificate] {
+				result[entityID] = append(result[entityID], IssuerInfo{
+					Subject:         c.Subject.String(),
+					Issuer:          c.Issuer.String(),
+					NotBefore:       c.NotBefore.UTC(),
+					NotAfter:        c.NotAfter.UTC(),
+					SPKIFingerprint: util.Fingerprint(c),
+				})
 			}
 		}
 	}
-	return pool
+	return result
+}
+
+// Counts the issuers which contributed at least one certificate
+func (cache certCache) trustedIssuers() int {
+	count := 0
+	for _, chain := range cache {
+		if len(chain) > 0 {
+			count++
+		}
+	}
+	return count
 }
 
-func updateTrust(mdstore *fedtls.MetadataStore, tlsConfigManager *TLSConfigManager) {
-	certPool := buildCertPool(mdstore.GetIssuerCertificates())
-	tlsConfigManager.SetTrusted(certPool)
+func (mgr *MetadataTLSConfigManager) updateTrust(mdstore *fedtls.MetadataStore) {
+	if !mdstore.Status().Loaded {
+		// Nothing to trust yet, and nothing to keep
+		return
+	}
+
+	issuers := mdstore.GetIssuerCertificates()
+	certPool, cache := buildCertPool(issuers, mgr.certCache)
+	options := mgr.tlsConfigManager.options
+
+	if issuers := cache.trustedIssuers(); issuers < options.MinTrustedIssuers {
+		// Replacing a working trust set with an empty (or almost empty) one
+		// would reject every client, that's more likely a problem with the
+		// metadata than something intended.
+		log.Printf("ERROR: New metadata only has %d usable issuer(s), minimum is %d. "+
+			"Keeping the previously trusted issuers.", issuers, options.MinTrustedIssuers)
+		if options.OnTrustUpdateRejected != nil {
+			options.OnTrustUpdateRejected(issuers)
+		}
+		return
+	}
+
+	mgr.certCache = cache
+	mgr.tlsConfigManager.SetTrusted(certPool)
+
+	mgr.issuersLock.Lock()
+	mgr.issuers = describeIssuers(issuers, cache)
+	mgr.issuersLock.Unlock()
+}
+
+// TrustedIssuers returns the issuer certificates currently trusted, per
+// entity ID. This is the trust actually in force, so if a metadata update
+// was rejected (see TLSMinTrustedIssuers) the previous issuers are returned.
+// An issuer given with its chain is only listed with the certificates which
+// are trust anchors (the intermediate, not the root above it).
+func (mdTLSConfigManager *MetadataTLSConfigManager) TrustedIssuers() map[string][]IssuerInfo {
+	mdTLSConfigManager.issuersLock.Lock()
+	defer mdTLSConfigManager.issuersLock.Unlock()
+
+	result := make(map[string][]IssuerInfo, len(mdTLSConfigManager.issuers))
+	for entityID, issuers := range mdTLSConfigManager.issuers {
+		result[entityID] = append([]IssuerInfo(nil), issuers...)
+	}
+	return result
 }
 
 // NewMetadataTLSConfigManager creates a new TLS config manager connected to a MetadataStore.
 // The config manager will listen to changes from the metadata store and hot-swap the CA store.
-func NewMetadataTLSConfigManager(certFile, keyFile string, mdstore *fedtls.MetadataStore) (*MetadataTLSConfigManager, error) {
-	tlsConfigManager, err := NewTLSConfigManager(certFile, keyFile)
+func NewMetadataTLSConfigManager(certFile, keyFile string, mdstore *fedtls.MetadataStore, setters ...TLSOptionSetter) (*MetadataTLSConfigManager, error) {
+	tlsConfigManager, err := NewTLSConfigManager(certFile, keyFile, setters...)
 
 	if err != nil {
 		return nil, err
 	}
 
+	mgr := &MetadataTLSConfigManager{
+		tlsConfigManager: tlsConfigManager,
+	}
+
 	metadataChange := make(chan int)
 	mdstore.AddChangeListener(metadataChange)
-	updateTrust(mdstore, tlsConfigManager)
+	mgr.updateTrust(mdstore)
 
 	go func() {
 		for {
 			<-metadataChange
-			updateTrust(mdstore, tlsConfigManager)
+			mgr.updateTrust(mdstore)
 			log.Println("New metadata loaded")
 		}
 	}()
 
-	return &MetadataTLSConfigManager{
-		tlsConfigManager: tlsConfigManager,
-	}, nil
+	return mgr, nil
+}
+
+// PinVerifier returns a function suitable for TLSVerifyConnection which
+// rejects clients without a matching client pin in metadata already during
+// the TLS handshake.
+//
+// This saves resources when under attack from unauthorized clients, but
+// such clients will only see a failed handshake rather than an HTTP error
+// explaining why they were rejected.
+func PinVerifier(mdstore *fedtls.MetadataStore) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		_, _, _, err := mdstore.LookupClient(cs.VerifiedChains)
+		return err
+	}
+}
+
+// SetSessionTicketKeys replaces the keys used for TLS session tickets,
+// see TLSConfigManager.SetSessionTicketKeys
+func (mdTLSConfigManager *MetadataTLSConfigManager) SetSessionTicketKeys(keys [][32]byte) {
+	mdTLSConfigManager.tlsConfigManager.SetSessionTicketKeys(keys)
+}
+
+// Summary describes the effective TLS configuration, see
+// TLSConfigManager.Summary
+func (mdTLSConfigManager *MetadataTLSConfigManager) Summary() string {
+	return mdTLSConfigManager.tlsConfigManager.Summary()
 }
 
 // Config returns a tls.Config which can be used by a TLS listener.
@@ -0,0 +1,318 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/joesiltberg/bowness/fedtls"
+	"github.com/joesiltberg/bowness/util"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// Creates a certificate signed by parent, or a self-signed CA if parent is nil
+func newTestCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("Failed to generate serial: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+
+	return &testCert{cert: cert, key: key}
+}
+
+func toPEM(certs ...*testCert) string {
+	var result []byte
+	for _, c := range certs {
+		result = append(result, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})...)
+	}
+	return string(result)
+}
+
+// Verifies a client's chain the same way crypto/tls does for client certificates
+func verifyClient(pool *x509.CertPool, leaf *testCert, intermediates ...*testCert) error {
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	for _, i := range intermediates {
+		opts.Intermediates.AddCert(i.cert)
+	}
+
+	_, err := leaf.cert.Verify(opts)
+	return err
+}
+
+func TestIntermediateIssuers(t *testing.T) {
+	root := newTestCert(t, "Root CA", true, nil)
+	intermediate := newTestCert(t, "Intermediate CA", true, root)
+	leaf := newTestCert(t, "client", false, intermediate)
+
+	cases := []struct {
+		name          string
+		issuer        string
+		intermediates []*testCert
+	}{
+		{"intermediate only", toPEM(intermediate), nil},
+		{"intermediate with chain", toPEM(intermediate, root), nil},
+		{"chain from the root", toPEM(root, intermediate), nil},
+		{"root with client sending intermediate", toPEM(root), []*testCert{intermediate}},
+	}
+
+	for _, c := range cases {
+		pool, _ := buildCertPool(fedtls.IssuersPerEntity{
+			"https://example.com": []fedtls.Issuer{{X509certificate: c.issuer}},
+		}, nil)
+
+		if err := verifyClient(pool, leaf, c.intermediates...); err != nil {
+			t.Errorf("%s: failed to verify client: %v", c.name, err)
+		}
+	}
+}
+
+// An issuer registered with its chain must not make the root a trust
+// anchor, that would trust everything else the root has issued
+func TestIssuerChainNotTrusted(t *testing.T) {
+	root := newTestCert(t, "Root CA", true, nil)
+	registered := newTestCert(t, "Registered CA", true, root)
+	other := newTestCert(t, "Other CA", true, root)
+	leaf := newTestCert(t, "client", false, other)
+
+	pool, _ := buildCertPool(fedtls.IssuersPerEntity{
+		"https://example.com": []fedtls.Issuer{{X509certificate: toPEM(registered, root)}},
+	}, nil)
+
+	if err := verifyClient(pool, leaf, other); err == nil {
+		t.Errorf("Client of another intermediate under the same root verified")
+	}
+}
+
+func TestUnrelatedIssuer(t *testing.T) {
+	root := newTestCert(t, "Root CA", true, nil)
+	other := newTestCert(t, "Other CA", true, nil)
+	leaf := newTestCert(t, "client", false, root)
+
+	pool, _ := buildCertPool(fedtls.IssuersPerEntity{
+		"https://example.com": []fedtls.Issuer{{X509certificate: toPEM(other)}},
+	}, nil)
+
+	if err := verifyClient(pool, leaf); err == nil {
+		t.Errorf("Client verified against unrelated issuer")
+	}
+}
+
+func TestCertCache(t *testing.T) {
+	a := newTestCert(t, "A", true, nil)
+	b := newTestCert(t, "B", true, nil)
+
+	_, cache := buildCertPool(fedtls.IssuersPerEntity{
+		"https://a.example.com": []fedtls.Issuer{{X509certificate: toPEM(a)}},
+		"https://b.example.com": []fedtls.Issuer{{X509certificate: toPEM(b)}},
+	}, nil)
+
+	cachedA := cache[toPEM(a)]
+	if len(cachedA) != 1 {
+		t.Fatalf("Expected A to be cached")
+	}
+
+	_, cache = buildCertPool(fedtls.IssuersPerEntity{
+		"https://a.example.com": []fedtls.Issuer{{X509certificate: toPEM(a)}},
+	}, cache)
+
+	if cache[toPEM(a)][0] != cachedA[0] {
+		t.Errorf("Unchanged issuer was parsed again")
+	}
+
+	if _, ok := cache[toPEM(b)]; ok {
+		t.Errorf("Removed issuer is still cached")
+	}
+}
+
+func TestTrustedIssuers(t *testing.T) {
+	a := newTestCert(t, "A", true, nil)
+
+	_, cache := buildCertPool(fedtls.IssuersPerEntity{
+		"https://a.example.com": []fedtls.Issuer{{X509certificate: toPEM(a)}},
+		"https://b.example.com": []fedtls.Issuer{{X509certificate: "not a certificate"}},
+	}, nil)
+
+	if n := cache.trustedIssuers(); n != 1 {
+		t.Errorf("Expected 1 trusted issuer, got %d", n)
+	}
+
+	_, cache = buildCertPool(fedtls.IssuersPerEntity{}, nil)
+
+	if n := cache.trustedIssuers(); n != 0 {
+		t.Errorf("Expected no trusted issuers, got %d", n)
+	}
+}
+
+// During issuer rotation an entity lists both its old and new issuer,
+// clients with a leaf from either must be accepted
+func TestIssuerRotation(t *testing.T) {
+	oldIssuer := newTestCert(t, "Old CA", true, nil)
+	newIssuer := newTestCert(t, "New CA", true, nil)
+	oldLeaf := newTestCert(t, "client", false, oldIssuer)
+	newLeaf := newTestCert(t, "client", false, newIssuer)
+
+	pool, _ := buildCertPool(fedtls.IssuersPerEntity{
+		"https://example.com": []fedtls.Issuer{
+			{X509certificate: toPEM(oldIssuer)},
+			{X509certificate: toPEM(newIssuer)},
+		},
+	}, nil)
+
+	if err := verifyClient(pool, oldLeaf); err != nil {
+		t.Errorf("Client with leaf from old issuer rejected: %v", err)
+	}
+
+	if err := verifyClient(pool, newLeaf); err != nil {
+		t.Errorf("Client with leaf from new issuer rejected: %v", err)
+	}
+}
+
+func TestDescribeIssuers(t *testing.T) {
+	root := newTestCert(t, "Root CA", true, nil)
+	intermediate := newTestCert(t, "Intermediate CA", true, root)
+
+	issuers := fedtls.IssuersPerEntity{
+		"https://a.example.com": []fedtls.Issuer{{X509certificate: toPEM(intermediate, root)}},
+		"https://b.example.com": []fedtls.Issuer{{X509certificate: "not a certificate"}},
+	}
+	_, cache := buildCertPool(issuers, nil)
+
+	described := describeIssuers(issuers, cache)
+
+	if _, ok := described["https://b.example.com"]; ok {
+		t.Errorf("Entity without usable issuers should be left out")
+	}
+
+	a := described["https://a.example.com"]
+	if len(a) != 1 {
+		t.Fatalf("Expected only the intermediate of the chain, got %d", len(a))
+	}
+
+	shouldEqual := func(expected, actual string) {
+		if expected != actual {
+			t.Errorf("Expected %s, got %s", expected, actual)
+		}
+	}
+
+	shouldEqual("CN=Intermediate CA", a[0].Subject)
+	shouldEqual("CN=Root CA", a[0].Issuer)
+	shouldEqual(util.Fingerprint(intermediate.cert), a[0].SPKIFingerprint)
+
+	if !a[0].NotAfter.Equal(intermediate.cert.NotAfter) {
+		t.Errorf("Wrong NotAfter: %v", a[0].NotAfter)
+	}
+}
+
+// A client whose entity is removed from metadata (with its issuer) can still
+// complete the handshake and be authenticated during RemovedPinGrace
+func TestRemovedPinGraceHandshake(t *testing.T) {
+	rootA := newTestCert(t, "Root CA A", true, nil)
+	clientA := newTestCert(t, "client A", false, rootA)
+	rootB := newTestCert(t, "Root CA B", true, nil)
+	clientB := newTestCert(t, "client B", false, rootB)
+
+	mdstore := fedtls.NewStaticMetadataStore(fedtls.RemovedPinGrace(time.Hour, nil))
+	mdstore.SetMetadata(metadataWithClient("https://a.example.com", rootA, clientA))
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(EntityIDFromContext(r.Context())))
+	})
+	addr := startTestServer(t, mdstore, backend)
+
+	// Each request is made on a new connection
+	get := func(client *testCert) (string, error) {
+		response, err := newTestClient(client).Get("https://" + addr + "/")
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		return string(body), err
+	}
+
+	if _, err := get(clientA); err != nil {
+		t.Fatalf("Request before the entity was removed failed: %v", err)
+	}
+
+	mdstore.SetMetadata(metadataWithClient("https://b.example.com", rootB, clientB))
+
+	// Once B is trusted the server is using the new metadata
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := get(clientB); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("New metadata wasn't used for handshakes")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	entityID, err := get(clientA)
+	if err != nil {
+		t.Fatalf("Request from removed entity within the grace period failed: %v", err)
+	}
+	if entityID != "https://a.example.com" {
+		t.Errorf("Expected request authenticated as removed entity, got %q", entityID)
+	}
+}
@@ -9,7 +9,13 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/joesiltberg/bowness/fedtls"
 )
@@ -70,42 +76,462 @@ type APIKey struct {
 	Key        string // The actual API key
 }
 
+// MiddlewareOptions are optional settings for the authentication middleware
+type MiddlewareOptions struct {
+	// Log the negotiated TLS version and cipher suite for each
+	// authenticated connection
+	LogTLSParameters bool
+
+	// How to log denied connections
+	DenialLogMode DenialLogMode
+
+	// Also log the certificates presented by denied clients (subject,
+	// issuer, fingerprint and validity), whenever a denial is logged
+	LogDeniedCertificates bool
+
+	// With DenialLogSampled, how long to suppress repeated denials from
+	// the same client after one has been logged
+	DenialLogInterval time.Duration
+
+	// Called whenever a connection has been authenticated or denied
+	OnAuthentication func(event *AuthEvent)
+
+	// Authenticate connections again if metadata (or the deny list) has
+	// changed since they were authenticated, rather than only on the
+	// first request
+	RecheckAuth bool
+
+	// If set, a signed JWT describing the client is added to requests
+	BackendToken *BackendToken
+
+	// The HTTP status for denied requests, 403 Forbidden by default
+	DenialStatus int
+
+	// With DenialStatus 401, the value of the WWW-Authenticate header
+	// (left out if empty)
+	WWWAuthenticate string
+
+	// If not empty, a header set to a comma separated list of the
+	// descriptions of all the authenticated entity's clients
+	ClientDescriptionsHeader string
+
+	// Called for every request from an authenticated client, see Authorizer
+	Authorizer Authorizer
+
+	// If UserIDHeader isn't empty, it's set to the client's user ID from
+	// UserMap. Entities which aren't in the map get DefaultUserID, or their
+	// entity ID if DefaultUserID is empty.
+	UserIDHeader  string
+	UserMap       *UserMap
+	DefaultUserID string
+
+	// If not empty, a header set to the application protocol negotiated
+	// with ALPN (such as "h2"), left out if none was negotiated
+	ALPNHeader string
+
+	// If not empty, requests are answered with 503 Service Unavailable and
+	// this body as long as no valid metadata has been loaded (requires
+	// the TLS configuration's HandshakeWhenNotReady)
+	NotReadyBody string
+
+	// If set, authenticated connections are registered here so they can be
+	// closed when their entity is removed from metadata
+	Drainer *ConnectionDrainer
+
+	// If not empty, a header set to the hash of the metadata which was in
+	// effect when the connection was authenticated (see
+	// fedtls.MetadataStore.MetadataHash)
+	MetadataVersionHeader string
+}
+
+// An Authorizer decides whether an authenticated client may make a request,
+// for rules beyond pin matching (such as restricting some entities to
+// certain paths or source networks). If it returns false the request is
+// denied like an unauthenticated one (see DenialStatus), and reason is sent
+// as the response body.
+type Authorizer func(status AuthStatus, r *http.Request) (allowed bool, reason string)
+
+// An AuthEvent describes the authentication decision for a connection
+type AuthEvent struct {
+	Time       time.Time
+	RemoteAddr string
+
+	// Empty if the client is unknown
+	EntityID string
+
+	// Fingerprint of the client's certificate, empty if it didn't send one
+	Fingerprint string
+
+	// Hash of the metadata the decision was based on, see
+	// fedtls.MetadataStore.MetadataHash
+	MetadataHash string
+
+	Granted bool
+
+	// Why the connection was denied, nil if it was granted
+	Err error
+}
+
+// OnAuthentication creates a MiddlewareOptionSetter for setting a callback
+// which is called with every authentication decision
+func OnAuthentication(callback func(event *AuthEvent)) MiddlewareOptionSetter {
+	return func(options *MiddlewareOptions) {
+		options.OnAuthentication = callback
+	}
+}
+
+// A MiddlewareOptionSetter is a function for modifying the middleware options
+type MiddlewareOptionSetter func(*MiddlewareOptions)
+
+// LogTLSParameters creates a MiddlewareOptionSetter for enabling logging of
+// the negotiated TLS version and cipher suite for authenticated connections
+func LogTLSParameters(enabled bool) MiddlewareOptionSetter {
+	return func(options *MiddlewareOptions) {
+		options.LogTLSParameters = enabled
+	}
+}
+
+// LogDenials creates a MiddlewareOptionSetter for choosing how denied
+// connections are logged, see DenialLogMode
+func LogDenials(mode DenialLogMode) MiddlewareOptionSetter {
+	return func(options *MiddlewareOptions) {
+		options.DenialLogMode = mode
+	}
+}
+
+// LogDeniedCertificates creates a MiddlewareOptionSetter for logging the
+// certificates presented by denied clients, which helps troubleshooting
+// clients with the wrong certificate or an unexpected key
+func LogDeniedCertificates(enabled bool) MiddlewareOptionSetter {
+	return func(options *MiddlewareOptions) {
+		options.LogDeniedCertificates = enabled
+	}
+}
+
+// DenialLogInterval creates a MiddlewareOptionSetter for setting the sampling
+// interval used with DenialLogSampled
+func DenialLogInterval(interval time.Duration) MiddlewareOptionSetter {
+	return func(options *MiddlewareOptions) {
+		options.DenialLogInterval = interval
+	}
+}
+
+// RecheckAuth creates a MiddlewareOptionSetter for authenticating long lived
+// connections again when metadata has changed, so that for instance a client
+// whose pin has been removed can't keep using an existing connection
+func RecheckAuth(enabled bool) MiddlewareOptionSetter {
+	return func(options *MiddlewareOptions) {
+		options.RecheckAuth = enabled
+	}
+}
+
+// WithBackendToken creates a MiddlewareOptionSetter for adding a signed JWT
+// describing the client to each request, see BackendToken
+func WithBackendToken(token *BackendToken) MiddlewareOptionSetter {
+	return func(options *MiddlewareOptions) {
+		options.BackendToken = token
+	}
+}
+
+// DenialStatus creates a MiddlewareOptionSetter for choosing the HTTP status
+// used for denied requests. Some clients treat 401 Unauthorized as a
+// reason to select another certificate. If status is 401 and
+// wwwAuthenticate isn't empty, it's sent in a WWW-Authenticate header.
+func DenialStatus(status int, wwwAuthenticate string) MiddlewareOptionSetter {
+	return func(options *MiddlewareOptions) {
+		options.DenialStatus = status
+		options.WWWAuthenticate = wwwAuthenticate
+	}
+}
+
+// ClientDescriptionsHeader creates a MiddlewareOptionSetter for adding a
+// header with the descriptions of all the authenticated entity's clients
+// (as registered in metadata) to each request. It's only informational,
+// for instance for the backend's logs.
+func ClientDescriptionsHeader(headerName string) MiddlewareOptionSetter {
+	return func(options *MiddlewareOptions) {
+		options.ClientDescriptionsHeader = headerName
+	}
+}
+
+// ALPNHeader creates a MiddlewareOptionSetter for adding a header with the
+// application protocol the client negotiated with ALPN, for backends which
+// behave differently depending on whether the client used HTTP/2
+func ALPNHeader(headerName string) MiddlewareOptionSetter {
+	return func(options *MiddlewareOptions) {
+		options.ALPNHeader = headerName
+	}
+}
+
+// MetadataVersionHeader creates a MiddlewareOptionSetter for adding a header
+// with the hash of the metadata which was in effect when the client was
+// authenticated, for correlating requests with the trust state at the time
+func MetadataVersionHeader(headerName string) MiddlewareOptionSetter {
+	return func(options *MiddlewareOptions) {
+		options.MetadataVersionHeader = headerName
+	}
+}
+
+// Returns the descriptions of an entity's clients as a header value.
+// Clients without a description are left out.
+func clientDescriptions(entity *fedtls.Entity) string {
+	var descriptions []string
+	for _, client := range entity.Clients {
+		if client.Description != nil && *client.Description != "" {
+			descriptions = append(descriptions, sanitizeHeaderValue(*client.Description))
+		}
+	}
+	return strings.Join(descriptions, ",")
+}
+
+// Replaces characters which aren't allowed in header values
+func sanitizeHeaderValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, value)
+}
+
+// Authorize creates a MiddlewareOptionSetter for setting an Authorizer which
+// is called for every request after the client has been authenticated
+func Authorize(authorizer Authorizer) MiddlewareOptionSetter {
+	return func(options *MiddlewareOptions) {
+		options.Authorizer = authorizer
+	}
+}
+
+// UserID creates a MiddlewareOptionSetter for adding a header with the
+// client's user ID in the backend, looked up in userMap. Entities which
+// aren't in the map get defaultUserID, or their entity ID if defaultUserID
+// is empty.
+func UserID(headerName string, userMap *UserMap, defaultUserID string) MiddlewareOptionSetter {
+	return func(options *MiddlewareOptions) {
+		options.UserIDHeader = headerName
+		options.UserMap = userMap
+		options.DefaultUserID = defaultUserID
+	}
+}
+
+// NotReadyResponse creates a MiddlewareOptionSetter for answering requests
+// with 503 Service Unavailable and body until valid metadata has been
+// loaded. Requests only get this far before then if the TLS configuration
+// completes handshakes while not ready, see TLSHandshakeWhenNotReady.
+func NotReadyResponse(body string) MiddlewareOptionSetter {
+	return func(options *MiddlewareOptions) {
+		options.NotReadyBody = body
+	}
+}
+
+// DrainConnections creates a MiddlewareOptionSetter for registering
+// authenticated connections with a ConnectionDrainer
+func DrainConnections(drainer *ConnectionDrainer) MiddlewareOptionSetter {
+	return func(options *MiddlewareOptions) {
+		options.Drainer = drainer
+	}
+}
+
+// Returns the user ID to send to the backend for an entity
+func (options *MiddlewareOptions) userID(entityID string) string {
+	if userID, ok := options.UserMap.Lookup(entityID); ok {
+		return userID
+	}
+
+	if options.DefaultUserID != "" {
+		return options.DefaultUserID
+	}
+	return entityID
+}
+
+// Denies a request with DenialStatus (and WWW-Authenticate, if configured)
+func (options *MiddlewareOptions) deny(w http.ResponseWriter, body string) {
+	if options.DenialStatus == http.StatusUnauthorized && options.WWWAuthenticate != "" {
+		w.Header().Set("WWW-Authenticate", options.WWWAuthenticate)
+	}
+	http.Error(w, body, options.DenialStatus)
+}
+
+// Logs why a connection was denied
+func logDenied(r *http.Request, err error, suppressed int) {
+	var notAClient *fedtls.NotAClientError
+	var denied *fedtls.DeniedError
+
+	repeated := ""
+	if suppressed > 0 {
+		repeated = fmt.Sprintf(" (%d similar denials not logged)", suppressed)
+	}
+
+	if errors.As(err, &denied) {
+		log.Printf("Denied connection from %s by local deny list: %v%s", r.RemoteAddr, err, repeated)
+	} else if errors.As(err, &notAClient) {
+		log.Printf("Denied connection from %s, issued by known entity but not a registered client: %v%s",
+			r.RemoteAddr, err, repeated)
+	} else {
+		log.Printf("Denied connection from %s: %v%s", r.RemoteAddr, err, repeated)
+	}
+}
+
+// Returns the body of the response to a denied connection. Errors which
+// reveal other entities or the local lists only go to the log.
+func denialBody(err error) string {
+	var notAClient *fedtls.NotAClientError
+	var denied *fedtls.DeniedError
+	var notAllowed *fedtls.NotAllowedError
+
+	if errors.As(err, &notAClient) || errors.As(err, &denied) || errors.As(err, &notAllowed) {
+		return "Unauthorized"
+	}
+	return err.Error()
+}
+
 // AuthMiddleware is the authentication middlware for federated TLS authentication.
 //
 // It assumes that the http.Server is set up with a ConnContext as provided
 // by ContextModifier() so that the middleware can access the connection of
 // the request and store some authentication state in the context associated
 // with the connection.
-func AuthMiddleware(h http.Handler, mdstore *fedtls.MetadataStore, apiKey *APIKey) http.Handler {
+func AuthMiddleware(h http.Handler, mdstore *fedtls.MetadataStore, apiKey *APIKey, setters ...MiddlewareOptionSetter) http.Handler {
+	options := &MiddlewareOptions{
+		DenialLogMode:     DenialLogFull,
+		DenialLogInterval: 1 * time.Minute,
+		DenialStatus:      http.StatusForbidden,
+	}
+
+	for _, setter := range setters {
+		setter(options)
+	}
+
+	sampler := newDenialSampler(options.DenialLogInterval, func(key string, suppressed int) {
+		log.Printf("%d denials from %s not logged", suppressed, key)
+	})
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		connection := ConnectionFromContext(ctx)
 		errorString := "Unauthorized"
 
-		if connection.auth == nil {
-			entityID, org, orgID, err := mdstore.LookupClient(connection.conn.ConnectionState().VerifiedChains)
+		if connection == nil {
+			log.Printf("No connection in request context from %s, is the server's ConnContext set up with ContextModifier?",
+				r.RemoteAddr)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if connection.currentAuth() == nil && options.NotReadyBody != "" && !mdstore.Status().Loaded {
+			// The connection's handshake didn't verify the client, so
+			// it can't be used once we're ready either
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, options.NotReadyBody)
+			return
+		}
+
+		if options.Drainer != nil && options.Drainer.draining(connection.conn) {
+			// Requests which arrive while the connection is being
+			// drained (pipelined or concurrent HTTP/2 streams)
+			w.Header().Set("Connection", "close")
+			http.Error(w, "Entity has been removed from metadata", options.DenialStatus)
+			return
+		}
+
+		var state tls.ConnectionState
+		var err error
 
-			connection.auth = &AuthStatus{
+		stale := func(auth *AuthStatus) bool {
+			return options.RecheckAuth && auth.version != mdstore.Version()
+		}
+
+		auth, previous, fresh := connection.authenticate(stale, func() *AuthStatus {
+			state = connection.conn.ConnectionState()
+			var lookup fedtls.ClientLookup
+			lookup, err = mdstore.LookupClientWithMetadata(state.VerifiedChains)
+
+			auth := &AuthStatus{
 				Granted:        err == nil,
-				EntityID:       entityID,
-				Organization:   org,
-				OrganizationID: orgID,
+				EntityID:       lookup.EntityID,
+				Organization:   lookup.Organization,
+				OrganizationID: lookup.OrganizationID,
+				version:        lookup.Version,
+				metadataHash:   lookup.MetadataHash,
+			}
+
+			if err == nil && options.ClientDescriptionsHeader != "" {
+				if entity, ok := mdstore.Entity(lookup.EntityID); ok {
+					auth.clientDescriptions = clientDescriptions(entity)
+				}
+			}
+			return auth
+		})
+
+		if fresh {
+			if previous != nil && previous.Granted && err != nil {
+				log.Printf("Connection from %s, previously authenticated as %s, is no longer authorized",
+					r.RemoteAddr, previous.EntityID)
+			}
+
+			if options.OnAuthentication != nil {
+				options.OnAuthentication(&AuthEvent{
+					Time:         time.Now(),
+					RemoteAddr:   r.RemoteAddr,
+					EntityID:     auth.EntityID,
+					Fingerprint:  peerFingerprint(state),
+					MetadataHash: auth.metadataHash,
+					Granted:      err == nil,
+					Err:          err,
+				})
 			}
 
 			if err != nil {
-				errorString = err.Error()
+				errorString = denialBody(err)
+
+				shouldLog, suppressed := false, 0
+				switch options.DenialLogMode {
+				case DenialLogFull:
+					shouldLog = true
+				case DenialLogSampled:
+					shouldLog, suppressed = sampler.sample(denialKey(r.RemoteAddr, state), time.Now())
+				}
+
+				if shouldLog {
+					logDenied(r, err, suppressed)
+					if options.LogDeniedCertificates {
+						logPeerCertificates(r.RemoteAddr, state)
+					}
+				}
+			} else {
+				if options.Drainer != nil {
+					options.Drainer.register(connection.conn, auth.EntityID)
+				}
+
+				if options.LogTLSParameters {
+					log.Printf("Connection from %s authenticated as %s using %s (%s)",
+						r.RemoteAddr, auth.EntityID,
+						tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+				}
 			}
 		}
 
-		if !connection.auth.Granted {
-			http.Error(w, errorString, http.StatusForbidden)
+		if !auth.Granted {
+			options.deny(w, errorString)
 			return
 		}
 
-		entityID := connection.auth.EntityID
-		org := connection.auth.Organization
-		orgID := connection.auth.OrganizationID
+		if options.Authorizer != nil {
+			if allowed, reason := options.Authorizer(*auth, r); !allowed {
+				if options.DenialLogMode != DenialLogOff {
+					log.Printf("Request from %s (%s) for %s not authorized: %s",
+						r.RemoteAddr, auth.EntityID, r.URL.Path, reason)
+				}
+				options.deny(w, reason)
+				return
+			}
+		}
+
+		entityID := auth.EntityID
+		org := auth.Organization
+		orgID := auth.OrganizationID
 
 		newContext := context.WithValue(ctx, entityIDKey, entityID)
 		newContext = context.WithValue(newContext, organizationKey, org)
@@ -120,6 +546,41 @@ func AuthMiddleware(h http.Handler, mdstore *fedtls.MetadataStore, apiKey *APIKe
 			r2.Header.Set(apiKey.HeaderName, apiKey.Key)
 		}
 
+		if options.ClientDescriptionsHeader != "" {
+			r2.Header.Del(options.ClientDescriptionsHeader)
+			if descriptions := auth.clientDescriptions; descriptions != "" {
+				r2.Header.Set(options.ClientDescriptionsHeader, descriptions)
+			}
+		}
+
+		if options.ALPNHeader != "" {
+			r2.Header.Del(options.ALPNHeader)
+			if r.TLS != nil && r.TLS.NegotiatedProtocol != "" {
+				r2.Header.Set(options.ALPNHeader, r.TLS.NegotiatedProtocol)
+			}
+		}
+
+		if options.MetadataVersionHeader != "" {
+			r2.Header.Set(options.MetadataVersionHeader, auth.metadataHash)
+		}
+
+		if options.UserIDHeader != "" {
+			r2.Header.Del(options.UserIDHeader)
+			if options.UserMap != nil {
+				r2.Header.Set(options.UserIDHeader, options.userID(entityID))
+			}
+		}
+
+		if token := options.BackendToken; token != nil {
+			signed, err := token.mint(entityID, org, orgID, time.Now())
+			if err != nil {
+				log.Printf("Failed to create backend token for %s: %v", entityID, err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			r2.Header.Set(token.HeaderName, token.Prefix+signed)
+		}
+
 		h.ServeHTTP(w, r2)
 	})
 }
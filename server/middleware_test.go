@@ -0,0 +1,406 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/joesiltberg/bowness/fedtls"
+	"github.com/joesiltberg/bowness/util"
+)
+
+func TestClientDescriptions(t *testing.T) {
+	production := "Production"
+	multiline := "Test\r\nsystem"
+
+	entity := &fedtls.Entity{
+		Clients: []fedtls.Client{
+			{Description: &production},
+			{Description: nil},
+			{Description: &multiline},
+		},
+	}
+
+	if got := clientDescriptions(entity); got != "Production,Test  system" {
+		t.Errorf("Unexpected client descriptions: %q", got)
+	}
+
+	if got := clientDescriptions(&fedtls.Entity{}); got != "" {
+		t.Errorf("Expected no descriptions for an entity without clients, got %q", got)
+	}
+}
+
+// Creates a request on a connection which has already been authenticated
+func newAuthenticatedRequest(entityID, path string) *http.Request {
+	connection := &ContextConnection{
+		auth: &AuthStatus{Granted: true, EntityID: entityID},
+	}
+	r := httptest.NewRequest("GET", path, nil)
+	return r.WithContext(context.WithValue(r.Context(), connKey, connection))
+}
+
+func TestAuthorizer(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	h := AuthMiddleware(backend, &fedtls.MetadataStore{}, nil,
+		Authorize(func(status AuthStatus, r *http.Request) (bool, string) {
+			if status.EntityID == "https://limited.example.com" && r.URL.Path != "/public" {
+				return false, "Only /public is allowed"
+			}
+			return true, ""
+		}))
+
+	tests := []struct {
+		entityID string
+		path     string
+		expected int
+	}{
+		{"https://limited.example.com", "/public", http.StatusTeapot},
+		{"https://limited.example.com", "/private", http.StatusForbidden},
+		{"https://other.example.com", "/private", http.StatusTeapot},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newAuthenticatedRequest(test.entityID, test.path))
+
+		if w.Code != test.expected {
+			t.Errorf("%s %s: expected %d, got %d", test.entityID, test.path, test.expected, w.Code)
+		}
+	}
+}
+
+// Authorizer denials get the configured DenialStatus
+func TestAuthorizerDenialStatus(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Request shouldn't reach the backend")
+	})
+
+	h := AuthMiddleware(backend, &fedtls.MetadataStore{}, nil,
+		DenialStatus(http.StatusUnauthorized, `Mutual scheme="fedtls"`),
+		Authorize(func(status AuthStatus, r *http.Request) (bool, string) {
+			return false, "Not now"
+		}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newAuthenticatedRequest("https://example.com", "/"))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401, got %d", w.Code)
+	}
+	if got := w.Header().Get("WWW-Authenticate"); got != `Mutual scheme="fedtls"` {
+		t.Errorf("Unexpected WWW-Authenticate %q", got)
+	}
+	if got := strings.TrimSpace(w.Body.String()); got != "Not now" {
+		t.Errorf("Unexpected body %q", got)
+	}
+}
+
+func TestNotReadyResponse(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Request shouldn't reach the backend")
+	})
+
+	body := "Not ready yet"
+	h := AuthMiddleware(backend, &fedtls.MetadataStore{}, nil, NotReadyResponse(body))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), connKey, &ContextConnection{}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %d", w.Code)
+	}
+	if got := strings.TrimSpace(w.Body.String()); got != body {
+		t.Errorf("Unexpected body %q", got)
+	}
+	if w.Header().Get("Connection") != "close" {
+		t.Errorf("Expected the connection to be closed")
+	}
+}
+
+func TestALPNHeader(t *testing.T) {
+	const header = "X-FedTLSAuth-ALPN"
+	var got []string
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Values(header)
+	})
+
+	h := AuthMiddleware(backend, &fedtls.MetadataStore{}, nil, ALPNHeader(header))
+
+	r := newAuthenticatedRequest("https://example.com", "/")
+	r.TLS = &tls.ConnectionState{NegotiatedProtocol: "h2"}
+	r.Header.Set(header, "spoofed")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(got) != 1 || got[0] != "h2" {
+		t.Errorf("Expected negotiated protocol in header, got %v", got)
+	}
+
+	r = newAuthenticatedRequest("https://example.com", "/")
+	r.TLS = &tls.ConnectionState{}
+	r.Header.Set(header, "spoofed")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(got) != 0 {
+		t.Errorf("Expected no header without ALPN, got %v", got)
+	}
+}
+
+func TestMetadataVersionHeader(t *testing.T) {
+	const header = "X-FedTLSAuth-Metadata-Version"
+	var got []string
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Values(header)
+	})
+
+	h := AuthMiddleware(backend, &fedtls.MetadataStore{}, nil, MetadataVersionHeader(header))
+
+	r := newAuthenticatedRequest("https://example.com", "/")
+	ConnectionFromContext(r.Context()).auth.metadataHash = "abc123"
+	r.Header.Set(header, "spoofed")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(got) != 1 || got[0] != "abc123" {
+		t.Errorf("Expected the hash from authentication in header, got %v", got)
+	}
+}
+
+// Does a handshake over a pipe with client's certificate, and returns the
+// server's side of the connection (with the client verified against root)
+func newVerifiedConn(t *testing.T, root, client *testCert) *tls.Conn {
+	t.Helper()
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(root.cert)
+
+	serverSide, clientSide := net.Pipe()
+	t.Cleanup(func() { serverSide.Close(); clientSide.Close() })
+
+	server := tls.Server(serverSide, &tls.Config{
+		Certificates: []tls.Certificate{toTLSCertificate(newTestServerCert(t, root))},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+
+	cert := toTLSCertificate(client)
+	go tls.Client(clientSide, &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{cert},
+	}).Handshake()
+
+	if err := server.Handshake(); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	return server
+}
+
+// Metadata with an entity whose client certificate is issued by root
+func metadataWithClient(entityID string, root, client *testCert) *fedtls.Metadata {
+	return &fedtls.Metadata{
+		Entities: []fedtls.Entity{
+			{
+				EntityID: entityID,
+				Issuers:  []fedtls.Issuer{{X509certificate: toPEM(root)}},
+				Clients: []fedtls.Client{
+					{Pins: []fedtls.Pin{{Alg: "sha256", Digest: util.Fingerprint(client.cert)}}},
+				},
+			},
+		},
+	}
+}
+
+// Creates a request on a connection which hasn't been authenticated yet
+func newConnectionRequest(connection *ContextConnection, path string) *http.Request {
+	r := httptest.NewRequest("GET", path, nil)
+	return r.WithContext(context.WithValue(r.Context(), connKey, connection))
+}
+
+func TestRecheckAuth(t *testing.T) {
+	root := newTestCert(t, "Root CA", true, nil)
+	client := newTestCert(t, "client", false, root)
+	other := newTestCert(t, "other", false, root)
+
+	mdstore := fedtls.NewStaticMetadataStore()
+	mdstore.SetMetadata(metadataWithClient("https://example.com", root, client))
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(EntityIDFromContext(r.Context())))
+	})
+
+	connection := &ContextConnection{conn: newVerifiedConn(t, root, client)}
+
+	for _, recheck := range []bool{false, true} {
+		h := AuthMiddleware(backend, mdstore, nil, RecheckAuth(recheck))
+		connection.auth = nil
+		mdstore.SetMetadata(metadataWithClient("https://example.com", root, client))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newConnectionRequest(connection, "/"))
+		if w.Code != http.StatusOK || w.Body.String() != "https://example.com" {
+			t.Fatalf("Expected the client to be authenticated, got %d: %s", w.Code, w.Body.String())
+		}
+
+		// The client's pin is replaced with another one
+		mdstore.SetMetadata(metadataWithClient("https://example.com", root, other))
+
+		expected := http.StatusOK
+		if recheck {
+			expected = http.StatusForbidden
+		}
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, newConnectionRequest(connection, "/"))
+		if w.Code != expected {
+			t.Errorf("RecheckAuth %t: expected %d after the pin was removed, got %d", recheck, expected, w.Code)
+		}
+	}
+}
+
+// Requests on the same connection (like HTTP/2 streams) while metadata
+// changes, run with -race
+func TestRecheckAuthConcurrent(t *testing.T) {
+	root := newTestCert(t, "Root CA", true, nil)
+	client := newTestCert(t, "client", false, root)
+
+	mdstore := fedtls.NewStaticMetadataStore()
+	mdstore.SetMetadata(metadataWithClient("https://example.com", root, client))
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := AuthMiddleware(backend, mdstore, nil, RecheckAuth(true))
+	connection := &ContextConnection{conn: newVerifiedConn(t, root, client)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, newConnectionRequest(connection, "/"))
+				if w.Code != http.StatusOK {
+					t.Errorf("Expected 200, got %d", w.Code)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		mdstore.SetMetadata(metadataWithClient("https://example.com", root, client))
+	}
+	wg.Wait()
+}
+
+func TestDrainConnectionsMiddleware(t *testing.T) {
+	root := newTestCert(t, "Root CA", true, nil)
+	client := newTestCert(t, "client", false, root)
+
+	mdstore := fedtls.NewStaticMetadataStore()
+	mdstore.SetMetadata(metadataWithClient("https://example.com", root, client))
+
+	drainer := NewConnectionDrainer()
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := AuthMiddleware(backend, mdstore, nil, DrainConnections(drainer))
+	connection := &ContextConnection{conn: newVerifiedConn(t, root, client)}
+
+	drainer.ConnState(connection.conn, http.StateActive)
+	h.ServeHTTP(httptest.NewRecorder(), newConnectionRequest(connection, "/"))
+
+	drainer.lock.Lock()
+	dc, ok := drainer.conns[connection.conn]
+	drainer.lock.Unlock()
+	if !ok || dc.entityID != "https://example.com" {
+		t.Fatalf("Authenticated connection wasn't registered with the drainer")
+	}
+
+	// The entity is removed while the request is active, so further
+	// requests on the connection are refused
+	drainer.Drain([]string{"https://example.com"})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newConnectionRequest(connection, "/"))
+	if w.Code != http.StatusForbidden || w.Header().Get("Connection") != "close" {
+		t.Errorf("Expected 403 with Connection: close while draining, got %d", w.Code)
+	}
+}
+
+func TestDenialBody(t *testing.T) {
+	root := newTestCert(t, "Root CA", true, nil)
+	client := newTestCert(t, "client", false, root)
+	other := newTestCert(t, "other", false, root)
+
+	// The client's certificate is issued by the entity's issuer, but
+	// isn't one of its clients
+	mdstore := fedtls.NewStaticMetadataStore()
+	mdstore.SetMetadata(metadataWithClient("https://example.com", root, other))
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := AuthMiddleware(backend, mdstore, nil)
+	connection := &ContextConnection{conn: newVerifiedConn(t, root, client)}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newConnectionRequest(connection, "/"))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403, got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "https://example.com") {
+		t.Errorf("Response reveals the entity the client was checked against: %s", w.Body.String())
+	}
+}
+
+func TestDenialStatus(t *testing.T) {
+	root := newTestCert(t, "Root CA", true, nil)
+	client := newTestCert(t, "client", false, root)
+	other := newTestCert(t, "other", false, root)
+
+	mdstore := fedtls.NewStaticMetadataStore()
+	mdstore.SetMetadata(metadataWithClient("https://example.com", root, other))
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	connection := &ContextConnection{conn: newVerifiedConn(t, root, client)}
+
+	cases := []struct {
+		setters         []MiddlewareOptionSetter
+		status          int
+		wwwAuthenticate string
+	}{
+		{nil, http.StatusForbidden, ""},
+		{[]MiddlewareOptionSetter{DenialStatus(http.StatusUnauthorized, `Mutual scheme="fedtls"`)},
+			http.StatusUnauthorized, `Mutual scheme="fedtls"`},
+		{[]MiddlewareOptionSetter{DenialStatus(http.StatusForbidden, `Mutual scheme="fedtls"`)},
+			http.StatusForbidden, ""},
+	}
+
+	for _, c := range cases {
+		h := AuthMiddleware(backend, mdstore, nil, c.setters...)
+		connection.auth = nil
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newConnectionRequest(connection, "/"))
+		if w.Code != c.status {
+			t.Errorf("Expected %d, got %d", c.status, w.Code)
+		}
+		if got := w.Header().Get("WWW-Authenticate"); got != c.wwwAuthenticate {
+			t.Errorf("Expected WWW-Authenticate %q with status %d, got %q", c.wwwAuthenticate, c.status, got)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// Whether alg is a signature algorithm which can be used with key
+func nonceAlgorithmMatches(alg jwa.SignatureAlgorithm, key interface{}) bool {
+	switch key.(type) {
+	case *ecdsa.PublicKey:
+		return alg == jwa.ES256 || alg == jwa.ES384 || alg == jwa.ES512
+	case *rsa.PublicKey:
+		return alg == jwa.RS256 || alg == jwa.RS384 || alg == jwa.RS512 ||
+			alg == jwa.PS256 || alg == jwa.PS384 || alg == jwa.PS512
+	case ed25519.PublicKey:
+		return alg == jwa.EdDSA
+	}
+	return false
+}
+
+// Remembers the nonces seen within the freshness window
+type nonceCache struct {
+	// When each nonce (prefixed with the entity ID) can be forgotten
+	seen map[string]time.Time
+	lock sync.Mutex
+
+	lastPrune time.Time
+}
+
+// Records a nonce, returns false if it has been seen before
+func (c *nonceCache) add(key string, expires, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if now.Sub(c.lastPrune) > time.Second {
+		for k, e := range c.seen {
+			if now.After(e) {
+				delete(c.seen, k)
+			}
+		}
+		c.lastPrune = now
+	}
+
+	if _, seen := c.seen[key]; seen {
+		return false
+	}
+	c.seen[key] = expires
+	return true
+}
+
+// Verifies a nonce, signed with the key of the client's certificate
+func verifyNonce(value string, r *http.Request, window time.Duration, cache *nonceCache, now time.Time) error {
+	if value == "" {
+		return errors.New("missing nonce")
+	}
+
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return errors.New("no client certificate to verify the nonce with")
+	}
+	key := r.TLS.PeerCertificates[0].PublicKey
+
+	msg, err := jws.Parse([]byte(value))
+	if err != nil {
+		return fmt.Errorf("malformed nonce: %v", err)
+	}
+	if len(msg.Signatures()) != 1 {
+		return errors.New("nonce must have exactly one signature")
+	}
+
+	alg := msg.Signatures()[0].ProtectedHeaders().Algorithm()
+	if !nonceAlgorithmMatches(alg, key) {
+		return fmt.Errorf("nonce algorithm %s can't be used with the client's key", alg)
+	}
+
+	token, err := jwt.Parse([]byte(value), jwt.WithKey(alg, key), jwt.WithValidate(false))
+	if err != nil {
+		return fmt.Errorf("invalid nonce signature: %v", err)
+	}
+
+	iat := token.IssuedAt()
+	if iat.IsZero() {
+		return errors.New("nonce has no iat")
+	}
+	if now.Sub(iat) > window || iat.Sub(now) > window {
+		return fmt.Errorf("nonce issued at %s, outside of the allowed window of %v", iat.UTC().Format(time.RFC3339), window)
+	}
+
+	if token.JwtID() == "" {
+		return errors.New("nonce has no jti")
+	}
+
+	// Outside of the window the nonce is rejected anyway
+	if !cache.add(EntityIDFromContext(r.Context())+" "+token.JwtID(), iat.Add(window), now) {
+		return errors.New("nonce has already been used")
+	}
+	return nil
+}
+
+// NonceVerifier returns a middleware which protects against replayed
+// requests by requiring a nonce in a header.
+//
+// The nonce is a JWT signed with the private key of the client's
+// certificate (the key pinned in metadata), with a unique jti claim and an
+// iat claim within window of the current time. A jti can only be used once
+// per entity. Requests without a valid nonce get 401 Unauthorized, and the
+// header is removed before requests are passed on.
+//
+// If pathPrefixes are given, only requests for paths starting with one of
+// them (as whole path segments) need a nonce. It must be placed after the authentication middleware.
+func NonceVerifier(h http.Handler, headerName string, window time.Duration, pathPrefixes ...string) http.Handler {
+	cache := &nonceCache{seen: make(map[string]time.Time)}
+
+	required := func(r *http.Request) bool {
+		if len(pathPrefixes) == 0 {
+			return true
+		}
+		path, normalize := matchingPath(r)
+		for _, prefix := range pathPrefixes {
+			if hasPathPrefix(path, normalize(prefix)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if required(r) {
+			if err := verifyNonce(r.Header.Get(headerName), r, window, cache, time.Now()); err != nil {
+				log.Printf("Request from %s (%s) for %s rejected: %v",
+					r.RemoteAddr, EntityIDFromContext(r.Context()), r.URL.Path, err)
+				http.Error(w, "Invalid nonce: "+err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+
+		r.Header.Del(headerName)
+		h.ServeHTTP(w, r)
+	})
+}
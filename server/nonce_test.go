@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// Creates a nonce signed with the client's key
+func newNonce(t *testing.T, client *testCert, jti string, iat time.Time) string {
+	t.Helper()
+
+	key, err := jwk.FromRaw(client.key)
+	if err != nil {
+		t.Fatalf("Failed to create JWK: %v", err)
+	}
+
+	token, err := jwt.NewBuilder().JwtID(jti).IssuedAt(iat).Build()
+	if err != nil {
+		t.Fatalf("Failed to build nonce: %v", err)
+	}
+
+	signed, err := jwt.Sign(token, jwt.WithKey(jwa.ES256, key))
+	if err != nil {
+		t.Fatalf("Failed to sign nonce: %v", err)
+	}
+	return string(signed)
+}
+
+func TestNonceVerifier(t *testing.T) {
+	const header = "X-FedTLSAuth-Nonce"
+
+	client := newTestCert(t, "client", false, nil)
+	other := newTestCert(t, "other", false, nil)
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(header) != "" {
+			t.Errorf("Nonce header was passed on")
+		}
+	})
+	h := NonceVerifier(backend, header, time.Minute, "/secure")
+
+	request := func(path, nonce string) int {
+		r := httptest.NewRequest("POST", path, nil)
+		r = r.WithContext(context.WithValue(r.Context(), entityIDKey, "https://example.com"))
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client.cert}}
+		if nonce != "" {
+			r.Header.Set(header, nonce)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	now := time.Now()
+	valid := newNonce(t, client, "1", now)
+
+	tests := []struct {
+		name     string
+		path     string
+		nonce    string
+		expected int
+	}{
+		{"valid", "/secure/x", valid, http.StatusOK},
+		{"replayed", "/secure/x", valid, http.StatusUnauthorized},
+		{"missing", "/secure/x", "", http.StatusUnauthorized},
+		{"stale", "/secure/x", newNonce(t, client, "2", now.Add(-2*time.Minute)), http.StatusUnauthorized},
+		{"other key", "/secure/x", newNonce(t, other, "3", now), http.StatusUnauthorized},
+		{"no jti", "/secure/x", newNonce(t, client, "", now), http.StatusUnauthorized},
+		{"malformed", "/secure/x", "garbage", http.StatusUnauthorized},
+		{"not required", "/public", "", http.StatusOK},
+		{"repeated slash", "//secure/x", "", http.StatusUnauthorized},
+		{"dot segment", "/./secure/x", "", http.StatusUnauthorized},
+		{"parent segment", "/public/../secure/x", "", http.StatusUnauthorized},
+		{"prefix itself", "/secure", "", http.StatusUnauthorized},
+		{"other segment", "/securex", "", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		if code := request(test.path, test.nonce); code != test.expected {
+			t.Errorf("%s: expected %d, got %d", test.name, test.expected, code)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Labels used by OrganizationCounter for requests which aren't counted
+// under their organization ID
+const (
+	// The entity has no organization ID
+	UnknownOrganizationLabel = "(unknown)"
+
+	// The maximum number of labels has been reached
+	OtherOrganizationLabel = "(other)"
+)
+
+// Keeps track of which organization IDs have been given labels of their own
+type organizationLabels struct {
+	maxLabels int
+	seen      map[string]bool
+	lock      sync.Mutex
+}
+
+// The label a request from orgID is counted under. Organization IDs
+// starting with ( get another ( prepended, so that they can't be mistaken
+// for UnknownOrganizationLabel or OtherOrganizationLabel.
+func (l *organizationLabels) label(orgID *string) string {
+	if orgID == nil || *orgID == "" {
+		return UnknownOrganizationLabel
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.seen[*orgID] {
+		if len(l.seen) >= l.maxLabels {
+			return OtherOrganizationLabel
+		}
+		l.seen[*orgID] = true
+	}
+
+	if strings.HasPrefix(*orgID, "(") {
+		return "(" + *orgID
+	}
+	return *orgID
+}
+
+// OrganizationCounter returns a middleware which calls count for each
+// request with a label for the client's organization, for instance to
+// update a metric per organization. The label is the organization ID, or
+// UnknownOrganizationLabel for entities without one. Once maxLabels
+// organizations have been seen, requests from any further organizations
+// are counted as OtherOrganizationLabel, so the number of labels is bounded.
+//
+// It must be placed after the authentication middleware.
+func OrganizationCounter(h http.Handler, maxLabels int, count func(label string)) http.Handler {
+	labels := &organizationLabels{
+		maxLabels: maxLabels,
+		seen:      make(map[string]bool),
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count(labels.label(OrganizationIDFromContext(r.Context())))
+		h.ServeHTTP(w, r)
+	})
+}
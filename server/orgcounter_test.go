@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// A request from an entity with the given organization ID
+func newOrganizationRequest(orgID *string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	return r.WithContext(context.WithValue(r.Context(), organizationIDKey, orgID))
+}
+
+func TestOrganizationCounter(t *testing.T) {
+	counts := make(map[string]int)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := OrganizationCounter(backend, 3, func(label string) { counts[label]++ })
+
+	org := func(id string) *string { return &id }
+
+	for _, orgID := range []*string{
+		nil,
+		org(""),
+		org("SE1"),
+		org("(unknown)"),
+		org("SE1"),
+		org("(other)"),
+		org("SE2"), // Over the limit
+		org("SE1"), // Seen before, so still counted under its own label
+		org("SE3"),
+	} {
+		h.ServeHTTP(httptest.NewRecorder(), newOrganizationRequest(orgID))
+	}
+
+	expected := map[string]int{
+		UnknownOrganizationLabel: 2,
+		OtherOrganizationLabel:   2,
+		"SE1":                    3,
+		"((unknown)":             1,
+		"((other)":               1,
+	}
+
+	if len(counts) != len(expected) {
+		t.Errorf("Expected %d labels, got %v", len(expected), counts)
+	}
+	for label, count := range expected {
+		if counts[label] != count {
+			t.Errorf("Expected %d requests for %s, got %d", count, label, counts[label])
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// PathNormalization describes how request paths are normalized before they
+// are matched against configured paths, such as path costs (PathCost), the
+// health check path and nonce paths
+type PathNormalization struct {
+	// Replace repeated slashes with a single slash ("//a///b" becomes "/a/b")
+	CollapseSlashes bool
+
+	// Match paths case insensitively
+	IgnoreCase bool
+
+	// Remove a trailing slash ("/a/" becomes "/a", "/" is kept)
+	TrimTrailingSlash bool
+
+	// Also send the normalized path to the backend, rather than the path
+	// as the client sent it
+	RewritePath bool
+}
+
+type pathContextKey int
+
+const normalizationKey pathContextKey = 0
+
+func (n *PathNormalization) normalize(path string) string {
+	if n.CollapseSlashes {
+		var b strings.Builder
+		for i := 0; i < len(path); i++ {
+			if path[i] == '/' && i > 0 && path[i-1] == '/' {
+				continue
+			}
+			b.WriteByte(path[i])
+		}
+		path = b.String()
+	}
+
+	if n.TrimTrailingSlash && len(path) > 1 {
+		path = strings.TrimRight(path, "/")
+		if path == "" {
+			path = "/"
+		}
+	}
+
+	if n.IgnoreCase {
+		path = strings.ToLower(path)
+	}
+	return path
+}
+
+// Leaves a path as it is
+func noNormalization(path string) string {
+	return path
+}
+
+// NormalizePaths returns a middleware which makes the handlers after it
+// match request paths normalized according to n. The paths they're matched
+// against are normalized the same way.
+//
+// Unless n.RewritePath is set the request itself isn't changed, so the
+// backend gets the path as the client sent it.
+func NormalizePaths(h http.Handler, n PathNormalization) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r2 := r.WithContext(context.WithValue(r.Context(), normalizationKey, &n))
+
+		if n.RewritePath {
+			u := *r.URL
+			r2.URL = &u
+			r2.URL.Path = n.normalize(r.URL.Path)
+			r2.URL.RawPath = ""
+		}
+
+		h.ServeHTTP(w, r2)
+	})
+}
+
+// Returns the path of r to match against configured paths, and a function
+// normalizing the configured paths the same way
+func matchingPath(r *http.Request) (string, func(string) string) {
+	n, ok := r.Context().Value(normalizationKey).(*PathNormalization)
+	if !ok {
+		return r.URL.Path, noNormalization
+	}
+	return n.normalize(r.URL.Path), n.normalize
+}
+
+// Returns whether p is prefix or below it, comparing whole path segments
+// ("/a" matches "/a" and "/a/b", but not "/ab"). Both are cleaned first,
+// so "//a/b" and "/./a/b" can't be used to get around a prefix.
+func hasPathPrefix(p, prefix string) bool {
+	p = path.Clean("/" + p)
+	prefix = path.Clean("/" + prefix)
+
+	return prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/joesiltberg/bowness/fedtls"
+)
+
+func TestNormalizePath(t *testing.T) {
+	all := &PathNormalization{CollapseSlashes: true, IgnoreCase: true, TrimTrailingSlash: true}
+
+	cases := []struct {
+		n        *PathNormalization
+		path     string
+		expected string
+	}{
+		{&PathNormalization{}, "//API/Orders/", "//API/Orders/"},
+		{&PathNormalization{CollapseSlashes: true}, "//api///orders", "/api/orders"},
+		{&PathNormalization{TrimTrailingSlash: true}, "/api/orders//", "/api/orders"},
+		{&PathNormalization{TrimTrailingSlash: true}, "/", "/"},
+		{&PathNormalization{IgnoreCase: true}, "/API/Orders", "/api/orders"},
+		{all, "//API//Orders/", "/api/orders"},
+		{all, "///", "/"},
+	}
+
+	for _, c := range cases {
+		if got := c.n.normalize(c.path); got != c.expected {
+			t.Errorf("%+v: expected %s for %s, got %s", *c.n, c.expected, c.path, got)
+		}
+	}
+}
+
+func TestNormalizePaths(t *testing.T) {
+	var backendPath string
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendPath = r.URL.Path
+	})
+
+	n := PathNormalization{CollapseSlashes: true, IgnoreCase: true, TrimTrailingSlash: true}
+
+	// The health check matches the normalized path
+	h := NormalizePaths(HealthCheck(backend, "/Health", &fedtls.MetadataStore{}), n)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "//HEALTH/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the health check to answer, got %d", rec.Code)
+	}
+
+	// The backend gets the original path
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "//API/Orders/", nil))
+	if backendPath != "//API/Orders/" {
+		t.Errorf("Expected the original path at the backend, got %s", backendPath)
+	}
+
+	// Unless it's rewritten
+	n.RewritePath = true
+	h = NormalizePaths(backend, n)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "//API/Orders/", nil))
+	if backendPath != "/api/orders" {
+		t.Errorf("Expected the normalized path at the backend, got %s", backendPath)
+	}
+}
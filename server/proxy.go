@@ -0,0 +1,256 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyOptions are optional settings for the reverse proxy
+type ProxyOptions struct {
+	// Used for requests to the backend, nil means http.DefaultTransport
+	Transport http.RoundTripper
+
+	// How often to flush the response to the client while copying the
+	// response body, a negative value flushes after each write
+	FlushInterval time.Duration
+
+	// Size of the (pooled) buffers used when copying response bodies,
+	// 0 means the default from net/http/httputil
+	BufferSize int
+
+	// Set X-Forwarded-Proto and X-Forwarded-Host on requests to the backend
+	ForwardedHeaders bool
+
+	// If set, this path prefix is replaced with ReplacePrefix (which may be
+	// empty) before the request is sent to the backend
+	StripPrefix   string
+	ReplacePrefix string
+
+	// Respond with 404 Not Found to requests not matching StripPrefix,
+	// rather than passing them on unchanged
+	RejectUnmatchedPrefix bool
+
+	// Path prefixes added to requests depending on the authenticated peer,
+	// see ProxyEntityPrefixes
+	EntityPrefixes      []EntityPrefix
+	DefaultEntityPrefix string
+
+	// Called for each outgoing request after the default director,
+	// which means the authentication headers etc. are already set
+	Director func(*http.Request)
+}
+
+// A ProxyOptionSetter is a function for modifying the reverse proxy options
+type ProxyOptionSetter func(*ProxyOptions)
+
+// ProxyTransport creates a ProxyOptionSetter for setting the transport
+func ProxyTransport(transport http.RoundTripper) ProxyOptionSetter {
+	return func(options *ProxyOptions) {
+		options.Transport = transport
+	}
+}
+
+// ProxyFlushInterval creates a ProxyOptionSetter for setting the flush interval
+func ProxyFlushInterval(interval time.Duration) ProxyOptionSetter {
+	return func(options *ProxyOptions) {
+		options.FlushInterval = interval
+	}
+}
+
+// ProxyBufferSize creates a ProxyOptionSetter for setting the buffer size
+func ProxyBufferSize(size int) ProxyOptionSetter {
+	return func(options *ProxyOptions) {
+		options.BufferSize = size
+	}
+}
+
+// ProxyForwardedHeaders creates a ProxyOptionSetter for enabling the
+// X-Forwarded-Proto and X-Forwarded-Host headers
+func ProxyForwardedHeaders(enabled bool) ProxyOptionSetter {
+	return func(options *ProxyOptions) {
+		options.ForwardedHeaders = enabled
+	}
+}
+
+// ProxyDirector creates a ProxyOptionSetter for setting a function which
+// can modify outgoing requests to the backend
+func ProxyDirector(director func(*http.Request)) ProxyOptionSetter {
+	return func(options *ProxyOptions) {
+		options.Director = director
+	}
+}
+
+// ProxyRewritePrefix creates a ProxyOptionSetter for replacing a path prefix
+// (for instance /api) with another (possibly empty) prefix. Requests not
+// matching the prefix are rejected with 404 Not Found if rejectUnmatched is
+// set, otherwise they're passed on unchanged.
+func ProxyRewritePrefix(prefix, replacement string, rejectUnmatched bool) ProxyOptionSetter {
+	return func(options *ProxyOptions) {
+		options.StripPrefix = prefix
+		options.ReplacePrefix = replacement
+		options.RejectUnmatchedPrefix = rejectUnmatched
+	}
+}
+
+// An EntityPrefix is a path prefix added to requests from some entities or
+// organizations, for instance to send them to a specific version of an API
+type EntityPrefix struct {
+	EntityIDs       []string
+	OrganizationIDs []string
+	Prefix          string
+}
+
+// ProxyEntityPrefixes creates a ProxyOptionSetter for adding a path prefix
+// to requests depending on the authenticated peer. The prefix of the first
+// EntityPrefix matching the peer's entity ID or organization ID is used,
+// otherwise defaultPrefix (which may be empty). The prefix is added after
+// any ProxyRewritePrefix rewrite and before the target URL's path.
+func ProxyEntityPrefixes(prefixes []EntityPrefix, defaultPrefix string) ProxyOptionSetter {
+	return func(options *ProxyOptions) {
+		options.EntityPrefixes = prefixes
+		options.DefaultEntityPrefix = defaultPrefix
+	}
+}
+
+// The path prefix for the peer who made r, see ProxyEntityPrefixes
+func (options *ProxyOptions) entityPrefix(r *http.Request) string {
+	for i := range options.EntityPrefixes {
+		prefix := &options.EntityPrefixes[i]
+		if peerMatches(r, prefix.EntityIDs, prefix.OrganizationIDs) {
+			return prefix.Prefix
+		}
+	}
+	return options.DefaultEntityPrefix
+}
+
+// Replaces prefix in path with replacement. The prefix only matches
+// whole path segments, so /api matches /api and /api/foo but not /apis.
+// Returns false if the prefix doesn't match.
+func rewritePrefix(path, prefix, replacement string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+		return path, false
+	}
+
+	result := strings.TrimSuffix(replacement, "/") + strings.TrimPrefix(path, prefix)
+	if !strings.HasPrefix(result, "/") {
+		result = "/" + result
+	}
+	return result, true
+}
+
+// A httputil.BufferPool handing out buffers of a fixed size
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{
+		pool: sync.Pool{
+			New: func() interface{} {
+				return make([]byte, size)
+			},
+		},
+	}
+}
+
+func (bp *bufferPool) Get() []byte {
+	return bp.pool.Get().([]byte)
+}
+
+func (bp *bufferPool) Put(b []byte) {
+	bp.pool.Put(b)
+}
+
+func stripHeader(h http.Handler, header string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r2 := *r
+		r2.Header = r.Header.Clone()
+		r2.Header.Del(header)
+		h.ServeHTTP(w, &r2)
+	})
+}
+
+// NewReverseProxy creates a reverse proxy to a backend
+//
+// It's meant to be placed after the authentication middleware, the requests
+// sent to the backend will include the headers set by the middleware.
+// Any X-Forwarded-For header from the client is replaced with the client's IP.
+func NewReverseProxy(target *url.URL, setters ...ProxyOptionSetter) http.Handler {
+	options := &ProxyOptions{}
+
+	for _, setter := range setters {
+		setter(options)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = options.Transport
+	proxy.FlushInterval = options.FlushInterval
+
+	if options.BufferSize > 0 {
+		proxy.BufferPool = newBufferPool(options.BufferSize)
+	}
+
+	defaultDirector := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		if options.StripPrefix != "" {
+			if path, ok := rewritePrefix(r.URL.Path, options.StripPrefix, options.ReplacePrefix); ok {
+				r.URL.Path = path
+				// Keep the original encoding of the rest of the path if possible
+				r.URL.RawPath, ok = rewritePrefix(r.URL.RawPath, options.StripPrefix, options.ReplacePrefix)
+				if !ok {
+					r.URL.RawPath = ""
+				}
+			}
+		}
+
+		if prefix := options.entityPrefix(r); prefix != "" {
+			// An empty prefix matches every path
+			r.URL.Path, _ = rewritePrefix(r.URL.Path, "", prefix)
+			if r.URL.RawPath != "" {
+				r.URL.RawPath, _ = rewritePrefix(r.URL.RawPath, "", prefix)
+			}
+		}
+
+		defaultDirector(r)
+
+		if options.ForwardedHeaders {
+			proto := "http"
+			if r.TLS != nil {
+				proto = "https"
+			}
+			r.Header.Set("X-Forwarded-Proto", proto)
+			r.Header.Set("X-Forwarded-Host", r.Host)
+		}
+
+		if options.Director != nil {
+			options.Director(r)
+		}
+	}
+
+	var h http.Handler = proxy
+
+	if options.StripPrefix != "" && options.RejectUnmatchedPrefix {
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := rewritePrefix(r.URL.Path, options.StripPrefix, ""); !ok {
+				http.NotFound(w, r)
+				return
+			}
+			proxy.ServeHTTP(w, r)
+		})
+	}
+
+	return stripHeader(h, "X-Forwarded-For")
+}
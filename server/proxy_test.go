@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRewritePrefix(t *testing.T) {
+	cases := []struct {
+		path, prefix, replacement string
+		want                      string
+		ok                        bool
+	}{
+		{"/api/foo", "/api", "", "/foo", true},
+		{"/api/foo", "/api/", "", "/foo", true},
+		{"/api", "/api", "", "/", true},
+		{"/api/foo", "/api", "/v2", "/v2/foo", true},
+		{"/apis/foo", "/api", "", "/apis/foo", false},
+		{"/other", "/api", "", "/other", false},
+	}
+
+	for _, c := range cases {
+		got, ok := rewritePrefix(c.path, c.prefix, c.replacement)
+		if got != c.want || ok != c.ok {
+			t.Errorf("rewritePrefix(%s, %s, %s) = %s, %v, expected %s, %v",
+				c.path, c.prefix, c.replacement, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestProxyRewritePrefix(t *testing.T) {
+	var backendPath string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendPath = r.URL.Path
+	}))
+	defer backend.Close()
+
+	target, _ := url.Parse(backend.URL)
+	proxy := NewReverseProxy(target, ProxyRewritePrefix("/api", "", true))
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/api/foo", nil))
+	if rec.Code != http.StatusOK || backendPath != "/foo" {
+		t.Errorf("Expected /foo at the backend, got %d %s", rec.Code, backendPath)
+	}
+
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/other", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unmatched prefix, got %d", rec.Code)
+	}
+}
+
+func TestProxyEntityPrefixes(t *testing.T) {
+	var backendPath string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendPath = r.URL.Path
+	}))
+	defer backend.Close()
+
+	target, _ := url.Parse(backend.URL + "/base")
+	proxy := NewReverseProxy(target,
+		ProxyRewritePrefix("/api", "", false),
+		ProxyEntityPrefixes([]EntityPrefix{
+			{EntityIDs: []string{"https://legacy.example.com"}, Prefix: "/v1"},
+		}, "/v2/"))
+
+	cases := []struct {
+		entityID string
+		path     string
+		expected string
+	}{
+		{"https://legacy.example.com", "/api/orders", "/base/v1/orders"},
+		{"https://other.example.com", "/api/orders", "/base/v2/orders"},
+		{"https://other.example.com", "/", "/base/v2/"},
+	}
+
+	for _, c := range cases {
+		r := newRoutedRequest(c.entityID)
+		r.URL.Path = c.path
+
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, r)
+		if rec.Code != http.StatusOK || backendPath != c.expected {
+			t.Errorf("%s for %s: expected %s at the backend, got %d %s",
+				c.entityID, c.path, c.expected, rec.Code, backendPath)
+		}
+	}
+}
+
+// A reader producing n bytes without allocating them up front
+type zeroReader struct {
+	remaining int64
+}
+
+func (z *zeroReader) Read(p []byte) (int, error) {
+	if z.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > z.remaining {
+		p = p[:z.remaining]
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	z.remaining -= int64(len(p))
+	return len(p), nil
+}
+
+func TestProxyStreamsRequestBody(t *testing.T) {
+	const size = 64 << 20
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, r.Body)
+		if err != nil {
+			t.Errorf("Backend failed to read body: %v", err)
+		}
+		fmt.Fprintf(w, "%d", n)
+	}))
+	defer backend.Close()
+
+	target, _ := url.Parse(backend.URL)
+	// With a backend timeout, like in Bowness itself
+	proxy := httptest.NewServer(withTimeout(NewReverseProxy(target), time.Minute))
+	defer proxy.Close()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	req, _ := http.NewRequest("POST", proxy.URL, &zeroReader{remaining: size})
+	req.ContentLength = size
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+
+	runtime.ReadMemStats(&after)
+
+	if string(body) != fmt.Sprint(size) {
+		t.Fatalf("Backend received %s bytes, expected %d", body, size)
+	}
+
+	// Buffering the body would allocate at least its size
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/4 {
+		t.Errorf("Uploading %d bytes allocated %d bytes, the body seems to be buffered", size, allocated)
+	}
+}
+
+func TestProxyHeadAndEmptyResponses(t *testing.T) {
+	const contentLength = "1234"
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/empty" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", contentLength)
+		w.Header().Set("ETag", `"v1"`)
+		if r.Method != "HEAD" {
+			w.Write(make([]byte, 1234))
+		}
+	}))
+	defer backend.Close()
+
+	target, _ := url.Parse(backend.URL)
+	// The backend timeout mustn't add a body or change the Content-Length
+	// of HEAD responses
+	proxy := httptest.NewServer(withTimeout(NewReverseProxy(target), time.Minute))
+	defer proxy.Close()
+
+	response, err := http.Head(proxy.URL)
+	if err != nil {
+		t.Fatalf("HEAD request failed: %v", err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200, got %d", response.StatusCode)
+	}
+	if got := response.Header.Get("Content-Length"); got != contentLength {
+		t.Errorf("Expected Content-Length %s, got %q", contentLength, got)
+	}
+	if got := response.Header.Get("ETag"); got != `"v1"` {
+		t.Errorf("Expected ETag to be passed on, got %q", got)
+	}
+	if len(body) != 0 {
+		t.Errorf("Expected no body for HEAD, got %d bytes", len(body))
+	}
+
+	response, err = http.Get(proxy.URL + "/empty")
+	if err != nil {
+		t.Fatalf("GET request failed: %v", err)
+	}
+	body, _ = io.ReadAll(response.Body)
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK || response.ContentLength != 0 || len(body) != 0 {
+		t.Errorf("Expected empty 200 response, got %d with Content-Length %d and %d bytes",
+			response.StatusCode, response.ContentLength, len(body))
+	}
+}
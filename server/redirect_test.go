@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPSRedirectHandler(t *testing.T) {
+	cases := []struct {
+		port, host, target, expected string
+	}{
+		{"443", "example.com", "/a/b?x=1&y=2", "https://example.com/a/b?x=1&y=2"},
+		{"443", "example.com:80", "/", "https://example.com/"},
+		{"", "example.com:8080", "/a", "https://example.com/a"},
+		{"8443", "example.com:8080", "/a%2Fb", "https://example.com:8443/a%2Fb"},
+		{"443", "[::1]:80", "/", "https://[::1]/"},
+		{"8443", "[::1]", "/", "https://[::1]:8443/"},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", c.target, nil)
+		req.Host = c.host
+		rec := httptest.NewRecorder()
+		HTTPSRedirectHandler(c.port).ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusPermanentRedirect {
+			t.Errorf("Expected 308 for %s%s, got %d", c.host, c.target, rec.Code)
+		}
+		if location := rec.Header().Get("Location"); location != c.expected {
+			t.Errorf("Expected redirect to %s, got %s", c.expected, location)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = ""
+	rec := httptest.NewRecorder()
+	HTTPSRedirectHandler("443").ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a host, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+// A Route sends requests from some authenticated peers to a specific handler
+//
+// A request matches the route if the peer's entity ID is one of EntityIDs,
+// or if its organization ID is one of OrganizationIDs.
+type Route struct {
+	EntityIDs       []string
+	OrganizationIDs []string
+	Handler         http.Handler
+
+	// Used by RouteTimeouts, zero means the default timeout
+	Timeout time.Duration
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the authenticated peer is one of entityIDs or belongs to one of
+// organizationIDs
+func peerMatches(r *http.Request, entityIDs, organizationIDs []string) bool {
+	ctx := r.Context()
+
+	if contains(entityIDs, EntityIDFromContext(ctx)) {
+		return true
+	}
+
+	orgID := OrganizationIDFromContext(ctx)
+	return orgID != nil && contains(organizationIDs, *orgID)
+}
+
+func (route *Route) matches(r *http.Request) bool {
+	return peerMatches(r, route.EntityIDs, route.OrganizationIDs)
+}
+
+// EntityRouter returns a handler which sends each request to the handler of
+// the first route matching the authenticated peer, or to defaultHandler if
+// no route matches.
+//
+// It must be placed after the authentication middleware.
+func EntityRouter(routes []Route, defaultHandler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if i := matchingRoute(routes, r); i >= 0 {
+			routes[i].Handler.ServeHTTP(w, r)
+			return
+		}
+		defaultHandler.ServeHTTP(w, r)
+	})
+}
+
+// Returns the index of the first route matching the request, or -1
+func matchingRoute(routes []Route, r *http.Request) int {
+	for i := range routes {
+		if routes[i].matches(r) {
+			return i
+		}
+	}
+	return -1
+}
+
+// RouteTimeouts returns a handler which passes requests on to h with a
+// timeout (a deadline in the request's context) depending on the route
+// matching the authenticated peer. Requests which haven't been responded to
+// when the deadline passes get 503 Service Unavailable. Routes without a
+// Timeout, and requests which don't match any route, get defaultTimeout.
+// A timeout of zero means none.
+//
+// The routes' handlers aren't used, so the same routes can be given to an
+// EntityRouter further in, with other middleware (such as rate limiting)
+// in between whose time should count towards the timeout.
+//
+// CONNECT requests (see ConnectTunnel) are passed on without a timeout,
+// since a tunnel is expected to be long lived.
+//
+// It must be placed after the authentication middleware.
+func RouteTimeouts(h http.Handler, routes []Route, defaultTimeout time.Duration) http.Handler {
+	defaultHandler := withTimeout(h, defaultTimeout)
+	handlers := make([]http.Handler, len(routes))
+	for i := range routes {
+		if routes[i].Timeout > 0 {
+			handlers[i] = withTimeout(h, routes[i].Timeout)
+		} else {
+			handlers[i] = defaultHandler
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if i := matchingRoute(routes, r); i >= 0 {
+			handlers[i].ServeHTTP(w, r)
+			return
+		}
+		defaultHandler.ServeHTTP(w, r)
+	})
+}
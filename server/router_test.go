@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Creates a request as it looks after the authentication middleware
+func newRoutedRequest(entityID string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	ctx := context.WithValue(r.Context(), entityIDKey, entityID)
+	ctx = context.WithValue(ctx, organizationIDKey, (*string)(nil))
+	return r.WithContext(ctx)
+}
+
+func TestEntityRouter(t *testing.T) {
+	target := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		})
+	}
+
+	orgID := "123456-7890"
+	routes := []Route{
+		{EntityIDs: []string{"https://a.example.com"}, Handler: target("a")},
+		{OrganizationIDs: []string{orgID}, Handler: target("org")},
+		{EntityIDs: []string{"https://a.example.com", "https://b.example.com"}, Handler: target("b")},
+	}
+	h := EntityRouter(routes, target("default"))
+
+	tests := []struct {
+		entityID string
+		orgID    *string
+		expected string
+	}{
+		{"https://a.example.com", nil, "a"},
+		{"https://b.example.com", nil, "b"},
+		{"https://c.example.com", &orgID, "org"},
+		{"https://a.example.com", &orgID, "a"}, // The first matching route wins
+		{"https://c.example.com", nil, "default"},
+	}
+
+	for _, test := range tests {
+		r := newRoutedRequest(test.entityID)
+		r = r.WithContext(context.WithValue(r.Context(), organizationIDKey, test.orgID))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Body.String() != test.expected {
+			t.Errorf("%s: expected route %s, got %s", test.entityID, test.expected, w.Body.String())
+		}
+	}
+}
+
+func TestRouteTimeouts(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	})
+
+	routes := []Route{
+		{EntityIDs: []string{"https://slow.example.com"}, Timeout: time.Minute},
+		{EntityIDs: []string{"https://other.example.com"}},
+	}
+	h := RouteTimeouts(backend, routes, 50*time.Millisecond)
+
+	tests := []struct {
+		entityID string
+		expected int
+	}{
+		{"https://slow.example.com", http.StatusOK},
+		{"https://other.example.com", http.StatusServiceUnavailable},
+		{"https://unrouted.example.com", http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRoutedRequest(test.entityID))
+		if w.Code != test.expected {
+			t.Errorf("%s: expected %d, got %d", test.entityID, test.expected, w.Code)
+		}
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"context"
 	"crypto/tls"
 	"net"
+	"sync"
 )
 
 // AuthStatus shows us if a connection is authenticated and if so, who the peer is
@@ -26,6 +27,16 @@ type AuthStatus struct {
 
 	// Set if Granted == true and there was an organization id attribute for the entity in metadata
 	OrganizationID *string
+
+	// The metadata store's version when the status was determined
+	version uint64
+
+	// The metadata store's MetadataHash when the status was determined
+	metadataHash string
+
+	// Descriptions of the entity's clients, as a header value
+	// (only set if the middleware is configured to send them)
+	clientDescriptions string
 }
 
 // ContextConnection is stored in the context used for all requests for a server
@@ -36,8 +47,44 @@ type ContextConnection struct {
 	// The authentication status of the connection.
 	// nil means it's the first request and we haven't checked yet,
 	// the middleware should do the authentication and set auth
-	// apropriately.
+	// apropriately. An AuthStatus is never modified once it's set, a new
+	// one replaces it.
 	auth *AuthStatus
+
+	// Protects auth, with HTTP/2 requests on the same connection are
+	// handled concurrently
+	lock sync.Mutex
+}
+
+// Returns the connection's current authentication status (nil if it hasn't
+// been authenticated yet)
+func (connection *ContextConnection) currentAuth() *AuthStatus {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	return connection.auth
+}
+
+// Returns the connection's authentication status. If it hasn't been
+// authenticated yet, or if stale returns true for the current status, the
+// status is replaced with the result of authenticate. fresh tells if that
+// happened, previous is the status which was replaced (nil if none).
+//
+// Concurrent requests wait for an ongoing authentication, so a connection
+// is only authenticated once per change.
+func (connection *ContextConnection) authenticate(stale func(*AuthStatus) bool,
+	authenticate func() *AuthStatus) (auth, previous *AuthStatus, fresh bool) {
+
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	if connection.auth != nil && !stale(connection.auth) {
+		return connection.auth, nil, false
+	}
+
+	previous = connection.auth
+	connection.auth = authenticate()
+	return connection.auth, previous, true
 }
 
 type connContextKey int
@@ -52,18 +99,45 @@ type ConnContext func(ctx context.Context, c net.Conn) context.Context
 // The context will contain a ContextConnection, which allows the middleware
 // to do the authentication based on client cert if it hasn't been done, or check
 // the result of this authentication if it was done in a previous request.
+//
+// Connections which aren't TLS connections are left without a
+// ContextConnection, requests on them are rejected by the middleware.
+//
+// If you need a ConnContext of your own as well, combine them with
+// ComposeConnContext.
 func ContextModifier() ConnContext {
 	return func(ctx context.Context, c net.Conn) context.Context {
-		return context.WithValue(ctx, connKey, &ContextConnection{conn: c.(*tls.Conn)})
+		conn, ok := c.(*tls.Conn)
+		if !ok {
+			return ctx
+		}
+		return context.WithValue(ctx, connKey, &ContextConnection{conn: conn})
 	}
+}
 
+// ComposeConnContext combines several ConnContext functions into one, which
+// can be used as the http.Server's ConnContext. They're called in order, each
+// one gets the context returned by the previous one.
+//
+// Since the ContextConnection is stored under a key private to this package,
+// other functions can add their own values without affecting it (as long as
+// they derive their context from the one they're given).
+func ComposeConnContext(fns ...ConnContext) ConnContext {
+	return func(ctx context.Context, c net.Conn) context.Context {
+		for _, fn := range fns {
+			ctx = fn(ctx, c)
+		}
+		return ctx
+	}
 }
 
-// ConnectionFromContext gets the ContextConnection from the context.
+// ConnectionFromContext gets the ContextConnection from the context,
+// or nil if the server wasn't set up with ContextModifier.
 //
 // Typically called from the authentication middleware to do the
 // authentication and either deny the request or send it through
 // to the actual request handler.
 func ConnectionFromContext(ctx context.Context) *ContextConnection {
-	return ctx.Value(connKey).(*ContextConnection)
+	connection, _ := ctx.Value(connKey).(*ContextConnection)
+	return connection
 }
@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+type testContextKey int
+
+func TestComposeConnContext(t *testing.T) {
+	client, srv := net.Pipe()
+	defer client.Close()
+	defer srv.Close()
+	conn := tls.Server(srv, &tls.Config{})
+
+	own := func(ctx context.Context, c net.Conn) context.Context {
+		return context.WithValue(ctx, testContextKey(0), "own value")
+	}
+
+	for _, connContext := range []ConnContext{
+		ComposeConnContext(ContextModifier(), own),
+		ComposeConnContext(own, ContextModifier()),
+	} {
+		ctx := connContext(context.Background(), conn)
+
+		if connection := ConnectionFromContext(ctx); connection == nil || connection.conn != conn {
+			t.Errorf("ContextConnection missing after composition")
+		}
+
+		if ctx.Value(testContextKey(0)) != "own value" {
+			t.Errorf("Own value missing after composition")
+		}
+	}
+}
+
+func TestConnectionFromContextMissing(t *testing.T) {
+	if ConnectionFromContext(context.Background()) != nil {
+		t.Errorf("Expected nil without ContextModifier")
+	}
+
+	client, srv := net.Pipe()
+	defer client.Close()
+	defer srv.Close()
+
+	ctx := ContextModifier()(context.Background(), srv)
+	if ConnectionFromContext(ctx) != nil {
+		t.Errorf("Expected nil for a connection which isn't a TLS connection")
+	}
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/joesiltberg/bowness/fedtls"
+)
+
+// IssuerPool returns a pool with the certificates of all issuers in metadata,
+// the same certificates which are trusted for client certificates
+func IssuerPool(issuers fedtls.IssuersPerEntity) *x509.CertPool {
+	pool, _ := buildCertPool(issuers, nil)
+	return pool
+}
+
+// VerifyServerCertificate checks that the server certificate in certFile
+// chains to one of roots. Any certificates following the server certificate
+// in certFile are used as intermediates.
+//
+// In some federations the server certificate must be issued by an issuer
+// registered in metadata, otherwise clients will reject it. Checking this
+// at start up catches such misconfigurations early.
+func VerifyServerCertificate(certFile string, roots *x509.CertPool) error {
+	data, err := os.ReadFile(certFile)
+
+	if err != nil {
+		return err
+	}
+
+	certs, err := parseServerCertificates(data)
+
+	if err != nil {
+		return err
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	if _, err := certs[0].Verify(opts); err != nil {
+		return fmt.Errorf("Server certificate (%s) isn't issued by a trusted issuer: %v",
+			certs[0].Subject, err)
+	}
+	return nil
+}
+
+// Parses the certificates in a server certificate file. Unlike issuers in
+// metadata, a certificate which can't be parsed is an error.
+func parseServerCertificates(pemData []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+
+	for {
+		var block *pem.Block
+		block, pemData = pem.Decode(pemData)
+
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse certificate %d: %v", len(certs)+1, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("No certificates found")
+	}
+	return certs, nil
+}
+
+// Parses the first private key in PEM data, in any of the formats
+// supported by tls.X509KeyPair
+func parsePrivateKey(pemData []byte) error {
+	for {
+		var block *pem.Block
+		block, pemData = pem.Decode(pemData)
+
+		if block == nil {
+			return errors.New("no private key found")
+		}
+
+		if block.Type != "PRIVATE KEY" && !strings.HasSuffix(block.Type, " PRIVATE KEY") {
+			continue
+		}
+
+		if _, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+			return nil
+		}
+		if _, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+			return nil
+		}
+		if _, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+			return nil
+		}
+		return errors.New("failed to parse private key")
+	}
+}
+
+// Loads the server's certificate and key like tls.LoadX509KeyPair, but with
+// errors which tell an unreadable file, an invalid certificate or key, and
+// a key which doesn't match the certificate apart
+func loadServerCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Failed to read server certificate file: %v", err)
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Failed to read server key file: %v", err)
+	}
+
+	certs, err := parseServerCertificates(certPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Invalid server certificate file (%s): %v", certFile, err)
+	}
+
+	if err := parsePrivateKey(keyPEM); err != nil {
+		return tls.Certificate{}, fmt.Errorf("Invalid server key file (%s): %v", keyFile, err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		// Both could be parsed on their own
+		return tls.Certificate{}, fmt.Errorf("Server key (%s) doesn't match the certificate (%s, subject %s): %v",
+			keyFile, certFile, certs[0].Subject, err)
+	}
+
+	cert.Leaf = certs[0]
+	return cert, nil
+}
+
+// Returns an error if a certificate isn't valid at the time now
+func checkValidity(cert *x509.Certificate, now time.Time) error {
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("Server certificate (%s) expired at %s",
+			cert.Subject, cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("Server certificate (%s) isn't valid until %s",
+			cert.Subject, cert.NotBefore.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
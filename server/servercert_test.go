@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joesiltberg/bowness/fedtls"
+)
+
+// Creates a server certificate issued by parent
+func newTestServerCert(t *testing.T, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(4711),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent.cert, &key.PublicKey, parent.key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+
+	return &testCert{cert: cert, key: key}
+}
+
+func TestVerifyServerCertificate(t *testing.T) {
+	root := newTestCert(t, "Root CA", true, nil)
+	intermediate := newTestCert(t, "Intermediate CA", true, root)
+	other := newTestCert(t, "Other CA", true, nil)
+	serverCert := newTestServerCert(t, intermediate)
+
+	certFile := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(certFile, []byte(toPEM(serverCert, intermediate)), 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+
+	trusted := IssuerPool(fedtls.IssuersPerEntity{
+		"https://example.com": []fedtls.Issuer{{X509certificate: toPEM(root)}},
+	})
+
+	if err := VerifyServerCertificate(certFile, trusted); err != nil {
+		t.Errorf("Server certificate from trusted issuer rejected: %v", err)
+	}
+
+	untrusted := IssuerPool(fedtls.IssuersPerEntity{
+		"https://example.com": []fedtls.Issuer{{X509certificate: toPEM(other)}},
+	})
+
+	if err := VerifyServerCertificate(certFile, untrusted); err == nil {
+		t.Errorf("Server certificate from untrusted issuer accepted")
+	}
+}
+
+func TestLoadServerCertificate(t *testing.T) {
+	root := newTestCert(t, "Root CA", true, nil)
+	serverCert := newTestServerCert(t, root)
+	dir := t.TempDir()
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return path
+	}
+
+	keyPEM := func(c *testCert) string {
+		der, err := x509.MarshalECPrivateKey(c.key)
+		if err != nil {
+			t.Fatalf("Failed to marshal key: %v", err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	}
+
+	certFile := write("cert.pem", toPEM(serverCert))
+	keyFile := write("key.pem", keyPEM(serverCert))
+	otherKeyFile := write("other.pem", keyPEM(root))
+	garbageFile := write("garbage.pem", "garbage")
+	corruptFile := write("corrupt.pem", toPEM(serverCert)+
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("corrupt")})))
+
+	cert, err := loadServerCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load matching certificate and key: %v", err)
+	}
+	if cert.Leaf == nil || cert.Leaf.Subject.CommonName != "server" {
+		t.Errorf("Leaf not set")
+	}
+
+	cases := []struct {
+		certFile string
+		keyFile  string
+		expected string
+	}{
+		{filepath.Join(dir, "missing.pem"), keyFile, "Failed to read server certificate file"},
+		{certFile, filepath.Join(dir, "missing.pem"), "Failed to read server key file"},
+		{garbageFile, keyFile, "No certificates found"},
+		{corruptFile, keyFile, "Failed to parse certificate 2"},
+		{certFile, garbageFile, "Invalid server key file"},
+		{certFile, otherKeyFile, "doesn't match the certificate"},
+	}
+
+	for _, c := range cases {
+		_, err := loadServerCertificate(c.certFile, c.keyFile)
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("Expected error containing %q, got %v", c.expected, err)
+		}
+	}
+}
+
+func TestCheckValidity(t *testing.T) {
+	cert := newTestCert(t, "server", false, nil).cert
+
+	if err := checkValidity(cert, time.Now()); err != nil {
+		t.Errorf("Valid certificate rejected: %v", err)
+	}
+
+	if err := checkValidity(cert, time.Now().Add(2*time.Hour)); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Expected expired certificate to be rejected, got %v", err)
+	}
+
+	if err := checkValidity(cert, time.Now().Add(-2*time.Hour)); err == nil || !strings.Contains(err.Error(), "isn't valid until") {
+		t.Errorf("Expected certificate which isn't valid yet to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+)
+
+// LoadSessionTicketKeys reads TLS session ticket keys from a file
+//
+// The file should contain one base64 encoded 32 byte key per line, the first
+// key is used for new tickets. Empty lines and lines starting with # are ignored.
+func LoadSessionTicketKeys(path string) ([][32]byte, error) {
+	content, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var keys [][32]byte
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(line)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode session ticket key on line %d: %v", i+1, err)
+		}
+
+		if len(decoded) != 32 {
+			return nil, fmt.Errorf("Session ticket key on line %d is %d bytes, expected 32", i+1, len(decoded))
+		}
+
+		var key [32]byte
+		copy(key[:], decoded)
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No session ticket keys found in %s", path)
+	}
+	return keys, nil
+}
+
+// A SessionTicketKeySetter is something which can have its TLS session
+// ticket keys replaced, like a TLSConfigManager
+type SessionTicketKeySetter interface {
+	SetSessionTicketKeys(keys [][32]byte)
+}
+
+// RotateSessionTicketKeys sets session ticket keys and replaces them at the
+// given interval, in a goroutine.
+//
+// If path is set, the keys are read from that file (see LoadSessionTicketKeys)
+// and re-read at each interval, so keys can be rotated by an external tool and
+// shared between instances. Failing to re-read the file is logged and the
+// current keys are kept. If path is empty, a new random key is generated at
+// each interval, the previous key is kept for decryption only.
+func RotateSessionTicketKeys(setter SessionTicketKeySetter, path string, interval time.Duration) error {
+	var previous *[32]byte
+
+	next := func() ([][32]byte, error) {
+		if path != "" {
+			return LoadSessionTicketKeys(path)
+		}
+
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return nil, err
+		}
+
+		keys := [][32]byte{key}
+		if previous != nil {
+			keys = append(keys, *previous)
+		}
+		previous = &key
+		return keys, nil
+	}
+
+	keys, err := next()
+	if err != nil {
+		return err
+	}
+	setter.SetSessionTicketKeys(keys)
+
+	if interval <= 0 {
+		return nil
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			keys, err := next()
+
+			if err != nil {
+				log.Printf("Failed to rotate session ticket keys: %v", err)
+				continue
+			}
+			setter.SetSessionTicketKeys(keys)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Records the keys it's given, so a test can wait for them
+type keyRecorder chan [][32]byte
+
+func (r keyRecorder) SetSessionTicketKeys(keys [][32]byte) {
+	r <- keys
+}
+
+func (r keyRecorder) next(t *testing.T) [][32]byte {
+	t.Helper()
+
+	select {
+	case keys := <-r:
+		return keys
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for session ticket keys")
+		return nil
+	}
+}
+
+func testTicketKey(b byte) [32]byte {
+	var key [32]byte
+	for i := range key {
+		key[i] = b
+	}
+	return key
+}
+
+func writeTicketKeys(t *testing.T, path string, lines ...string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatalf("Failed to write session ticket keys: %v", err)
+	}
+}
+
+func encodeTicketKey(key [32]byte) string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+func TestLoadSessionTicketKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tickets")
+	writeTicketKeys(t, path, "# Current key first", encodeTicketKey(testTicketKey(1)), "",
+		"  "+encodeTicketKey(testTicketKey(2)))
+
+	keys, err := LoadSessionTicketKeys(path)
+	if err != nil {
+		t.Fatalf("Failed to load session ticket keys: %v", err)
+	}
+	if len(keys) != 2 || keys[0] != testTicketKey(1) || keys[1] != testTicketKey(2) {
+		t.Errorf("Unexpected keys: %v", keys)
+	}
+
+	malformed := map[string][]string{
+		"not base64":   {encodeTicketKey(testTicketKey(1)), "not base64!"},
+		"wrong length": {base64.StdEncoding.EncodeToString([]byte("short"))},
+		"no keys":      {"# Nothing here", ""},
+	}
+
+	for name, lines := range malformed {
+		writeTicketKeys(t, path, lines...)
+		if _, err := LoadSessionTicketKeys(path); err == nil {
+			t.Errorf("File with %s was accepted", name)
+		}
+	}
+
+	if _, err := LoadSessionTicketKeys(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("Missing file was accepted")
+	}
+}
+
+func TestRotateSessionTicketKeysFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tickets")
+	writeTicketKeys(t, path, encodeTicketKey(testTicketKey(1)))
+
+	recorder := make(keyRecorder, 1)
+	if err := RotateSessionTicketKeys(recorder, path, 20*time.Millisecond); err != nil {
+		t.Fatalf("Failed to set session ticket keys: %v", err)
+	}
+
+	if keys := recorder.next(t); len(keys) != 1 || keys[0] != testTicketKey(1) {
+		t.Fatalf("Unexpected initial keys: %v", keys)
+	}
+
+	// A malformed file is skipped, the current keys are kept until the
+	// file is fixed
+	writeTicketKeys(t, path, "not base64!")
+	time.Sleep(60 * time.Millisecond)
+	select {
+	case keys := <-recorder:
+		if keys[0] != testTicketKey(1) {
+			t.Errorf("Keys were replaced with a malformed file's: %v", keys)
+		}
+	default:
+	}
+
+	writeTicketKeys(t, path, encodeTicketKey(testTicketKey(2)), encodeTicketKey(testTicketKey(1)))
+	for {
+		keys := recorder.next(t)
+		if keys[0] == testTicketKey(2) {
+			if len(keys) != 2 || keys[1] != testTicketKey(1) {
+				t.Errorf("Unexpected rotated keys: %v", keys)
+			}
+			break
+		}
+	}
+}
+
+func TestRotateSessionTicketKeysMalformedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tickets")
+	writeTicketKeys(t, path, "not base64!")
+
+	if err := RotateSessionTicketKeys(make(keyRecorder, 1), path, 0); err == nil {
+		t.Errorf("Malformed session ticket key file was accepted at start up")
+	}
+}
+
+// Without a file, a new random key is generated each interval and the
+// previous one is kept for decryption
+func TestRotateSessionTicketKeysRandom(t *testing.T) {
+	recorder := make(keyRecorder, 1)
+	if err := RotateSessionTicketKeys(recorder, "", 20*time.Millisecond); err != nil {
+		t.Fatalf("Failed to set session ticket keys: %v", err)
+	}
+
+	first := recorder.next(t)
+	if len(first) != 1 {
+		t.Fatalf("Expected a single initial key, got %d", len(first))
+	}
+
+	second := recorder.next(t)
+	if len(second) != 2 || second[1] != first[0] || second[0] == first[0] {
+		t.Errorf("Expected a new key followed by the previous one")
+	}
+}
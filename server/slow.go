@@ -0,0 +1,36 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// SlowRequestLogger returns a middleware which logs requests taking longer
+// than threshold for h to handle, together with the entity and path.
+// If onSlow isn't nil it's also called for each such request (for instance
+// to update a metric).
+//
+// It must be placed after the authentication middleware.
+func SlowRequestLogger(h http.Handler, threshold time.Duration, onSlow func(r *http.Request, elapsed time.Duration)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h.ServeHTTP(w, r)
+		elapsed := time.Since(start)
+
+		if elapsed > threshold {
+			log.Printf("WARNING: Slow request from %s: %s %s took %v",
+				EntityIDFromContext(r.Context()), r.Method, r.URL.Path, elapsed)
+			if onSlow != nil {
+				onSlow(r, elapsed)
+			}
+		}
+	})
+}
@@ -0,0 +1,45 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSlowRequestLogger(t *testing.T) {
+	delay := 0 * time.Millisecond
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	slow := 0
+	h := SlowRequestLogger(backend, 20*time.Millisecond, func(r *http.Request, elapsed time.Duration) {
+		slow++
+	})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, newEntityRequest("https://example.com", "/"))
+	if slow != 0 {
+		t.Errorf("Fast request reported as slow")
+	}
+
+	delay = 30 * time.Millisecond
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newEntityRequest("https://example.com", "/"))
+	if slow != 1 {
+		t.Errorf("Slow request not reported")
+	}
+
+	if rec.Code != http.StatusTeapot {
+		t.Errorf("Response was modified, got %d", rec.Code)
+	}
+}
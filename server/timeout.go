@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// A timeoutWriter replaces the response with 503 Service Unavailable if the
+// handler hasn't started responding when its request's deadline passes
+// (for instance the reverse proxy's 502 Bad Gateway)
+type timeoutWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (w *timeoutWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if errors.Is(w.ctx.Err(), context.DeadlineExceeded) {
+		w.timedOut = true
+		http.Error(w.ResponseWriter, "Backend timeout", http.StatusServiceUnavailable)
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *timeoutWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.timedOut {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *timeoutWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.timedOut {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+func (w *timeoutWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Passes requests on to h with a deadline timeout from now in their
+// context, requests which haven't been responded to by then get 503
+// Service Unavailable. Unlike http.TimeoutHandler the response isn't
+// buffered, so streamed responses (such as server-sent events) are flushed
+// to the client as they're written, and the connection can be hijacked.
+// h must give up when the request's context is done, as the reverse proxy
+// does. A timeout of zero means none, and CONNECT requests never time out.
+func withTimeout(h http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		tw := &timeoutWriter{ResponseWriter: w, ctx: ctx}
+		h.ServeHTTP(tw, r.WithContext(ctx))
+
+		if !tw.wroteHeader && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			tw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+}
@@ -0,0 +1,43 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithTimeout(t *testing.T) {
+	// Like the reverse proxy when the backend doesn't answer in time
+	gaveUp := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+	})
+
+	w := httptest.NewRecorder()
+	withTimeout(gaveUp, 10*time.Millisecond).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "Backend timeout") {
+		t.Errorf("Expected 503 Backend timeout, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Responses started in time are passed on as they are
+	started := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		<-r.Context().Done()
+		w.Write([]byte("partial"))
+	})
+
+	w = httptest.NewRecorder()
+	withTimeout(started, 10*time.Millisecond).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusAccepted || w.Body.String() != "partial" {
+		t.Errorf("Expected the started response, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -10,7 +10,13 @@ package server
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
 	"sync"
+	"time"
 )
 
 // The TLSConfigManager constructs a dynamic tls.Config object used by TLS listeners.
@@ -22,50 +28,212 @@ type TLSConfigManager struct {
 	defaultConfig *tls.Config
 	currentConfig *tls.Config
 
+	// Used instead of currentConfig as long as it's nil, if
+	// HandshakeWhenNotReady is set
+	notReadyConfig *tls.Config
+
 	// Our server cert, not currently hot-swappable
 	certs []tls.Certificate
 
+	options *TLSOptions
+
+	// Explicitly set session ticket keys, nil means crypto/tls manages them
+	sessionTicketKeys [][32]byte
+
 	lock sync.Mutex
 }
 
+// TLSOptions are optional settings for the TLS configuration
+type TLSOptions struct {
+	// Called after the client's certificate has been verified during the
+	// handshake, if it returns an error the handshake fails
+	VerifyConnection func(tls.ConnectionState) error
+
+	// Disable TLS session resumption with session tickets
+	SessionTicketsDisabled bool
+
+	// A metadata update resulting in fewer trusted issuers than this is
+	// ignored, and the previously trusted issuers are kept
+	// (only used by MetadataTLSConfigManager)
+	MinTrustedIssuers int
+
+	// Called when a metadata update is ignored because of MinTrustedIssuers,
+	// with the number of issuers the update would have resulted in
+	OnTrustUpdateRejected func(issuers int)
+
+	// Application protocols offered with ALPN, for instance "h2" and
+	// "http/1.1". Without "h2" clients can't negotiate HTTP/2.
+	NextProtos []string
+
+	// Complete handshakes (without verifying the client's certificate)
+	// until trusted issuers have been set, instead of failing them. This
+	// lets the middleware tell clients that the server isn't ready yet,
+	// see NotReadyResponse.
+	HandshakeWhenNotReady bool
+
+	// Fail if the server's certificate has expired or isn't valid yet,
+	// rather than just logging a warning
+	RequireValidServerCert bool
+
+	// Fail handshakes with clients which don't send a server name (SNI)
+	RequireSNI bool
+}
+
+// ErrNoSNI is the handshake error for clients which don't send a server
+// name, when the RequireSNI option is set
+var ErrNoSNI = errors.New("Client didn't send a server name (SNI)")
+
+// A TLSOptionSetter is a function for modifying the TLS options
+type TLSOptionSetter func(*TLSOptions)
+
+// TLSVerifyConnection creates a TLSOptionSetter for setting a function
+// which can reject connections during the handshake
+func TLSVerifyConnection(verify func(tls.ConnectionState) error) TLSOptionSetter {
+	return func(options *TLSOptions) {
+		options.VerifyConnection = verify
+	}
+}
+
+// TLSSessionTicketsDisabled creates a TLSOptionSetter for disabling
+// session tickets
+func TLSSessionTicketsDisabled(disabled bool) TLSOptionSetter {
+	return func(options *TLSOptions) {
+		options.SessionTicketsDisabled = disabled
+	}
+}
+
+// TLSMinTrustedIssuers creates a TLSOptionSetter for setting the minimum
+// number of trusted issuers a metadata update must result in, zero disables
+// the check
+func TLSMinTrustedIssuers(min int) TLSOptionSetter {
+	return func(options *TLSOptions) {
+		options.MinTrustedIssuers = min
+	}
+}
+
+// TLSOnTrustUpdateRejected creates a TLSOptionSetter for setting a callback
+// which is called when a metadata update is ignored because of
+// MinTrustedIssuers
+func TLSOnTrustUpdateRejected(callback func(issuers int)) TLSOptionSetter {
+	return func(options *TLSOptions) {
+		options.OnTrustUpdateRejected = callback
+	}
+}
+
+// TLSNextProtos creates a TLSOptionSetter for setting the application
+// protocols offered with ALPN
+func TLSNextProtos(protos []string) TLSOptionSetter {
+	return func(options *TLSOptions) {
+		options.NextProtos = protos
+	}
+}
+
+// TLSHandshakeWhenNotReady creates a TLSOptionSetter for completing
+// handshakes before any issuers are trusted, see HandshakeWhenNotReady
+func TLSHandshakeWhenNotReady(enabled bool) TLSOptionSetter {
+	return func(options *TLSOptions) {
+		options.HandshakeWhenNotReady = enabled
+	}
+}
+
+// TLSRequireValidServerCert creates a TLSOptionSetter for failing to
+// create the TLS configuration if the server's certificate has expired or
+// isn't valid yet
+func TLSRequireValidServerCert(enabled bool) TLSOptionSetter {
+	return func(options *TLSOptions) {
+		options.RequireValidServerCert = enabled
+	}
+}
+
+// TLSRequireSNI creates a TLSOptionSetter for failing handshakes with
+// clients which don't send a server name (SNI). By default such clients
+// are allowed.
+func TLSRequireSNI(required bool) TLSOptionSetter {
+	return func(options *TLSOptions) {
+		options.RequireSNI = required
+	}
+}
+
 // Returns a tls.Config with some basic settings we want to have
 // both when we're creating the default and the current config.
-func baseTLSConfig(certs []tls.Certificate) *tls.Config {
+func (mgr *TLSConfigManager) baseTLSConfig() *tls.Config {
 	return &tls.Config{
-		Certificates:             certs,
+		Certificates:             mgr.certs,
 		ClientAuth:               tls.RequireAndVerifyClientCert,
 		MinVersion:               tls.VersionTLS12,
 		PreferServerCipherSuites: true,
+		VerifyConnection:         mgr.options.VerifyConnection,
+		SessionTicketsDisabled:   mgr.options.SessionTicketsDisabled,
+		NextProtos:               mgr.options.NextProtos,
 	}
 }
 
-func NewTLSConfigManager(certFile, keyFile string) (*TLSConfigManager, error) {
-	mgr := &TLSConfigManager{}
+// NewTLSConfigManager creates a TLSConfigManager with the server's certificate
+// and key loaded from file. No clients are trusted until SetTrusted is called.
+func NewTLSConfigManager(certFile, keyFile string, setters ...TLSOptionSetter) (*TLSConfigManager, error) {
+	mgr := &TLSConfigManager{
+		options: &TLSOptions{
+			MinTrustedIssuers: 1,
+		},
+	}
+
+	for _, setter := range setters {
+		setter(mgr.options)
+	}
 
-	var err error
-	mgr.certs = make([]tls.Certificate, 1)
-	mgr.certs[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+	cert, err := loadServerCertificate(certFile, keyFile)
 
 	if err != nil {
 		return nil, err
 	}
 
-	getCurrentConfig := func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	log.Printf("Server certificate: subject %s, issuer %s, valid until %s",
+		cert.Leaf.Subject, cert.Leaf.Issuer, cert.Leaf.NotAfter.UTC().Format(time.RFC3339))
+
+	if err := checkValidity(cert.Leaf, time.Now()); err != nil {
+		if mgr.options.RequireValidServerCert {
+			return nil, err
+		}
+		log.Printf("WARNING: %v", err)
+	}
+
+	mgr.certs = []tls.Certificate{cert}
+
+	getCurrentConfig := func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if mgr.options.RequireSNI && hello.ServerName == "" {
+			// crypto/tls answers with an internal error alert
+			return nil, ErrNoSNI
+		}
+
 		mgr.lock.Lock()
 		defer mgr.lock.Unlock()
 
+		if mgr.currentConfig == nil && mgr.notReadyConfig != nil {
+			return mgr.notReadyConfig, nil
+		}
 		return mgr.currentConfig, nil
 	}
 
 	// The default config is only used until valid metadata has been loaded,
 	// it will deny any incoming connections since it requires verified
 	// client certs but none are installed.
-	config := baseTLSConfig(mgr.certs)
+	config := mgr.baseTLSConfig()
 	config.GetConfigForClient = getCurrentConfig
 
 	mgr.defaultConfig = config
 	mgr.currentConfig = nil
 
+	if mgr.options.HandshakeWhenNotReady {
+		// The client's certificate is requested but not verified, so
+		// connections made with this config never get any verified
+		// chains and can't be authenticated. Sessions aren't resumable
+		// since the connection is useless once we're ready.
+		mgr.notReadyConfig = mgr.baseTLSConfig()
+		mgr.notReadyConfig.ClientAuth = tls.RequestClientCert
+		mgr.notReadyConfig.SessionTicketsDisabled = true
+		mgr.notReadyConfig.VerifyConnection = nil
+	}
+
 	return mgr, nil
 }
 
@@ -79,11 +247,92 @@ func (mgr *TLSConfigManager) Config() *tls.Config {
 
 // SetTrusted replaces the client certificate authorities
 func (mgr *TLSConfigManager) SetTrusted(clientCAs *x509.CertPool) {
-	newConfig := baseTLSConfig(mgr.certs)
+	newConfig := mgr.baseTLSConfig()
 	newConfig.ClientCAs = clientCAs
 
 	mgr.lock.Lock()
 	defer mgr.lock.Unlock()
 
+	if mgr.sessionTicketKeys != nil {
+		newConfig.SetSessionTicketKeys(mgr.sessionTicketKeys)
+	}
+
 	mgr.currentConfig = newConfig
 }
+
+// SetSessionTicketKeys replaces the keys used to encrypt and decrypt TLS
+// session tickets. The first key is used for new tickets, the others are
+// only used to decrypt existing tickets (see tls.Config.SetSessionTicketKeys).
+//
+// Setting the same keys in several instances lets clients resume sessions
+// across them, rotating the keys regularly limits how long a compromised
+// key can be used to decrypt recorded sessions.
+func (mgr *TLSConfigManager) SetSessionTicketKeys(keys [][32]byte) {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+
+	mgr.sessionTicketKeys = keys
+	mgr.defaultConfig.SetSessionTicketKeys(keys)
+	if mgr.currentConfig != nil {
+		mgr.currentConfig.SetSessionTicketKeys(keys)
+	}
+}
+
+// Describes the settings of a tls.Config which affect security, as
+// space separated key=value pairs. Settings left to crypto/tls are given
+// as the defaults of the Go version Bowness was built with.
+func describeTLSConfig(config *tls.Config) string {
+	goDefault := "default(" + runtime.Version() + ")"
+
+	version := func(v uint16) string {
+		if v == 0 {
+			return goDefault
+		}
+		return strings.ReplaceAll(tls.VersionName(v), " ", "")
+	}
+
+	cipherSuites := goDefault
+	if config.CipherSuites != nil {
+		names := make([]string, len(config.CipherSuites))
+		for i, id := range config.CipherSuites {
+			names[i] = tls.CipherSuiteName(id)
+		}
+		cipherSuites = strings.Join(names, ",")
+	}
+
+	curves := goDefault
+	if config.CurvePreferences != nil {
+		names := make([]string, len(config.CurvePreferences))
+		for i, id := range config.CurvePreferences {
+			names[i] = id.String()
+		}
+		curves = strings.Join(names, ",")
+	}
+
+	http2 := false
+	for _, proto := range config.NextProtos {
+		if proto == "h2" {
+			http2 = true
+		}
+	}
+
+	return fmt.Sprintf("min_version=%s max_version=%s cipher_suites=%s curves=%s client_auth=%s "+
+		"session_tickets=%t alpn=%s http2=%t",
+		version(config.MinVersion), version(config.MaxVersion), cipherSuites, curves,
+		config.ClientAuth, !config.SessionTicketsDisabled, strings.Join(config.NextProtos, ","), http2)
+}
+
+// Summary describes the effective TLS configuration for verified clients
+// (the one used once trusted issuers have been set), for logging. HTTP/2
+// is considered enabled if "h2" is offered with ALPN, the http.Server must
+// also support it.
+func (mgr *TLSConfigManager) Summary() string {
+	summary := describeTLSConfig(mgr.baseTLSConfig())
+	if mgr.options.HandshakeWhenNotReady {
+		summary += " handshake_when_not_ready=true"
+	}
+	if mgr.options.RequireSNI {
+		summary += " require_sni=true"
+	}
+	return summary
+}
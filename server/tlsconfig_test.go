@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Writes a server certificate and its key to files, returns their paths
+func writeServerCertificate(t *testing.T) (string, string) {
+	t.Helper()
+
+	serverCert := newTestServerCert(t, newTestCert(t, "Root CA", true, nil))
+	der, err := x509.MarshalECPrivateKey(serverCert.key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	if err := os.WriteFile(certFile, []byte(toPEM(serverCert)), 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestDescribeTLSConfig(t *testing.T) {
+	summary := describeTLSConfig(&tls.Config{
+		MinVersion:             tls.VersionTLS12,
+		CurvePreferences:       []tls.CurveID{tls.X25519, tls.CurveP256},
+		ClientAuth:             tls.RequireAndVerifyClientCert,
+		SessionTicketsDisabled: true,
+		NextProtos:             []string{"h2", "http/1.1"},
+	})
+
+	for _, expected := range []string{
+		"min_version=TLS1.2",
+		"max_version=default(" + runtime.Version() + ")",
+		"cipher_suites=default(" + runtime.Version() + ")",
+		"curves=X25519,CurveP256",
+		"client_auth=RequireAndVerifyClientCert",
+		"session_tickets=false",
+		"alpn=h2,http/1.1",
+		"http2=true",
+	} {
+		if !strings.Contains(summary, expected) {
+			t.Errorf("Expected %s in summary: %s", expected, summary)
+		}
+	}
+
+	summary = describeTLSConfig(&tls.Config{
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		NextProtos:   []string{"http/1.1"},
+	})
+
+	for _, expected := range []string{
+		"cipher_suites=TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+		"http2=false",
+	} {
+		if !strings.Contains(summary, expected) {
+			t.Errorf("Expected %s in summary: %s", expected, summary)
+		}
+	}
+}
+
+func TestRequireSNI(t *testing.T) {
+	certFile, keyFile := writeServerCertificate(t)
+
+	for _, required := range []bool{false, true} {
+		mgr, err := NewTLSConfigManager(certFile, keyFile, TLSRequireSNI(required))
+		if err != nil {
+			t.Fatalf("Failed to create TLS configuration: %v", err)
+		}
+		mgr.SetTrusted(x509.NewCertPool())
+		getConfig := mgr.Config().GetConfigForClient
+
+		if _, err := getConfig(&tls.ClientHelloInfo{ServerName: "bowness.example.com"}); err != nil {
+			t.Errorf("Client with SNI rejected (required: %t): %v", required, err)
+		}
+
+		_, err = getConfig(&tls.ClientHelloInfo{})
+		if required && !errors.Is(err, ErrNoSNI) {
+			t.Errorf("Expected client without SNI to be rejected, got %v", err)
+		} else if !required && err != nil {
+			t.Errorf("Client without SNI rejected by default: %v", err)
+		}
+	}
+}
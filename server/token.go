@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// BackendToken configures a signed JWT describing the authenticated client,
+// which the middleware sets in a header of requests to the backend.
+//
+// The backend can verify the token with the proxy's public key, so it
+// doesn't need to trust that the X-FedTLSAuth-* headers were set by the proxy.
+type BackendToken struct {
+	// The private key used to sign tokens
+	Key jwk.Key
+
+	// Signature algorithm, must match the type of Key
+	Algorithm jwa.SignatureAlgorithm
+
+	// The header to set, and a prefix for the token in it
+	// (for instance "Authorization" and "Bearer ")
+	HeaderName string
+	Prefix     string
+
+	// How long the tokens are valid
+	Lifetime time.Duration
+
+	// Optional iss and aud claims
+	Issuer   string
+	Audience string
+
+	// Names of the claims for the client's entity ID, organization and
+	// organization ID. An empty name leaves that claim out. The
+	// organization claims are also left out if the entity doesn't have them.
+	EntityIDClaim       string
+	OrganizationClaim   string
+	OrganizationIDClaim string
+}
+
+// NewBackendToken creates a BackendToken with a private key loaded from
+// a PEM file, and defaults for everything else: an Authorization: Bearer
+// header, a lifetime of one minute and the claims sub, org and org_id.
+func NewBackendToken(keyFile string, algorithm jwa.SignatureAlgorithm) (*BackendToken, error) {
+	pem, err := os.ReadFile(keyFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := jwk.ParseKey(pem, jwk.WithPEM(true))
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse token signing key (%s): %v", keyFile, err)
+	}
+
+	return &BackendToken{
+		Key:                 key,
+		Algorithm:           algorithm,
+		HeaderName:          "Authorization",
+		Prefix:              "Bearer ",
+		Lifetime:            1 * time.Minute,
+		EntityIDClaim:       "sub",
+		OrganizationClaim:   "org",
+		OrganizationIDClaim: "org_id",
+	}, nil
+}
+
+// Creates a signed token for a client
+func (t *BackendToken) mint(entityID string, org, orgID *string, now time.Time) (string, error) {
+	builder := jwt.NewBuilder().
+		IssuedAt(now).
+		NotBefore(now).
+		Expiration(now.Add(t.Lifetime))
+
+	if t.Issuer != "" {
+		builder = builder.Issuer(t.Issuer)
+	}
+
+	if t.Audience != "" {
+		builder = builder.Audience([]string{t.Audience})
+	}
+
+	if t.EntityIDClaim != "" {
+		builder = builder.Claim(t.EntityIDClaim, entityID)
+	}
+
+	if t.OrganizationClaim != "" && org != nil {
+		builder = builder.Claim(t.OrganizationClaim, *org)
+	}
+
+	if t.OrganizationIDClaim != "" && orgID != nil {
+		builder = builder.Claim(t.OrganizationIDClaim, *orgID)
+	}
+
+	token, err := builder.Build()
+
+	if err != nil {
+		return "", err
+	}
+
+	signed, err := jwt.Sign(token, jwt.WithKey(t.Algorithm, t.Key))
+
+	if err != nil {
+		return "", err
+	}
+	return string(signed), nil
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joesiltberg/bowness/fedtls"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// Creates an ECDSA key and writes it to a PEM file
+func newTestTokenKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "token.key")
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return priv, keyFile
+}
+
+func TestBackendToken(t *testing.T) {
+	priv, keyFile := newTestTokenKey(t)
+
+	token, err := NewBackendToken(keyFile, jwa.ES256)
+	if err != nil {
+		t.Fatalf("Failed to create backend token: %v", err)
+	}
+	token.Issuer = "https://proxy.example.com"
+	token.OrganizationIDClaim = ""
+
+	org := "Example Org"
+	orgID := "SE1234567890"
+	now := time.Now()
+
+	signed, err := token.mint("https://client.example.com", &org, &orgID, now)
+	if err != nil {
+		t.Fatalf("Failed to mint token: %v", err)
+	}
+
+	public, err := jwk.FromRaw(&priv.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to create public key: %v", err)
+	}
+
+	parsed, err := jwt.Parse([]byte(signed), jwt.WithKey(jwa.ES256, public),
+		jwt.WithIssuer("https://proxy.example.com"))
+	if err != nil {
+		t.Fatalf("Failed to verify token: %v", err)
+	}
+
+	if parsed.Subject() != "https://client.example.com" {
+		t.Errorf("Unexpected subject: %s", parsed.Subject())
+	}
+
+	if value, _ := parsed.Get("org"); value != org {
+		t.Errorf("Unexpected org claim: %v", value)
+	}
+
+	if _, ok := parsed.Get("org_id"); ok {
+		t.Errorf("Expected org_id claim to be left out")
+	}
+
+	if !parsed.Expiration().Equal(now.Add(time.Minute).Truncate(time.Second)) {
+		t.Errorf("Unexpected expiration: %v", parsed.Expiration())
+	}
+}
+
+// The middleware replaces whatever the client sent in the token's header
+// with a token for the authenticated entity
+func TestBackendTokenMiddleware(t *testing.T) {
+	priv, keyFile := newTestTokenKey(t)
+	token, err := NewBackendToken(keyFile, jwa.ES256)
+	if err != nil {
+		t.Fatalf("Failed to create backend token: %v", err)
+	}
+
+	root := newTestCert(t, "Root CA", true, nil)
+	client := newTestCert(t, "client", false, root)
+
+	mdstore := fedtls.NewStaticMetadataStore()
+	mdstore.SetMetadata(metadataWithClient("https://example.com", root, client))
+
+	var received string
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("Authorization")
+	})
+	h := AuthMiddleware(backend, mdstore, nil, WithBackendToken(token))
+	connection := &ContextConnection{conn: newVerifiedConn(t, root, client)}
+
+	r := newConnectionRequest(connection, "/")
+	r.Header.Set("Authorization", "Bearer forged")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	signed, ok := strings.CutPrefix(received, "Bearer ")
+	if !ok {
+		t.Fatalf("Unexpected Authorization header: %q", received)
+	}
+
+	public, err := jwk.FromRaw(&priv.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to create public key: %v", err)
+	}
+
+	parsed, err := jwt.Parse([]byte(signed), jwt.WithKey(jwa.ES256, public))
+	if err != nil {
+		t.Fatalf("Failed to verify token from the middleware: %v", err)
+	}
+	if parsed.Subject() != "https://example.com" {
+		t.Errorf("Unexpected subject: %s", parsed.Subject())
+	}
+}
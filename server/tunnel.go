@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// The backend's host and port, with the scheme's default port if the
+// target doesn't have one
+func backendAddress(target *url.URL) string {
+	if target.Port() != "" {
+		return target.Host
+	}
+	if target.Scheme == "https" {
+		return net.JoinHostPort(target.Hostname(), "443")
+	}
+	return net.JoinHostPort(target.Hostname(), "80")
+}
+
+// Opens a connection to the backend, using TLS if the target is https
+func dialBackend(target *url.URL) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+
+	if target.Scheme == "https" {
+		return tls.DialWithDialer(dialer, "tcp", backendAddress(target), &tls.Config{})
+	}
+	return dialer.Dial("tcp", backendAddress(target))
+}
+
+// Copies data in both directions until either side is done
+func pipe(client, backend net.Conn, clientBuffered, backendBuffered io.Reader) {
+	done := make(chan struct{}, 2)
+
+	go func() {
+		io.Copy(backend, clientBuffered)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, backendBuffered)
+		done <- struct{}{}
+	}()
+
+	<-done
+	client.Close()
+	backend.Close()
+	<-done
+}
+
+// Whether w, or a http.ResponseWriter it wraps (see
+// http.ResponseController), can be hijacked
+func hijackable(w http.ResponseWriter) bool {
+	for {
+		if _, ok := w.(http.Hijacker); ok {
+			return true
+		}
+		wrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return false
+		}
+		w = wrapper.Unwrap()
+	}
+}
+
+func tunnel(w http.ResponseWriter, r *http.Request, target *url.URL) {
+	if !hijackable(w) {
+		http.Error(w, "CONNECT not supported on this connection", http.StatusNotImplemented)
+		return
+	}
+
+	backendConn, err := dialBackend(target)
+	if err != nil {
+		log.Printf("Failed to connect to backend for CONNECT: %v", err)
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+		return
+	}
+
+	// Send the CONNECT to the backend, including the headers set by
+	// the authentication middleware
+	outReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: r.Host},
+		Host:   r.Host,
+		Header: r.Header.Clone(),
+	}
+
+	backendReader := bufio.NewReader(backendConn)
+	err = outReq.Write(backendConn)
+	var response *http.Response
+	if err == nil {
+		response, err = http.ReadResponse(backendReader, outReq)
+	}
+
+	if err != nil {
+		backendConn.Close()
+		log.Printf("Failed to send CONNECT to backend: %v", err)
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+		return
+	}
+
+	if response.StatusCode != http.StatusOK {
+		defer backendConn.Close()
+		defer response.Body.Close()
+		for k, v := range response.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(response.StatusCode)
+		io.Copy(w, response.Body)
+		return
+	}
+
+	clientConn, clientBuffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		backendConn.Close()
+		log.Printf("Failed to hijack connection for CONNECT: %v", err)
+		return
+	}
+
+	// The server's timeouts don't apply to the tunnel
+	clientConn.SetDeadline(time.Time{})
+
+	_, err = clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		clientConn.Close()
+		backendConn.Close()
+		return
+	}
+
+	pipe(clientConn, backendConn, clientBuffered, backendReader)
+}
+
+// ConnectTunnel returns a middleware which handles CONNECT requests by
+// forwarding them to the backend at target (which is expected to be a proxy
+// itself) and then tunneling data in both directions between the client and
+// the backend. Other requests are passed on to h.
+//
+// It must be placed after the authentication middleware (so only
+// authenticated clients can open tunnels). It's meant to wrap the backend
+// itself, so rate and concurrency limits and routing apply to tunnels too
+// (a tunnel holds its concurrency slot until it's closed). Middleware in
+// between must let the http.ResponseWriter be hijacked, directly or with
+// an Unwrap method. CONNECT isn't supported for HTTP/2.
+func ConnectTunnel(h http.Handler, target *url.URL) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			h.ServeHTTP(w, r)
+			return
+		}
+		tunnel(w, r, target)
+	})
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/joesiltberg/bowness/fedtls"
+)
+
+// Starts a backend proxy which accepts CONNECT requests and then echoes
+// what the client sends. The entity ID header of each CONNECT is sent
+// on entityIDs.
+func startTunnelBackend(t *testing.T, entityIDs chan<- string) *url.URL {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				r, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				entityIDs <- r.Header.Get(entityIDHeader)
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\n")
+				io.Copy(conn, reader)
+			}()
+		}
+	}()
+
+	return &url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+// Opens a tunnel through the server at addr, returns the connection
+// and the status of the response to CONNECT
+func openTunnel(t *testing.T, addr string, client *testCert) (net.Conn, int) {
+	t.Helper()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{toTLSCertificate(client)},
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "CONNECT backend.example.com:443 HTTP/1.1\r\nHost: backend.example.com:443\r\n\r\n")
+	response, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("Failed to read response to CONNECT: %v", err)
+	}
+	return conn, response.StatusCode
+}
+
+func TestConnectTunnel(t *testing.T) {
+	root := newTestCert(t, "Root CA", true, nil)
+	client := newTestCert(t, "client", false, root)
+
+	mdstore := fedtls.NewStaticMetadataStore()
+	mdstore.SetMetadata(metadataWithClient("https://example.com", root, client))
+
+	entityIDs := make(chan string, 2)
+	target := startTunnelBackend(t, entityIDs)
+
+	// The tunnel is opened through a concurrency limit and a route
+	// timeout, like in Bowness itself
+	notFound := http.NotFoundHandler()
+	h := ConcurrencyLimiter(ConnectTunnel(notFound, target), 1, 0)
+	h = RouteTimeouts(h, nil, time.Second)
+	addr := startTestServer(t, mdstore, h)
+
+	conn, status := openTunnel(t, addr, client)
+	if status != http.StatusOK {
+		t.Fatalf("Expected 200 for CONNECT, got %d", status)
+	}
+
+	select {
+	case entityID := <-entityIDs:
+		if entityID != "https://example.com" {
+			t.Errorf("Expected entity ID header in CONNECT to backend, got %q", entityID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Backend didn't get CONNECT")
+	}
+
+	// The route timeout doesn't apply to the tunnel
+	time.Sleep(1500 * time.Millisecond)
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Expected echo through the tunnel, got %q: %v", buf, err)
+	}
+
+	// The open tunnel holds the only concurrency slot
+	if _, status := openTunnel(t, addr, client); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 for a second tunnel, got %d", status)
+	}
+
+	conn.Close()
+}
+
+func TestBackendAddress(t *testing.T) {
+	expected := map[string]string{
+		"http://proxy.internal":        "proxy.internal:80",
+		"https://proxy.example":        "proxy.example:443",
+		"https://proxy.example:8443/x": "proxy.example:8443",
+		"http://[::1]":                 "[::1]:80",
+	}
+
+	for rawURL, address := range expected {
+		target, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", rawURL, err)
+		}
+		if got := backendAddress(target); got != address {
+			t.Errorf("Expected %s for %s, got %s", address, rawURL, got)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A UserMap maps entity IDs to the IDs the backend uses for its users,
+// so the backend doesn't need to maintain its own mapping.
+//
+// The map can be reloaded at any time, requests see either the old or the
+// new map.
+type UserMap struct {
+	users map[string]string
+	lock  sync.RWMutex
+}
+
+// NewUserMap creates an empty UserMap
+func NewUserMap() *UserMap {
+	return &UserMap{users: make(map[string]string)}
+}
+
+// Load replaces the map with the contents of a file.
+//
+// Each line of the file should contain an entity ID and a user ID,
+// separated by whitespace. Empty lines and lines starting with # are
+// ignored. If the file can't be read or has an invalid line, the map is
+// left unchanged.
+func (m *UserMap) Load(path string) error {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("Invalid line %d in user map (%s), expected entity ID and user ID", lineNumber, path)
+		}
+		users[fields[0]] = fields[1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Failed to read user map (%s): %v", path, err)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.users = users
+	return nil
+}
+
+// Len returns the number of entities in the map
+func (m *UserMap) Len() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return len(m.users)
+}
+
+// Lookup returns the user ID for an entity
+func (m *UserMap) Lookup(entityID string) (string, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	userID, ok := m.users[entityID]
+	return userID, ok
+}
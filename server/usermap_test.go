@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2020-2021 Joe Siltberg
+ *
+ * You should have received a copy of the MIT license along with this project.
+ * If not, see <https://opensource.org/licenses/MIT>.
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joesiltberg/bowness/fedtls"
+)
+
+func TestUserMapLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	content := "# Entity ID, user ID\nhttps://a.example.com 1001\n\nhttps://b.example.com\t1002\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write user map: %v", err)
+	}
+
+	userMap := NewUserMap()
+	if err := userMap.Load(path); err != nil {
+		t.Fatalf("Failed to load user map: %v", err)
+	}
+
+	if userID, ok := userMap.Lookup("https://b.example.com"); !ok || userID != "1002" {
+		t.Errorf("Unexpected user ID for b: %s", userID)
+	}
+
+	// An invalid file leaves the map unchanged
+	if err := os.WriteFile(path, []byte("https://a.example.com 1 2\n"), 0600); err != nil {
+		t.Fatalf("Failed to write user map: %v", err)
+	}
+	if err := userMap.Load(path); err == nil {
+		t.Errorf("Expected an error for an invalid line")
+	}
+	if userMap.Len() != 2 {
+		t.Errorf("Expected the previous map to be kept, got %d entries", userMap.Len())
+	}
+}
+
+func TestUserIDHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte("https://a.example.com 1001\n"), 0600); err != nil {
+		t.Fatalf("Failed to write user map: %v", err)
+	}
+
+	userMap := NewUserMap()
+	if err := userMap.Load(path); err != nil {
+		t.Fatalf("Failed to load user map: %v", err)
+	}
+
+	var got string
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-User-ID")
+	})
+
+	tests := []struct {
+		defaultUserID string
+		entityID      string
+		expected      string
+	}{
+		{"", "https://a.example.com", "1001"},
+		{"", "https://unmapped.example.com", "https://unmapped.example.com"},
+		{"guest", "https://unmapped.example.com", "guest"},
+	}
+
+	for _, test := range tests {
+		h := AuthMiddleware(backend, &fedtls.MetadataStore{}, nil,
+			UserID("X-User-ID", userMap, test.defaultUserID))
+
+		r := newAuthenticatedRequest(test.entityID, "/")
+		r.Header.Set("X-User-ID", "spoofed")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		if got != test.expected {
+			t.Errorf("%s (default %q): expected user ID %s, got %s", test.entityID, test.defaultUserID, test.expected, got)
+		}
+	}
+}
+
+// Without a user map the header isn't set, but a client mustn't be able to
+// send it to the backend either
+func TestUserIDHeaderWithoutMap(t *testing.T) {
+	var got []string
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Values("X-User-ID")
+	})
+
+	h := AuthMiddleware(backend, &fedtls.MetadataStore{}, nil, UserID("X-User-ID", nil, ""))
+
+	r := newAuthenticatedRequest("https://a.example.com", "/")
+	r.Header.Set("X-User-ID", "spoofed")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(got) != 0 {
+		t.Errorf("Spoofed user ID reached the backend: %v", got)
+	}
+}